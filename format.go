@@ -0,0 +1,149 @@
+// format.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// formatModule is a Lua chunk which completes the `fmt` module registered with
+// the placeholder parser (as `fmt.parse`), formatting values with `string.format`
+// in protected mode so that values are formatted exactly as Lua does.
+const formatModule = `
+local fmt, format, pcall, type, ipairs = fmt, string and string.format, pcall, type, ipairs
+if not format then
+  error("string library is not opened", 0)
+end
+local parse = fmt.parse
+fmt.parse = nil
+
+function fmt.format(f, ...)
+  if type(f) ~= "string" then
+    return nil, "format should be a string"
+  end
+  local ok, result = pcall(format, f, ...)
+  if not ok then
+    return nil, result
+  end
+  return result
+end
+
+function fmt.named(template, values)
+  if type(template) ~= "string" then
+    return nil, "template should be a string"
+  end
+  if values ~= nil and type(values) ~= "table" then
+    return nil, "values should be a table, got " .. type(values)
+  end
+  values = values or {}
+
+  local parts, err = parse(template)
+  if not parts then
+    return nil, err
+  end
+  local str = ""
+  for _, part in ipairs(parts) do
+    if type(part) == "string" then
+      str = str .. part
+    else
+      local name, spec, index = part[1], part[2], part[3]
+      local value = values[name]
+      if value == nil and index ~= nil then
+        value = values[index]
+      end
+      if value == nil then
+        return nil, "missing value for placeholder '{" .. name .. "}'"
+      end
+      local ok, result = pcall(format, spec, value)
+      if not ok then
+        return nil, "placeholder '{" .. name .. "}': " .. result
+      end
+      str = str .. result
+    end
+  end
+  return str
+end
+`
+
+// OpenFormat registers a `fmt` module for safe string formatting:
+//
+//	fmt.format(format, ...) -- like string.format
+//	fmt.named(template, values) -- e.g. fmt.named("{name} is {age:%d}", {name = "x", age = 3})
+//
+// Unlike string.format, they don't raise errors on format/argument mismatches,
+// but return nil and an error message instead:
+//
+//	local s, err = fmt.format("%d items", "many")
+//	if not s then print(err) end
+//
+// Values are formatted with string.format itself, so the string library should be opened.
+func (s *State) OpenFormat(ctx context.Context) error {
+	if err := s.RegisterModule(ctx, "fmt", map[string]GoFunction{
+		"parse": func(args []any) ([]any, error) {
+			template, _ := arg[string](args, 0)
+			parts, err := parseNamed(template)
+			if err != nil {
+				return []any{nil, err.Error()}, nil
+			}
+			return []any{parts}, nil
+		},
+	}); err != nil {
+		return err
+	}
+
+	if _, err := s.EvaluateNamed(ctx, "=fmt", formatModule); err != nil {
+		return fmt.Errorf("failed to open fmt module: %w", err)
+	}
+	return nil
+}
+
+// parseNamed splits a template into its parts: literal strings, and placeholders like `{name}`
+// or `{name:%5.2f}` as lists of their names, format specifiers (`%s` by default), and
+// the integer indices of their names (when names are integers, e.g. `{1}`).
+// `{{` and `}}` are escaped braces.
+func parseNamed(template string) ([]any, error) {
+	var parts []any
+	var sb strings.Builder
+
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case c == '{' && strings.HasPrefix(template[i:], "{{"):
+			sb.WriteByte('{')
+			i++
+		case c == '}' && strings.HasPrefix(template[i:], "}}"):
+			sb.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed placeholder at position %d", i+1)
+			}
+			name, spec, _ := strings.Cut(template[i+1:i+end], ":")
+			if spec == "" {
+				spec = "%s"
+			}
+
+			if sb.Len() > 0 {
+				parts = append(parts, sb.String())
+				sb.Reset()
+			}
+			placeholder := []any{name, spec}
+			if n, err := strconv.ParseInt(name, 10, 64); err == nil {
+				placeholder = append(placeholder, n)
+			}
+			parts = append(parts, placeholder)
+			i += end
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if sb.Len() > 0 {
+		parts = append(parts, sb.String())
+	}
+
+	return parts, nil
+}
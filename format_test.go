@@ -0,0 +1,141 @@
+package lua
+
+import (
+	"context"
+	"testing"
+)
+
+// TestOpenFormat tests safe string formatting with the `fmt` module.
+func TestOpenFormat(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.OpenFormat(ctx); err != nil {
+		t.Fatalf("OpenFormat failed with error: %v", err)
+	}
+
+	for code, expected := range map[string]string{
+		`return fmt.format("%d items", 3)`:                                  "3 items",
+		`return fmt.format("%5.2f|%-4s|%x|%%", 3.14159, "ab", 255)`:         " 3.14|ab  |ff|%",
+		`return fmt.format("%s %s %s", 1, 2.0, nil)`:                        "1 2.0 nil",
+		`return fmt.format("%i %c", 42, 65)`:                                "42 A",
+		`return fmt.named("{name} is {age:%03d}", {name = "lua", age = 7})`: "lua is 007",
+		`return fmt.named("{{{1}}} and {2}", {"first", "second"})`:          "{first} and second",
+	} {
+		results, err := s.Evaluate(ctx, code)
+		if err != nil {
+			t.Errorf("Evaluate(`%s`) failed with error: %v", code, err)
+		} else if len(results) != 1 || results[0] != expected {
+			t.Errorf("Evaluate(`%s`) = %v, want [%s]", code, results, expected)
+		}
+	}
+
+	// mismatches return an error instead of aborting the script
+	for _, code := range []string{
+		`return fmt.format("%d items", "many")`,
+		`return fmt.format("%d and %d", 1)`,
+		`return fmt.format("%d", 1.5)`,
+		`return fmt.format("%y", 1)`,
+		`return fmt.named("{missing}", {})`,
+		`return fmt.named("{unclosed", {})`,
+	} {
+		results, err := s.Evaluate(ctx, code)
+		if err != nil {
+			t.Errorf("Evaluate(`%s`) failed with error: %v", code, err)
+		} else if len(results) != 2 || results[0] != nil || results[1] == nil {
+			t.Errorf("Evaluate(`%s`) = %v, want [nil, <error message>]", code, results)
+		}
+	}
+
+	// the script continues after a mismatch
+	results, err := s.Evaluate(ctx, `
+		local str, err = fmt.format("%d", "x")
+		if not str then return "recovered: " .. err end
+	`)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if str := results[0].(string); str != "recovered: bad argument #2 to 'string.format' (number expected, got string)" {
+		t.Errorf("Unexpected result: %s", str)
+	}
+}
+
+// TestFormatLikeStringFormat tests that fmt.format and fmt.named give the same outputs as string.format.
+func TestFormatLikeStringFormat(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.OpenFormat(ctx); err != nil {
+		t.Fatalf("OpenFormat failed with error: %v", err)
+	}
+
+	for _, args := range []string{
+		`"%q", "plain"`,
+		`"%q", "quote \" backslash \\ newline \n return \r tab \t"`,
+		`"%q", "nul \0 then digit \0001 and bell \a9 del \127"`,
+		`"%q", "zero width \u{200B} and \xff bytes"`,
+		`"%q", 42`,
+		`"%q", -7`,
+		`"%q", math.mininteger`,
+		`"%q", 1.5`,
+		`"%q", 0.1`,
+		`"%q", -2.0`,
+		`"%q", 1e300`,
+		`"%q", math.huge`,
+		`"%q", -math.huge`,
+		`"%q", true`,
+		`"%q", nil`,
+		`"%x %X %o", -1, -255, -8`,
+		`"%x|%5X|%#o", 255, 171, 8`,
+		`"%x", math.mininteger`,
+		`"%c", 200`,
+		`"%a %A", 1.0, 0.5`,
+		`"%s %10.3s", _G, "truncated"`,
+		`"%s", setmetatable({}, {__tostring = function() return "obj" end})`,
+		`"%s %s %.3f", 123456789012345.0, 1e100, 2/3`,
+	} {
+		results, err := s.Evaluate(ctx, `return string.format(`+args+`), fmt.format(`+args+`)`)
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed with error: %v", args, err)
+		} else if results[0] != results[1] {
+			t.Errorf("fmt.format(%s) = %v, want %v (as string.format)", args, results[1], results[0])
+		}
+	}
+
+	for _, args := range [][2]string{
+		{`"%c", 200`, `"{1:%c}", {200}`},
+		{`"%a", 1.0`, `"{x:%a}", {x = 1.0}`},
+		{`"%s", _G`, `"{g}", {g = _G}`},
+		{`"%s", 123456789012345.0`, `"{n}", {n = 123456789012345.0}`},
+	} {
+		results, err := s.Evaluate(ctx, `return string.format(`+args[0]+`), fmt.named(`+args[1]+`)`)
+		if err != nil {
+			t.Errorf("Evaluate(%s) failed with error: %v", args[1], err)
+		} else if results[0] != results[1] {
+			t.Errorf("fmt.named(%s) = %v, want %v (as string.format)", args[1], results[1], results[0])
+		}
+	}
+
+	// quoted values are read back as they were
+	results, err := s.Evaluate(ctx, `
+		for _, v in ipairs({"a\0001\r\n\"\\", "\u{200B}\xff", math.mininteger, 0.1, 1/3, 2^63}) do
+			local q = fmt.format("%q", v)
+			local back = load("return " .. q)()
+			if back ~= v or math.type(back) ~= math.type(v) then
+				return q
+			end
+		end
+		return "ok"`)
+	if err != nil || results[0] != "ok" {
+		t.Errorf("Expected quoted values to be read back, got %v (error: %v)", results, err)
+	}
+
+	// NaN is quoted as (0/0), like string.format
+	if results, err := s.Evaluate(ctx, `return fmt.format("%q", 0/0)`); err != nil || results[0] != "(0/0)" {
+		t.Errorf("Expected (0/0), got %v (error: %v)", results, err)
+	}
+}
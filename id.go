@@ -0,0 +1,56 @@
+// id.go
+
+package lua
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand/v2"
+	"sync"
+)
+
+// SetIDGenerator registers a global Lua function `new_id()` which returns
+// a new ID generated by the given Go function.
+//
+// Use RandomIDGenerator for real IDs, or SeededIDGenerator for reproducible ones (e.g. in tests).
+func (s *State) SetIDGenerator(ctx context.Context, gen func() string) error {
+	return s.RegisterFunction(ctx, "new_id", func(args []any) ([]any, error) {
+		return []any{gen()}, nil
+	})
+}
+
+// RandomIDGenerator returns an ID generator which generates random (version 4) UUIDs.
+func RandomIDGenerator() func() string {
+	return func() string {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		return formatUUID(b)
+	}
+}
+
+// SeededIDGenerator returns an ID generator which generates UUID-formatted IDs
+// in a deterministic sequence derived from the given seed.
+func SeededIDGenerator(seed uint64) func() string {
+	var mu sync.Mutex
+	r := mrand.New(mrand.NewPCG(seed, seed))
+
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var b [16]byte
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		return formatUUID(b)
+	}
+}
+
+// formatUUID formats given bytes as a version 4 UUID string.
+func formatUUID(b [16]byte) string {
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,59 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// TestSetIDGenerator tests the `new_id()` function backed by a Go generator.
+func TestSetIDGenerator(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// deterministic sequence
+	n := 0
+	if err := s.SetIDGenerator(ctx, func() string {
+		n++
+		return fmt.Sprintf("id-%d", n)
+	}); err != nil {
+		t.Fatalf("SetIDGenerator failed with error: %v", err)
+	}
+
+	results, err := s.Evaluate(ctx, `return new_id(), new_id(), new_id()`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if len(results) != 3 ||
+		results[0].(string) != "id-1" ||
+		results[1].(string) != "id-2" ||
+		results[2].(string) != "id-3" {
+		t.Errorf(`Evaluate("return new_id(), new_id(), new_id()") = %v, want [id-1 id-2 id-3]`, results)
+	}
+}
+
+// TestIDGenerators tests the random and seeded ID generators.
+func TestIDGenerators(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	// seeded generators with the same seed generate the same sequence
+	gen1, gen2 := SeededIDGenerator(42), SeededIDGenerator(42)
+	for range 3 {
+		id1, id2 := gen1(), gen2()
+		if id1 != id2 {
+			t.Errorf("SeededIDGenerator(42) generated different IDs: %s, %s", id1, id2)
+		}
+		if !uuid.MatchString(id1) {
+			t.Errorf("SeededIDGenerator(42) generated an invalid UUID: %s", id1)
+		}
+	}
+
+	// random generator
+	gen := RandomIDGenerator()
+	if id1, id2 := gen(), gen(); id1 == id2 || !uuid.MatchString(id1) || !uuid.MatchString(id2) {
+		t.Errorf("RandomIDGenerator generated invalid or duplicated IDs: %s, %s", id1, id2)
+	}
+}
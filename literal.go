@@ -0,0 +1,305 @@
+// literal.go
+
+package lua
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// luaKeywords is the set of reserved words of Lua, which cannot be used as identifiers.
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+// ToLuaLiteral renders a Go value as Lua source code which evaluates to an equal value
+// (e.g. for generating scripts from templates), like `{1, 2, a = "x", ["b c"] = true}`.
+//
+// Supported types are nil, booleans, integers, floats, strings, []any, map[any]any, and
+// *OrderedTable (with elements of supported types). Elements 1..n of maps are rendered as
+// a sequence, other keys are rendered in a deterministic order (or the order of OrderedTable),
+// and keys which are not valid identifiers are quoted. Values of other types, nil or NaN keys,
+// and tables which reference themselves are rejected with an error.
+func ToLuaLiteral(v any) (string, error) {
+	var sb strings.Builder
+	if err := writeLuaLiteral(&sb, v, map[any]bool{}); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// writeLuaLiteral writes the Lua literal of a Go value, with the tables being written as ancestors.
+func writeLuaLiteral(sb *strings.Builder, v any, ancestors map[any]bool) error {
+	if n, ok := literalInteger(v); ok {
+		if n == math.MinInt64 {
+			// `-9223372036854775808` would be read as the negation of a float
+			sb.WriteString("(-9223372036854775807 - 1)")
+		} else {
+			sb.WriteString(strconv.FormatInt(n, 10))
+		}
+		return nil
+	}
+
+	switch v := v.(type) {
+	case nil:
+		sb.WriteString("nil")
+	case bool:
+		sb.WriteString(strconv.FormatBool(v))
+	case uint:
+		writeFloatLiteral(sb, float64(v))
+	case uint64:
+		writeFloatLiteral(sb, float64(v)) // beyond the range of Lua integers
+	case float32:
+		writeFloatLiteral(sb, float64(v))
+	case float64:
+		writeFloatLiteral(sb, v)
+	case string:
+		writeStringLiteral(sb, v)
+	case []any:
+		if len(v) > 0 {
+			ptr := reflect.ValueOf(v).UnsafePointer()
+			if ancestors[ptr] {
+				return fmt.Errorf("cycle detected")
+			}
+			ancestors[ptr] = true
+			defer delete(ancestors, ptr)
+		}
+
+		sb.WriteByte('{')
+		for i, elem := range v {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			if err := writeLuaLiteral(sb, elem, ancestors); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		sb.WriteByte('}')
+	case map[any]any:
+		ptr := reflect.ValueOf(v).UnsafePointer()
+		if ancestors[ptr] {
+			return fmt.Errorf("cycle detected")
+		}
+		ancestors[ptr] = true
+		defer delete(ancestors, ptr)
+
+		keys := make([]any, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, compareLiteralKeys)
+
+		return writeTableLiteral(sb, keys, func(key any) any { return v[key] }, ancestors)
+	case *OrderedTable:
+		if v == nil {
+			sb.WriteString("nil")
+			return nil
+		}
+		if ancestors[v] {
+			return fmt.Errorf("cycle detected")
+		}
+		ancestors[v] = true
+		defer delete(ancestors, v)
+
+		return writeTableLiteral(sb, v.Keys(), func(key any) any {
+			value, _ := v.Get(key)
+			return value
+		}, ancestors)
+	default:
+		return fmt.Errorf("unsupported Go type: %T", v)
+	}
+	return nil
+}
+
+// writeTableLiteral writes a table constructor with the given keys (in order) and their values.
+// Keys 1..n are written as a sequence (without keys) first.
+func writeTableLiteral(sb *strings.Builder, keys []any, value func(key any) any, ancestors map[any]bool) error {
+	var seq []any
+	for _, key := range keys {
+		if n, ok := literalInteger(key); ok && n == int64(len(seq))+1 {
+			seq = append(seq, key)
+		}
+	}
+
+	sb.WriteByte('{')
+	for i, key := range seq {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		if err := writeLuaLiteral(sb, value(key), ancestors); err != nil {
+			return fmt.Errorf("value for key %d: %w", i+1, err)
+		}
+	}
+
+	written := len(seq) > 0
+	for _, key := range keys {
+		if n, ok := literalInteger(key); ok && n >= 1 && n <= int64(len(seq)) {
+			continue
+		}
+		if written {
+			sb.WriteString(", ")
+		}
+		written = true
+
+		switch k := key.(type) {
+		case nil:
+			return fmt.Errorf("nil is not allowed as a table key")
+		case float64:
+			if math.IsNaN(k) {
+				return fmt.Errorf("NaN is not allowed as a table key")
+			}
+		case string:
+			if isLuaIdentifier(k) {
+				sb.WriteString(k)
+				sb.WriteString(" = ")
+				if err := writeLuaLiteral(sb, value(key), ancestors); err != nil {
+					return fmt.Errorf("value for key %v: %w", key, err)
+				}
+				continue
+			}
+		}
+
+		sb.WriteByte('[')
+		if err := writeLuaLiteral(sb, key, ancestors); err != nil {
+			return fmt.Errorf("key %v: %w", key, err)
+		}
+		sb.WriteString("] = ")
+		if err := writeLuaLiteral(sb, value(key), ancestors); err != nil {
+			return fmt.Errorf("value for key %v: %w", key, err)
+		}
+	}
+	sb.WriteByte('}')
+
+	return nil
+}
+
+// compareLiteralKeys orders table keys: numbers (ascending), then strings, then booleans, then others.
+func compareLiteralKeys(a, b any) int {
+	rank := func(key any) (int, float64, string) {
+		if n, ok := literalInteger(key); ok {
+			return 0, float64(n), ""
+		}
+		switch k := key.(type) {
+		case float32:
+			return 0, float64(k), ""
+		case float64:
+			return 0, k, ""
+		case string:
+			return 1, 0, k
+		case bool:
+			return 2, 0, strconv.FormatBool(k)
+		}
+		return 3, 0, fmt.Sprint(key)
+	}
+
+	rankA, numA, strA := rank(a)
+	rankB, numB, strB := rank(b)
+	if c := cmp.Compare(rankA, rankB); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(numA, numB); c != 0 {
+		return c
+	}
+	return cmp.Compare(strA, strB)
+}
+
+// literalInteger returns a Go integer (which fits in a Lua integer) as int64.
+func literalInteger(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		if uint64(v) <= math.MaxInt64 {
+			return int64(v), true
+		}
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// writeFloatLiteral writes a float which is read back as a float (not an integer) by Lua.
+func writeFloatLiteral(sb *strings.Builder, f float64) {
+	switch {
+	case math.IsInf(f, 1):
+		sb.WriteString("(1/0)")
+	case math.IsInf(f, -1):
+		sb.WriteString("(-1/0)")
+	case math.IsNaN(f):
+		sb.WriteString("(0/0)")
+	default:
+		str := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(str, ".e") {
+			str += ".0"
+		}
+		sb.WriteString(str)
+	}
+}
+
+// writeStringLiteral writes a quoted Lua string, escaping quotes, backslashes,
+// control characters, and bytes which are not valid UTF-8.
+func writeStringLiteral(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"':
+			sb.WriteString(`\"`)
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f || (r == utf8.RuneError && size == 1):
+			// three digits, so that following digits are not taken as a part of the escape
+			fmt.Fprintf(sb, `\%03d`, s[i])
+		default:
+			sb.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	sb.WriteByte('"')
+}
+
+// isLuaIdentifier returns whether a string is a valid Lua identifier (and not a keyword).
+func isLuaIdentifier(s string) bool {
+	if s == "" || luaKeywords[s] {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package lua
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestToLuaLiteral tests rendering Go values as Lua literals.
+func TestToLuaLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		value    any
+		expected string
+	}{
+		{nil, `nil`},
+		{true, `true`},
+		{int64(42), `42`},
+		{-7, `-7`},
+		{int64(math.MinInt64), `(-9223372036854775807 - 1)`},
+		{2.0, `2.0`},
+		{-0.5, `-0.5`},
+		{1e300, `1e+300`},
+		{math.Inf(-1), `(-1/0)`},
+		{"a \"quoted\"\n\\ line", `"a \"quoted\"\n\\ line"`},
+		{"\x00\x01" + "2\xff한", `"\000\0012\255한"`},
+		{[]any{}, `{}`},
+		{[]any{int64(1), "two", []any{3.5}}, `{1, "two", {3.5}}`},
+		{map[any]any{int64(1): int64(1), int64(2): int64(2), "a": "x"}, `{1, 2, a = "x"}`},
+		{map[any]any{"b c": true, "end": false, "_ok1": nil, int64(3): "three", 1.5: "x", false: int64(0)}, `{[1.5] = "x", [3] = "three", _ok1 = nil, ["b c"] = true, ["end"] = false, [false] = 0}`},
+	} {
+		literal, err := ToLuaLiteral(tc.value)
+		if err != nil {
+			t.Errorf("ToLuaLiteral(%#v) failed with error: %v", tc.value, err)
+		} else if literal != tc.expected {
+			t.Errorf("ToLuaLiteral(%#v) = %s, want %s", tc.value, literal, tc.expected)
+		}
+	}
+
+	// ordered tables keep their orders
+	s := NewStateWithOptions(Options{OrderedTables: true})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `local t = {} t.z = 1 t.a = {"x", "y"} t[10] = "ten" return t`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	literal, err := ToLuaLiteral(results[0])
+	if err != nil {
+		t.Fatalf("ToLuaLiteral failed with error: %v", err)
+	}
+	fields := map[any]string{"z": `z = 1`, "a": `a = {"x", "y"}`, int64(10): `[10] = "ten"`}
+	pos := 0
+	for _, key := range results[0].(*OrderedTable).Keys() {
+		i := strings.Index(literal, fields[key])
+		if i < pos {
+			t.Errorf("Expected %s in the order of %v, got %s", fields[key], results[0].(*OrderedTable).Keys(), literal)
+		}
+		pos = i
+	}
+
+	// round trip
+	value := map[any]any{
+		"name":   "lua\x00go",
+		"list":   []any{int64(1), 2.5, "three", false},
+		"nested": map[any]any{int64(1): "a", int64(2): "b", "k": map[any]any{"deep": int64(math.MaxInt64)}},
+		"min":    int64(math.MinInt64),
+		"float":  3.0,
+	}
+	literal, err = ToLuaLiteral(value)
+	if err != nil {
+		t.Fatalf("ToLuaLiteral failed with error: %v", err)
+	}
+	s2 := NewState()
+	defer s2.Close()
+	results, err = s2.Evaluate(ctx, "return "+literal)
+	if err != nil {
+		t.Fatalf("Evaluate(%s) failed with error: %v", literal, err)
+	}
+	if expected := map[any]any{
+		"name":   "lua\x00go",
+		"list":   []any{int64(1), 2.5, "three", false},
+		"nested": map[any]any{int64(1): "a", int64(2): "b", "k": map[any]any{"deep": int64(math.MaxInt64)}},
+		"min":    int64(math.MinInt64),
+		"float":  3.0,
+	}; !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("Expected %v, got %v (from %s)", expected, results[0], literal)
+	}
+
+	// errors
+	cyclic := map[any]any{}
+	cyclic["self"] = []any{cyclic}
+	for _, value := range []any{
+		cyclic,
+		map[any]any{math.NaN(): 1},
+		map[any]any{nil: 1},
+		[]any{make(chan int)},
+		struct{}{},
+	} {
+		if _, err := ToLuaLiteral(value); err == nil {
+			t.Errorf("Expected an error for %#v", value)
+		}
+	}
+	if _, err := ToLuaLiteral(cyclic); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+}
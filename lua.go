@@ -5,6 +5,10 @@ package lua
 
 import (
 	"context"
+	"io"
+	"io/fs"
+	"time"
+	"unsafe"
 
 	"github.com/meinside/lua-go/luasrc"
 )
@@ -14,6 +18,130 @@ func Version() string {
 	return luasrc.Version()
 }
 
+// VersionNumber returns the numeric components of the Lua version (e.g., 5, 4, 8).
+func VersionNumber() (major, minor, patch int) {
+	return luasrc.VersionNumber()
+}
+
+// DefaultMaxCoroutines is the default maximum number of live coroutines
+// which scripts can create.
+const DefaultMaxCoroutines = luasrc.DefaultMaxCoroutines
+
+// DefaultMaxTableDepth is the default maximum depth of nested tables which are converted between Lua and Go.
+const DefaultMaxTableDepth = luasrc.DefaultMaxTableDepth
+
+// DefaultChunkCacheSize is the default number of functions compiled by Execute and Evaluate which are cached.
+const DefaultChunkCacheSize = luasrc.DefaultChunkCacheSize
+
+// HoleMode specifies how tables with holes (nil elements) in their sequences are converted to Go values.
+type HoleMode = luasrc.HoleMode
+
+// HoleMode constants
+const (
+	HolesAsMap = luasrc.HolesAsMap
+	HolesAsNil = luasrc.HolesAsNil
+)
+
+// Options is a set of options for creating a State.
+type Options = luasrc.Options
+
+// ErrorKind is the kind of a LuaError.
+type ErrorKind = luasrc.ErrorKind
+
+// ErrorKind constants
+const (
+	KindSyntax  = luasrc.KindSyntax
+	KindRuntime = luasrc.KindRuntime
+	KindMemory  = luasrc.KindMemory
+)
+
+// ErrStateClosed is returned by operations on a closed State.
+var ErrStateClosed = luasrc.ErrStateClosed
+
+// ErrStopped is returned by operations interrupted with State.Stop.
+var ErrStopped = luasrc.ErrStopped
+
+// ErrPoisoned is returned (wrapped) by operations on a State which was poisoned by an error outside
+// of protected mode (which would abort the process otherwise). A poisoned State cannot be used anymore.
+var ErrPoisoned = luasrc.ErrPoisoned
+
+// ErrCloseTimeout is returned by State.CloseTimeout when the state is not closed in time.
+var ErrCloseTimeout = luasrc.ErrCloseTimeout
+
+// Sentinel errors for the kinds of LuaErrors, for use with errors.Is.
+var (
+	ErrSyntax  = luasrc.ErrSyntax
+	ErrRuntime = luasrc.ErrRuntime
+	ErrMemory  = luasrc.ErrMemory
+
+	// ErrStackOverflow matches runtime errors of runaway recursion, which overflowed the stack.
+	ErrStackOverflow = luasrc.ErrStackOverflow
+)
+
+// LuaError is an error returned from Lua.
+type LuaError = luasrc.LuaError
+
+// GCStats is the statistics of the Lua garbage collector.
+type GCStats = luasrc.GCStats
+
+// GCMode is an operation of the Lua garbage collector for State.GC.
+type GCMode = luasrc.GCMode
+
+// GCMode constants
+const (
+	GCCollect = luasrc.GCCollect
+	GCStep    = luasrc.GCStep
+	GCStop    = luasrc.GCStop
+	GCRestart = luasrc.GCRestart
+)
+
+// GoFunction is a Go function which can be called from Lua.
+type GoFunction = luasrc.GoFunction
+
+// GoFunctionContext is a Go function which can be called from Lua,
+// receiving the context of the running operation.
+type GoFunctionContext = luasrc.GoFunctionContext
+
+// Trace is a record of what a script did while being evaluated.
+type Trace = luasrc.Trace
+
+// TraceCall is a record of a call to a registered Go function.
+type TraceCall = luasrc.TraceCall
+
+// Thunk is a one-shot handle to a Lua function.
+type Thunk = luasrc.Thunk
+
+// Library is a standard Lua library which can be opened in a sandboxed state.
+type Library = luasrc.Library
+
+// Library constants
+const (
+	LibCoroutine = luasrc.LibCoroutine
+	LibTable     = luasrc.LibTable
+	LibString    = luasrc.LibString
+	LibMath      = luasrc.LibMath
+	LibUTF8      = luasrc.LibUTF8
+	LibIO        = luasrc.LibIO
+	LibOS        = luasrc.LibOS
+	LibPackage   = luasrc.LibPackage
+	LibDebug     = luasrc.LibDebug
+)
+
+// LuaRef is a reusable handle to a Lua function.
+type LuaRef = luasrc.LuaRef
+
+// Chunk is a compiled Lua chunk which can be called repeatedly without re-parsing its code.
+type Chunk = luasrc.Chunk
+
+// Tx runs operations of a batch (see State.Batch) directly on the worker goroutine.
+type Tx = luasrc.Tx
+
+// Coroutine is a Lua coroutine which is resumed step by step from Go.
+type Coroutine = luasrc.Coroutine
+
+// OrderedTable is a Lua table converted to Go, preserving the iteration order of its keys.
+type OrderedTable = luasrc.OrderedTable
+
 // State wraps the low-level Lua state.
 type State struct {
 	s *luasrc.State
@@ -24,22 +152,382 @@ func NewState() *State {
 	return &State{s: luasrc.NewState()}
 }
 
-// Close closes the Lua state.
+// NewStateWithOptions creates a new Lua state with given options.
+func NewStateWithOptions(opts Options) *State {
+	return &State{s: luasrc.NewStateWithOptions(opts)}
+}
+
+// Scheduler runs operations of many States on a fixed number of worker threads,
+// instead of one worker goroutine (locked to an OS thread) per State.
+type Scheduler = luasrc.Scheduler
+
+// NewScheduler creates a new Scheduler with the given number of worker threads
+// (runtime.GOMAXPROCS(0) if it is not positive).
+func NewScheduler(threads int) *Scheduler {
+	return luasrc.NewScheduler(threads)
+}
+
+// NewStateOnScheduler creates a new Lua state whose operations run on the given Scheduler.
+//
+// States on a Scheduler should be closed before it.
+func NewStateOnScheduler(sched *Scheduler) *State {
+	return &State{s: luasrc.NewStateOnScheduler(sched)}
+}
+
+// Clone creates a new State (with the same options) which has copies of the globals defined by
+// scripts, e.g. for branching independent copies of an expensive base environment.
+//
+// Tables are copied deeply, and Lua functions are copied as bytecode with their upvalues.
+// It fails if the globals hold values which cannot be copied, like Go functions and userdata.
+func (s *State) Clone(ctx context.Context) (*State, error) {
+	clone, err := s.s.Clone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &State{s: clone}, nil
+}
+
+// NewSandboxedState creates a new Lua state which opens only the base library
+// (without `dofile` and `loadfile`) and given standard libraries.
+//
+// Globals of the libraries which are not opened (e.g. `os`, `io`, `package`, `require`,
+// and `debug`) are nil.
+func NewSandboxedState(libs ...Library) *State {
+	return &State{s: luasrc.NewSandboxedState(libs...)}
+}
+
+// NewStateWithLimits creates a new Lua state with resource limits (e.g. MaxMemoryBytes) in given options.
+//
+// It is the same as NewStateWithOptions, named for readability at call sites.
+func NewStateWithLimits(opts Options) *State {
+	return NewStateWithOptions(opts)
+}
+
+// SetLineHook sets fn to be called on each line of Lua code executed (e.g. for a step debugger),
+// with the source (chunk name) and the line number. A nil fn removes the hook.
+//
+// As fn is called on the worker goroutine, it must not call methods of this State itself.
+func (s *State) SetLineHook(ctx context.Context, fn func(source string, line int)) error {
+	return s.s.SetLineHook(ctx, fn)
+}
+
+// SetDefaultTimeout sets the default timeout of operations whose contexts have no deadlines.
+func (s *State) SetDefaultTimeout(d time.Duration) {
+	s.s.SetDefaultTimeout(d)
+}
+
+// Stop interrupts the operation which is currently running, making it fail with ErrStopped.
+// It is safe to call from any goroutine.
+func (s *State) Stop() {
+	s.s.Stop()
+}
+
+// Reset closes the current lua_State and opens a fresh one (with the same options),
+// wiping all globals and everything set up on it (e.g. registered Go functions).
+func (s *State) Reset(ctx context.Context) error {
+	return s.s.Reset(ctx)
+}
+
+// Close closes the Lua state, and waits until it is closed.
+//
+// It is safe to call Close multiple times.
 func (s *State) Close() {
 	s.s.Close()
 }
 
+// CloseTimeout interrupts the running operation, closes the Lua state, and waits up to
+// the grace period d until it is closed.
+//
+// It returns ErrCloseTimeout if the running operation cannot be interrupted in time
+// (e.g. a Go function called from Lua blocks). The state is closed when the operation
+// returns, and until then its worker goroutine is stuck.
+func (s *State) CloseTimeout(d time.Duration) error {
+	return s.s.CloseTimeout(d)
+}
+
 // Execute executes a string of Lua code.
 func (s *State) Execute(ctx context.Context, code string) error {
 	return s.s.Execute(ctx, code)
 }
 
+// ExecuteNamed executes a string of Lua code as a chunk with the given name, which is used
+// in error messages instead of the code itself (e.g. "@script.lua" for `script.lua:1:`).
+func (s *State) ExecuteNamed(ctx context.Context, name, code string) error {
+	return s.s.ExecuteNamed(ctx, name, code)
+}
+
+// ExecuteFile executes a Lua script file.
+func (s *State) ExecuteFile(ctx context.Context, path string) error {
+	return s.s.ExecuteFile(ctx, path)
+}
+
 // GetGlobal gets a global variable from the Lua state.
-func (s *State) GetGlobal(ctx context.Context, name string) any {
+//
+// It fails if the state is closed, ctx is done, or the variable cannot be converted.
+func (s *State) GetGlobal(ctx context.Context, name string) (any, error) {
 	return s.s.GetGlobal(ctx, name)
 }
 
+// GetGlobals gets global variables with the given names at once, keyed by their names.
+// Undefined variables are included as nil.
+func (s *State) GetGlobals(ctx context.Context, names ...string) (map[string]any, error) {
+	return s.s.GetGlobals(ctx, names...)
+}
+
+// Batch runs fn on the worker goroutine in a single round-trip, so that the operations of tx
+// do not pay the synchronization of separate calls. The first error from fn aborts the batch.
+//
+// As fn runs on the worker goroutine, it must not call methods of the State itself.
+func (s *State) Batch(ctx context.Context, fn func(tx *Tx) error) error {
+	return s.s.Batch(ctx, fn)
+}
+
+// RangeGlobalArray calls fn for each element (with its 1-based index) of a global array,
+// until fn returns false, without converting the whole array to a Go slice.
+//
+// As fn runs on the worker goroutine, it must not call methods of the State itself.
+func (s *State) RangeGlobalArray(ctx context.Context, name string, fn func(index int, value any) bool) error {
+	return s.s.RangeGlobalArray(ctx, name, fn)
+}
+
+// PushUserdata exposes an opaque Go object (e.g. a database handle) to Lua as a userdata
+// in the global variable with the given name, with methods called like `obj:method(...)`.
+//
+// Userdata values passed back to Go are converted to the object.
+// As methods are called on the worker goroutine, they must not call methods of this State itself.
+func (s *State) PushUserdata(ctx context.Context, name string, obj any, methods map[string]func(self any, args []any) ([]any, error)) error {
+	return s.s.PushUserdata(ctx, name, obj, methods)
+}
+
+// SetField sets a field of an existing table, reached by its dotted path from the global table
+// (e.g. "config.server"), to a Go value, without replacing the whole table.
+func (s *State) SetField(ctx context.Context, tablePath, key string, value any) error {
+	return s.s.SetField(ctx, tablePath, key, value)
+}
+
+// GetGlobalTable gets a global table with string keys (e.g. a config table) as map[string]any.
+func (s *State) GetGlobalTable(ctx context.Context, name string) (map[string]any, error) {
+	return s.s.GetGlobalTable(ctx, name)
+}
+
+// HasGlobal returns whether a global variable has a non-nil value.
+//
+// As Lua does not distinguish an unset global from a global set to nil, both are reported as false.
+func (s *State) HasGlobal(ctx context.Context, name string) (bool, error) {
+	return s.s.HasGlobal(ctx, name)
+}
+
+// GetGlobalBytes gets a global Lua string as a byte slice, without UTF-8 assumptions.
+func (s *State) GetGlobalBytes(ctx context.Context, name string) ([]byte, error) {
+	return s.s.GetGlobalBytes(ctx, name)
+}
+
+// SetGlobal sets a Go value as a global variable in the Lua state.
+func (s *State) SetGlobal(ctx context.Context, name string, value any) error {
+	return s.s.SetGlobal(ctx, name, value)
+}
+
 // Evaluate evaluates a string of Lua code and returns its results.
 func (s *State) Evaluate(ctx context.Context, code string) ([]any, error) {
 	return s.s.Evaluate(ctx, code)
 }
+
+// EvaluateTimeout evaluates a string of Lua code with the given timeout and returns its results.
+// When the timeout expires, the code is interrupted and context.DeadlineExceeded is returned.
+func (s *State) EvaluateTimeout(code string, timeout time.Duration) ([]any, error) {
+	return s.s.EvaluateTimeout(code, timeout)
+}
+
+// CallGlobal calls a global Lua function with given arguments and returns its results.
+func (s *State) CallGlobal(ctx context.Context, name string, args ...any) ([]any, error) {
+	return s.s.CallGlobal(ctx, name, args...)
+}
+
+// EvaluateIncremental evaluates a (possibly partial) input of an interactive console,
+// as an expression if it is one, or as statements otherwise.
+//
+// When the input is incomplete (e.g. an unclosed `function`), it returns incomplete == true
+// without an error, so that more lines can be read and evaluated together.
+func (s *State) EvaluateIncremental(ctx context.Context, code string) (results []any, incomplete bool, err error) {
+	return s.s.EvaluateIncremental(ctx, code)
+}
+
+// EvaluateExpr evaluates a string of Lua code which may be a bare expression (e.g. `1 + 2`) and returns its results.
+// It is loaded as an expression first, and as statements (like Evaluate) when it is not an expression.
+func (s *State) EvaluateExpr(ctx context.Context, code string) ([]any, error) {
+	return s.s.EvaluateExpr(ctx, code)
+}
+
+// EvaluateNamed executes a string of Lua code as a chunk with the given name and returns its results.
+// The name is used in error messages instead of the code itself (e.g. "=config" for `config:1:`).
+func (s *State) EvaluateNamed(ctx context.Context, name, code string) ([]any, error) {
+	return s.s.EvaluateNamed(ctx, name, code)
+}
+
+// EvaluateReader executes Lua code read from r as a chunk with the given name ("=reader" if empty)
+// and returns its results, loading the code in chunks instead of reading it into a string first.
+//
+// An error from r is returned (wrapped) as it is, instead of a LuaError.
+func (s *State) EvaluateReader(ctx context.Context, r io.Reader, name string) ([]any, error) {
+	return s.s.EvaluateReader(ctx, r, name)
+}
+
+// EvaluateWithArgs executes a string of Lua code with given arguments (passed as varargs) and returns its results.
+func (s *State) EvaluateWithArgs(ctx context.Context, code string, args ...any) ([]any, error) {
+	return s.s.EvaluateWithArgs(ctx, code, args...)
+}
+
+// CallPath calls a Lua function by its dotted path (e.g. "json.encode", or "obj:render" for
+// a method call with `self`) with given arguments, and returns its results.
+func (s *State) CallPath(ctx context.Context, path string, args ...any) ([]any, error) {
+	return s.s.CallPath(ctx, path, args...)
+}
+
+// EvaluateExplain evaluates a string of Lua code and returns its results,
+// along with a trace which records every call to registered Go functions and the final result.
+func (s *State) EvaluateExplain(ctx context.Context, code string) ([]any, Trace, error) {
+	return s.s.EvaluateExplain(ctx, code)
+}
+
+// EvaluateIsolated evaluates a string of Lua code in a fresh environment and returns its results.
+//
+// Writes to global variables are kept in the environment, which is discarded afterward.
+func (s *State) EvaluateIsolated(ctx context.Context, code string) ([]any, error) {
+	return s.s.EvaluateIsolated(ctx, code)
+}
+
+// EvaluateThunks evaluates a string of Lua code and returns its results,
+// converting returned Lua functions to one-shot *Thunk values.
+func (s *State) EvaluateThunks(ctx context.Context, code string) ([]any, error) {
+	return s.s.EvaluateThunks(ctx, code)
+}
+
+// EvaluateTracked evaluates a string of Lua code and returns its results,
+// along with the new values of the given global variables which were mutated by the code.
+func (s *State) EvaluateTracked(ctx context.Context, code string, tracked ...string) ([]any, map[string]any, error) {
+	return s.s.EvaluateTracked(ctx, code, tracked...)
+}
+
+// RegisterFunction registers a Go function as a global Lua function with the given name.
+func (s *State) RegisterFunction(ctx context.Context, name string, fn GoFunction) error {
+	return s.s.RegisterFunction(ctx, name, fn)
+}
+
+// RegisterModule registers Go functions as a module table with the given name.
+func (s *State) RegisterModule(ctx context.Context, name string, funcs map[string]GoFunction) error {
+	return s.s.RegisterModule(ctx, name, funcs)
+}
+
+// RegisterFunctionContext registers a context-aware Go function as a global Lua function with the given name.
+//
+// The function should honor the cancellation of the given context when it blocks.
+func (s *State) RegisterFunctionContext(ctx context.Context, name string, fn GoFunctionContext) error {
+	return s.s.RegisterFunctionContext(ctx, name, fn)
+}
+
+// SetGlobalFunc registers an ordinary Go function (e.g. `func(a, b int) int`) as a global Lua function
+// with the given name, converting its arguments and results with reflection.
+//
+// A wrong number of arguments, arguments which cannot be converted to the parameter types,
+// and a non-nil error as the last result raise Lua errors.
+func (s *State) SetGlobalFunc(ctx context.Context, name string, fn any) error {
+	return s.s.SetGlobalFunc(ctx, name, fn)
+}
+
+// Traceback returns a traceback of the current Lua call stack.
+//
+// When called with the context given to a GoFunctionContext, it returns the stack of the calling Lua code.
+func (s *State) Traceback(ctx context.Context) (string, error) {
+	return s.s.Traceback(ctx)
+}
+
+// NewCoroutine loads a string of Lua code as the body of a new coroutine,
+// which runs when it is resumed.
+func (s *State) NewCoroutine(ctx context.Context, code string) (*Coroutine, error) {
+	return s.s.NewCoroutine(ctx, code)
+}
+
+// Check parses a string of Lua code without running it, and returns its syntax error if any.
+func (s *State) Check(ctx context.Context, code string) error {
+	return s.s.Check(ctx, code)
+}
+
+// Compile compiles a string of Lua code as a Chunk with the given chunk name.
+func (s *State) Compile(ctx context.Context, code, name string) (*Chunk, error) {
+	return s.s.Compile(ctx, code, name)
+}
+
+// Dump compiles a string of Lua code and returns its bytecode.
+//
+// Bytecode is specific to the Lua version and the platform.
+func (s *State) Dump(ctx context.Context, code string) ([]byte, error) {
+	return s.s.Dump(ctx, code)
+}
+
+// LoadBytecode loads bytecode (dumped with Dump) as a Chunk.
+func (s *State) LoadBytecode(ctx context.Context, data []byte) (*Chunk, error) {
+	return s.s.LoadBytecode(ctx, data)
+}
+
+// SetSearchPath sets `package.path`, the search path of `require` for Lua modules.
+func (s *State) SetSearchPath(ctx context.Context, path string) error {
+	return s.s.SetSearchPath(ctx, path)
+}
+
+// SetModuleFS makes `require` resolve Lua modules in fsys (e.g. an embed.FS),
+// before searching `package.path`.
+//
+// A module named "a.b" is loaded from "a/b.lua" or "a/b/init.lua" in fsys.
+func (s *State) SetModuleFS(ctx context.Context, fsys fs.FS) error {
+	return s.s.SetModuleFS(ctx, fsys)
+}
+
+// SetCSearchPath sets `package.cpath`, the search path of `require` for C modules.
+func (s *State) SetCSearchPath(ctx context.Context, path string) error {
+	return s.s.SetCSearchPath(ctx, path)
+}
+
+// UnloadModule removes a module from `package.loaded`, so that the next `require(name)` loads it again.
+func (s *State) UnloadModule(ctx context.Context, name string) error {
+	return s.s.UnloadModule(ctx, name)
+}
+
+// SeedRandom seeds the pseudo-random generator of `math.random`, for reproducible sequences.
+func (s *State) SeedRandom(ctx context.Context, seed int64) error {
+	return s.s.SeedRandom(ctx, seed)
+}
+
+// SetOutput replaces the global `print` function with one which writes to w.
+func (s *State) SetOutput(ctx context.Context, w io.Writer) error {
+	return s.s.SetOutput(ctx, w)
+}
+
+// Run executes a string of Lua code, and returns what it printed with `print`.
+//
+// The previous `print` is restored afterward, even on error.
+func (s *State) Run(ctx context.Context, code string) (output string, err error) {
+	return s.s.Run(ctx, code)
+}
+
+// WithRawState runs fn on the worker goroutine with the raw `lua_State*`, for driving the Lua C API directly.
+//
+// The pointer must not be used concurrently or after fn returns,
+// and keeping the stack balanced is the caller's responsibility.
+func (s *State) WithRawState(ctx context.Context, fn func(L unsafe.Pointer) error) error {
+	return s.s.WithRawState(ctx, fn)
+}
+
+// GC controls the Lua garbage collector, like `collectgarbage` in Lua.
+func (s *State) GC(ctx context.Context, mode GCMode) error {
+	return s.s.GC(ctx, mode)
+}
+
+// MemoryKB returns the total memory in use by Lua (in kilobytes).
+func (s *State) MemoryKB(ctx context.Context) (int, error) {
+	return s.s.MemoryKB(ctx)
+}
+
+// GCStats returns the current statistics of the Lua garbage collector.
+func (s *State) GCStats(ctx context.Context) (GCStats, error) {
+	return s.s.GCStats(ctx)
+}
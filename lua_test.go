@@ -1,9 +1,26 @@
 package lua
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
+	"unsafe"
 )
 
 // TestVersion tests the Version function.
@@ -13,6 +30,69 @@ func TestVersion(t *testing.T) {
 	}
 }
 
+// TestSetField tests setting fields of existing tables.
+func TestSetField(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `
+		config = {name = "app", server = {port = 80}}
+		logged = {}
+		proxy = setmetatable({}, {__newindex = function(t, k, v) logged[#logged + 1] = k rawset(t, k, v) end})
+		readonly = setmetatable({}, {__newindex = function() error("read-only table") end})
+		scalar = 42
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	if err := s.SetField(ctx, "config", "name", "renamed"); err != nil {
+		t.Fatalf("SetField failed with error: %v", err)
+	}
+	if err := s.SetField(ctx, "config.server", "port", 8080); err != nil {
+		t.Fatalf("SetField failed with error: %v", err)
+	}
+	if err := s.SetField(ctx, "config.server", "tls", map[any]any{"enabled": true}); err != nil {
+		t.Fatalf("SetField failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return config.name, config.server.port, config.server.tls.enabled`); err != nil || !reflect.DeepEqual(results, []any{"renamed", int64(8080), true}) {
+		t.Errorf("Expected [renamed 8080 true], got %v (error: %v)", results, err)
+	}
+
+	// metamethods
+	if err := s.SetField(ctx, "proxy", "key", "value"); err != nil {
+		t.Fatalf("SetField failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return proxy.key, logged[1]`); err != nil || !reflect.DeepEqual(results, []any{"value", "key"}) {
+		t.Errorf("Expected [value key], got %v (error: %v)", results, err)
+	}
+	if err := s.SetField(ctx, "readonly", "key", 1); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "read-only table") {
+		t.Errorf("Expected a runtime error, got %v", err)
+	}
+
+	// errors
+	for _, path := range []string{"scalar", "undefined", "config.name", "scalar.field", "config:server", ""} {
+		if err := s.SetField(ctx, path, "key", 1); err == nil {
+			t.Errorf("Expected error for path '%s', got nil", path)
+		}
+	}
+	if err := s.SetField(ctx, "config", "bad", make(chan int)); err == nil {
+		t.Error("Expected error for an unsupported value, got nil")
+	}
+}
+
+// TestVersionNumber tests the VersionNumber function.
+func TestVersionNumber(t *testing.T) {
+	major, minor, patch := VersionNumber()
+	if major < 5 || (major == 5 && minor < 4) {
+		t.Errorf("Expected Lua 5.4 or later, got %d.%d.%d", major, minor, patch)
+	}
+	if expected := fmt.Sprintf("Lua %d.%d.%d", major, minor, patch); Version() != expected {
+		t.Errorf("VersionNumber() = %d, %d, %d, which does not match Version() = %s", major, minor, patch, Version())
+	}
+}
+
 // TestNewStateAndClose creates a new Lua state and then closes it.
 func TestNewStateAndClose(t *testing.T) {
 	s := NewState()
@@ -20,6 +100,21 @@ func TestNewStateAndClose(t *testing.T) {
 		t.Fatal("NewState() failed to create a new Lua state.")
 	}
 	s.Close()
+
+	// closing again should not panic
+	s.Close()
+
+	// operations on a closed state should fail instead of blocking
+	ctx := context.Background()
+	if err := s.Execute(ctx, `x = 1`); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed from Execute, got %v", err)
+	}
+	if _, err := s.Evaluate(ctx, `return 1`); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed from Evaluate, got %v", err)
+	}
+	if _, err := s.GetGlobal(ctx, "x"); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed from GetGlobal, got %v", err)
+	}
 }
 
 // TestExecute executes simple Lua scripts.
@@ -40,6 +135,41 @@ func TestExecute(t *testing.T) {
 	}
 }
 
+// TestExecuteFile tests executing Lua script files.
+func TestExecuteFile(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "ok.lua")
+	if err := os.WriteFile(path, []byte("#!/usr/bin/env lua\nfrom_file = 42\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write a script file: %v", err)
+	}
+	if err := s.ExecuteFile(ctx, path); err != nil {
+		t.Fatalf("ExecuteFile failed with error: %v", err)
+	}
+	if val, err := s.GetGlobal(ctx, "from_file"); err != nil || val.(int64) != 42 {
+		t.Errorf(`GetGlobal("from_file") = %v, want 42`, val)
+	}
+
+	// errors reference the file name and line
+	path = filepath.Join(dir, "error.lua")
+	if err := os.WriteFile(path, []byte("local a = 1\nlocal b = 2\nerror('failed')\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write a script file: %v", err)
+	}
+	if err := s.ExecuteFile(ctx, path); err == nil || !strings.Contains(err.Error(), path+":3: failed") {
+		t.Errorf("Expected error referencing %s:3, got %v", path, err)
+	}
+
+	// non-existent file
+	if err := s.ExecuteFile(ctx, filepath.Join(dir, "non_existent.lua")); err == nil {
+		t.Error("Expected error for a non-existent file, got nil")
+	}
+}
+
 // TestGetGlobal tests the GetGlobal function.
 func TestGetGlobal(t *testing.T) {
 	s := NewState()
@@ -62,34 +192,346 @@ func TestGetGlobal(t *testing.T) {
 	}
 
 	// Test string
-	if val := s.GetGlobal(ctx, "my_string"); val.(string) != "hello" {
+	if val, err := s.GetGlobal(ctx, "my_string"); err != nil || val.(string) != "hello" {
 		t.Errorf(`GetGlobal("my_string") = %v, want "hello"`, val)
 	}
 
 	// Test integer
-	if val := s.GetGlobal(ctx, "my_int"); val.(int64) != 42 {
+	if val, err := s.GetGlobal(ctx, "my_int"); err != nil || val.(int64) != 42 {
 		t.Errorf(`GetGlobal("my_int") = %v, want 42`, val)
 	}
 
 	// Test float
-	if val := s.GetGlobal(ctx, "my_float"); val.(float64) != 3.14 {
+	if val, err := s.GetGlobal(ctx, "my_float"); err != nil || val.(float64) != 3.14 {
 		t.Errorf(`GetGlobal("my_float") = %v, want 3.14`, val)
 	}
 
 	// Test boolean
-	if val := s.GetGlobal(ctx, "my_bool"); val.(bool) != true {
+	if val, err := s.GetGlobal(ctx, "my_bool"); err != nil || val.(bool) != true {
 		t.Errorf(`GetGlobal("my_bool") = %v, want true`, val)
 	}
 
 	// Test nil
-	if val := s.GetGlobal(ctx, "my_nil"); val != nil {
+	if val, err := s.GetGlobal(ctx, "my_nil"); err != nil || val != nil {
 		t.Errorf(`GetGlobal("my_nil") = %v, want nil`, val)
 	}
 
 	// Test non-existent global
-	if val := s.GetGlobal(ctx, "non_existent"); val != nil {
+	if val, err := s.GetGlobal(ctx, "non_existent"); err != nil || val != nil {
 		t.Errorf(`GetGlobal("non_existent") = %v, want nil`, val)
 	}
+
+	// Test cancelled context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if val, err := s.GetGlobal(cancelled, "my_string"); !errors.Is(err, context.Canceled) || val != nil {
+		t.Errorf(`GetGlobal("my_string") = %v, %v, want nil, context.Canceled`, val, err)
+	}
+}
+
+// TestSetGlobal tests the SetGlobal function.
+func TestSetGlobal(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	for name, value := range map[string]any{
+		"my_string": "hello",
+		"my_int":    int64(42),
+		"my_float":  3.14,
+		"my_bool":   true,
+		"my_nil":    nil,
+		"my_slice":  []any{int64(1), "two", false},
+		"my_map":    map[any]any{"a": int64(1), int64(2): "b"},
+	} {
+		if err := s.SetGlobal(ctx, name, value); err != nil {
+			t.Errorf("SetGlobal(%s) failed with error: %v", name, err)
+		}
+	}
+
+	results, err := s.Evaluate(ctx, `return my_string, my_int + 1, my_float, my_bool, my_nil, #my_slice, my_slice[2], my_map.a, my_map[2]`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if len(results) != 9 ||
+		results[0].(string) != "hello" ||
+		results[1].(int64) != 43 ||
+		results[2].(float64) != 3.14 ||
+		results[3].(bool) != true ||
+		results[4] != nil ||
+		results[5].(int64) != 3 ||
+		results[6].(string) != "two" ||
+		results[7].(int64) != 1 ||
+		results[8].(string) != "b" {
+		t.Errorf("Evaluate returned %v, want [hello 43 3.14 true <nil> 3 two 1 b]", results)
+	}
+
+	// round-trip
+	if val, err := s.GetGlobal(ctx, "my_slice"); err != nil || len(val.([]any)) != 3 || val.([]any)[1].(string) != "two" {
+		t.Errorf(`GetGlobal("my_slice") = %v, want [1 two false]`, val)
+	}
+
+	// unsupported types
+	if err := s.SetGlobal(ctx, "my_chan", make(chan int)); err == nil {
+		t.Error("Expected error for setting a channel, got nil")
+	}
+	if err := s.SetGlobal(ctx, "my_nested", []any{1, func() {}}); err == nil {
+		t.Error("Expected error for setting a slice with a function, got nil")
+	}
+	if val, err := s.GetGlobal(ctx, "my_nested"); err != nil || val != nil {
+		t.Errorf(`GetGlobal("my_nested") = %v, want nil`, val)
+	}
+}
+
+// TestSetGlobalPointers tests setting pointers as global variables.
+func TestSetGlobalPointers(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	n := 42
+	str := "hello"
+	pStr := &str
+	var nilInt *int
+	var nilPStr **string
+
+	for name, value := range map[string]any{
+		"p_int":      &n,
+		"pp_str":     &pStr,
+		"nil_int":    nilInt,
+		"nil_pp_str": nilPStr,
+		"p_nil_str":  &nilPStr,
+		"p_slice":    &[]any{&n, nilInt},
+	} {
+		if err := s.SetGlobal(ctx, name, value); err != nil {
+			t.Errorf("SetGlobal(%s) failed with error: %v", name, err)
+		}
+	}
+
+	results, err := s.Evaluate(ctx, `return p_int, pp_str, nil_int, nil_pp_str, p_nil_str, p_slice[1], p_slice[2]`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if len(results) != 7 ||
+		results[0].(int64) != 42 ||
+		results[1].(string) != "hello" ||
+		results[2] != nil ||
+		results[3] != nil ||
+		results[4] != nil ||
+		results[5].(int64) != 42 ||
+		results[6] != nil {
+		t.Errorf("Evaluate returned %v, want [42 hello <nil> <nil> <nil> 42 <nil>]", results)
+	}
+
+	// pointers to unsupported types
+	ch := make(chan int)
+	if err := s.SetGlobal(ctx, "p_chan", &ch); err == nil {
+		t.Error("Expected error for setting a pointer to a channel, got nil")
+	}
+}
+
+// TestSetGlobalStructSlices tests setting slices of structs as arrays of tables.
+func TestSetGlobalStructSlices(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	type Row struct {
+		Name  string  `lua:"name"`
+		Price float64 `lua:"price"`
+		Qty   int     `lua:"qty"`
+	}
+	rows := []Row{{"apple", 1.5, 4}, {"banana", 0.25, 12}, {"cherry", 3, 1}}
+
+	for name, value := range map[string]any{
+		"rows":     rows,
+		"ptr_rows": []*Row{&rows[0], &rows[1], &rows[2]},
+		"arr_rows": [3]Row(rows),
+	} {
+		if err := s.SetGlobal(ctx, name, value); err != nil {
+			t.Fatalf("SetGlobal(%s) failed with error: %v", name, err)
+		}
+		results, err := s.Evaluate(ctx, fmt.Sprintf(`
+			local names, total = {}, 0
+			for i, row in ipairs(%s) do
+				names[i] = row.name
+				total = total + row.price * row.qty
+			end
+			return #%s, table.concat(names, ","), total`, name, name))
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v", err)
+		}
+		if expected := []any{int64(3), "apple,banana,cherry", 12.0}; !reflect.DeepEqual(results, expected) {
+			t.Errorf("Expected %v for %s, got %v", expected, name, results)
+		}
+	}
+
+	// as arguments, and back
+	results, err := s.EvaluateWithArgs(ctx, `local data = ... return data[2].name, data`, rows[:2])
+	if err != nil {
+		t.Fatalf("EvaluateWithArgs failed with error: %v", err)
+	}
+	expected := []any{"banana", []any{
+		map[any]any{"name": "apple", "price": 1.5, "qty": int64(4)},
+		map[any]any{"name": "banana", "price": 0.25, "qty": int64(12)},
+	}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+	var out []Row
+	if err := UnmarshalGlobal(ctx, s, "rows", &out); err != nil || !reflect.DeepEqual(out, rows) {
+		t.Errorf("Expected %v, got %v (error: %v)", rows, out, err)
+	}
+
+	// empty slices are empty tables
+	if err := s.SetGlobal(ctx, "rows", []Row{}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return type(rows), #rows`); err != nil || !reflect.DeepEqual(results, []any{"table", int64(0)}) {
+		t.Errorf("Expected [table 0], got %v (error: %v)", results, err)
+	}
+}
+
+// TestSetGlobalMaps tests setting maps with string or integer keys as global variables.
+func TestSetGlobalMaps(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// as decoded from JSON
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(`{"name": "lua", "tags": ["a", "b"], "owner": {"id": 7, "langs": [{"name": "go"}]}}`), &doc); err != nil {
+		t.Fatalf("json.Unmarshal failed with error: %v", err)
+	}
+	if err := s.SetGlobal(ctx, "doc", doc); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if err := s.SetGlobal(ctx, "headers", map[string]string{"Accept": "text/plain"}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if err := s.SetGlobal(ctx, "codes", map[int]string{200: "OK", 404: "Not Found"}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	var nilMap map[string]int
+	if err := s.SetGlobal(ctx, "nil_map", nilMap); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+
+	results, err := s.Evaluate(ctx, `return doc.name, #doc.tags, doc.tags[2], doc.owner.id, doc.owner.langs[1].name,
+  headers.Accept, codes[404], nil_map`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	expected := []any{"lua", int64(2), "b", float64(7), "go", "text/plain", "Not Found", nil}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+
+	// unsupported keys
+	if err := s.SetGlobal(ctx, "bad", map[float64]string{1.5: "x"}); err == nil {
+		t.Error("Expected error for setting a map with float keys, got nil")
+	}
+	if err := s.SetGlobal(ctx, "bad", map[string]any{"ch": make(chan int)}); err == nil {
+		t.Error("Expected error for setting a map with an unsupported value, got nil")
+	}
+}
+
+// TestBoolKeys tests converting tables with boolean keys, which are never taken as arrays.
+func TestBoolKeys(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []Options{{}, {Holes: HolesAsNil}} {
+		s := NewStateWithOptions(opts)
+
+		results, err := s.Evaluate(ctx, `
+			local only = {[true] = "yes", [false] = "no"}
+			local mixed = {"a", "b", [true] = 1}
+			local single = {[true] = 1}
+			return only, mixed, single`)
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v", err)
+		}
+		expected := []any{
+			map[any]any{true: "yes", false: "no"},
+			map[any]any{int64(1): "a", int64(2): "b", true: int64(1)},
+			map[any]any{true: int64(1)},
+		}
+		if !reflect.DeepEqual(results, expected) {
+			t.Errorf("Expected %v, got %v (options: %+v)", expected, results, opts)
+		}
+
+		s.Close()
+	}
+
+	s := NewState()
+	defer s.Close()
+
+	// round trips of maps with bool keys
+	for _, value := range []any{
+		map[any]any{true: "yes", false: "no"},
+		map[any]any{int64(1): "a", true: int64(1), "k": false},
+	} {
+		if err := s.SetGlobal(ctx, "t", value); err != nil {
+			t.Fatalf("SetGlobal failed with error: %v", err)
+		}
+		if got, err := s.GetGlobal(ctx, "t"); err != nil || !reflect.DeepEqual(got, value) {
+			t.Errorf("Expected %v, got %v (error: %v)", value, got, err)
+		}
+	}
+	if err := s.SetGlobal(ctx, "flags", map[bool]string{true: "on", false: "off"}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return flags[true], flags[false]`); err != nil || !reflect.DeepEqual(results, []any{"on", "off"}) {
+		t.Errorf("Expected [on off], got %v (error: %v)", results, err)
+	}
+	var flags map[bool]string
+	if err := s.SetGlobalFunc(ctx, "receive", func(m map[bool]string) { flags = m }); err != nil {
+		t.Fatalf("SetGlobalFunc failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `receive(flags)`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if expected := map[bool]string{true: "on", false: "off"}; !reflect.DeepEqual(flags, expected) {
+		t.Errorf("Expected %v, got %v", expected, flags)
+	}
+}
+
+// TestBinarySafeStrings tests round-tripping strings with embedded NUL bytes.
+func TestBinarySafeStrings(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	binary := "a\x00b\x00\xffc"
+
+	// Go -> Lua -> Go
+	if err := s.SetGlobal(ctx, "bin", binary); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if val, err := s.GetGlobal(ctx, "bin"); err != nil || val.(string) != binary {
+		t.Errorf(`GetGlobal("bin") = %q, want %q`, val, binary)
+	}
+	results, err := s.Evaluate(ctx, `return #bin`)
+	if err != nil || len(results) != 1 || results[0].(int64) != int64(len(binary)) {
+		t.Errorf("Expected length of %d, got %v (error: %v)", len(binary), results, err)
+	}
+
+	// source code containing a NUL byte
+	if err := s.Execute(ctx, "src = \"x\x00y\""); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if val, err := s.GetGlobal(ctx, "src"); err != nil || val.(string) != "x\x00y" {
+		t.Errorf(`GetGlobal("src") = %q, want "x\x00y"`, val)
+	}
+	results, err = s.Evaluate(ctx, "return \"1\x002\", 3")
+	if err != nil || len(results) != 2 || results[0].(string) != "1\x002" || results[1].(int64) != 3 {
+		t.Errorf("Evaluate returned %q (error: %v), want [\"1\x002\" 3]", results, err)
+	}
 }
 
 // TestEvaluate tests the Evaluate function.
@@ -208,6 +650,59 @@ func TestLuaFunctionCall(t *testing.T) {
 	}
 }
 
+// TestCallGlobal tests calling a global Lua function with Go arguments.
+func TestCallGlobal(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	err := s.Execute(
+		ctx,
+		`
+		function add(a, b)
+			return a + b
+		end
+		function greet(name)
+			return "hello, " .. name, #name
+		end
+		not_a_function = 42
+	`)
+	if err != nil {
+		t.Fatalf("Failed to define Lua functions: %v", err)
+	}
+
+	results, err := s.CallGlobal(ctx, "add", 5, 3)
+	if err != nil {
+		t.Fatalf("CallGlobal failed with error: %v", err)
+	}
+	if len(results) != 1 || results[0].(int64) != 8 {
+		t.Errorf("Expected add(5, 3) to return 8, got %v", results)
+	}
+
+	// string arguments are passed as they are (no injection)
+	results, err = s.CallGlobal(ctx, "greet", `"); os.exit() --`)
+	if err != nil {
+		t.Fatalf("CallGlobal failed with error: %v", err)
+	}
+	if len(results) != 2 || results[0].(string) != `hello, "); os.exit() --` || results[1].(int64) != 16 {
+		t.Errorf("Unexpected results of greet: %v", results)
+	}
+
+	// not a function
+	if _, err := s.CallGlobal(ctx, "not_a_function"); err == nil {
+		t.Error("Expected error for calling a non-function global, got nil")
+	}
+	if _, err := s.CallGlobal(ctx, "non_existent"); err == nil {
+		t.Error("Expected error for calling a non-existent global, got nil")
+	}
+
+	// runtime error
+	if _, err := s.CallGlobal(ctx, "add", 1, nil); err == nil {
+		t.Error("Expected error for adding nil, got nil")
+	}
+}
+
 // TestContextTimeout tests that Lua execution respects context timeouts.
 func TestContextTimeout(t *testing.T) {
 	s := NewState()
@@ -230,3 +725,3580 @@ func TestContextTimeout(t *testing.T) {
 		t.Errorf("Expected context.DeadlineExceeded or context.Canceled, but got %v", err)
 	}
 }
+
+// TestEvaluateTimeout tests evaluating Lua code with a timeout.
+func TestEvaluateTimeout(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	results, err := s.EvaluateTimeout(`return 1 + 2`, time.Second)
+	if err != nil {
+		t.Fatalf("EvaluateTimeout failed with error: %v", err)
+	}
+	if !reflect.DeepEqual(results, []any{int64(3)}) {
+		t.Errorf("Expected [3], got %v", results)
+	}
+
+	start := time.Now()
+	if _, err := s.EvaluateTimeout(`while true do end`, 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the code to be interrupted in time, took %v", elapsed)
+	}
+
+	// the worker is freed for following operations
+	results, err = s.EvaluateTimeout(`return "ok"`, time.Second)
+	if err != nil {
+		t.Fatalf("EvaluateTimeout after a timeout failed with error: %v", err)
+	}
+	if !reflect.DeepEqual(results, []any{"ok"}) {
+		t.Errorf("Expected [ok], got %v", results)
+	}
+}
+
+// TestEvaluateThunks tests calling Lua functions returned as thunks.
+func TestEvaluateThunks(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	countThunks := `
+		local n = 0
+		for _ in pairs(debug.getregistry()["lua-go.thunks"] or {}) do n = n + 1 end
+		return n
+	`
+
+	results, err := s.EvaluateThunks(ctx, `return function(a, b) return a + b end`)
+	if err != nil {
+		t.Fatalf("EvaluateThunks failed with error: %v", err)
+	}
+	thunk, ok := results[0].(*Thunk)
+	if !ok {
+		t.Fatalf("EvaluateThunks returned %T, want *Thunk", results[0])
+	}
+
+	// the thunk is parked until called
+	if results, err := s.Evaluate(ctx, countThunks); err != nil || results[0].(int64) != 1 {
+		t.Errorf("Expected 1 parked thunk, got %v (error: %v)", results, err)
+	}
+
+	// call the thunk
+	results, err = thunk.Call(ctx, 5, 3)
+	if err != nil {
+		t.Fatalf("Thunk.Call failed with error: %v", err)
+	}
+	if len(results) != 1 || results[0].(int64) != 8 {
+		t.Errorf("Expected thunk.Call(5, 3) to return 8, got %v", results)
+	}
+
+	// its slot is released after the call
+	if results, err := s.Evaluate(ctx, countThunks); err != nil || results[0].(int64) != 0 {
+		t.Errorf("Expected no parked thunks, got %v (error: %v)", results, err)
+	}
+
+	// a thunk can be called only once
+	if _, err := thunk.Call(ctx, 5, 3); err == nil {
+		t.Error("Expected error for calling a thunk twice, got nil")
+	}
+
+	// functions passed to Go functions are not converted to thunks (nor parked)
+	var got any
+	if err := s.RegisterFunction(ctx, "receive", func(args []any) ([]any, error) {
+		got = args[0]
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if _, err := s.EvaluateThunks(ctx, `receive(function() end) return 1`); err != nil {
+		t.Fatalf("EvaluateThunks failed with error: %v", err)
+	}
+	if str, ok := got.(string); !ok || !strings.HasPrefix(str, "<unsupported Lua type: function") {
+		t.Errorf("Expected a placeholder for a function argument, got %#v", got)
+	}
+	if results, err := s.Evaluate(ctx, countThunks); err != nil || results[0].(int64) != 0 {
+		t.Errorf("Expected no parked thunks, got %v (error: %v)", results, err)
+	}
+}
+
+// TestMaxCoroutines tests limiting the number of live coroutines.
+func TestMaxCoroutines(t *testing.T) {
+	s := NewStateWithOptions(Options{MaxCoroutines: 10})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// coroutines which are not referenced anymore are not counted
+	err := s.Execute(ctx, `
+		for i = 1, 100 do
+			local co = coroutine.create(function() coroutine.yield(i) end)
+			coroutine.resume(co)
+		end
+	`)
+	if err != nil {
+		t.Errorf("Execute failed with error: %v", err)
+	}
+
+	// live coroutines hit the limit
+	err = s.Execute(ctx, `
+		cos = {}
+		for i = 1, 100 do
+			cos[i] = coroutine.wrap(function() coroutine.yield(i) end)
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "too many coroutines") {
+		t.Errorf("Expected error for too many coroutines, got %v", err)
+	}
+	if val, err := s.GetGlobal(ctx, "cos"); err != nil || len(val.([]any)) != 10 {
+		t.Errorf("Expected 10 coroutines to be created, got %d", len(val.([]any)))
+	}
+
+	// no limit
+	unlimited := NewStateWithOptions(Options{MaxCoroutines: -1})
+	defer unlimited.Close()
+
+	err = unlimited.Execute(ctx, `
+		cos = {}
+		for i = 1, 100 do
+			cos[i] = coroutine.create(function() end)
+		end
+	`)
+	if err != nil {
+		t.Errorf("Execute failed with error: %v", err)
+	}
+}
+
+// TestEvaluateTracked tests tracking mutations of global variables.
+func TestEvaluateTracked(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	err := s.Execute(ctx, `
+		config = {retries = 3, name = "test"}
+		limit = 10
+		other = 1
+	`)
+	if err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	results, mutations, err := s.EvaluateTracked(ctx, `
+		config.retries = config.retries + 1
+		other = 2 -- not tracked
+		local n = 0
+		for _ in pairs(config) do n = n + 1 end
+		return n, limit
+	`, "config", "limit")
+	if err != nil {
+		t.Fatalf("EvaluateTracked failed with error: %v", err)
+	}
+	if len(results) != 2 || results[0].(int64) != 2 || results[1].(int64) != 10 {
+		t.Errorf("EvaluateTracked returned %v, want [2 10]", results)
+	}
+	if len(mutations) != 1 {
+		t.Errorf("Expected only `config` to be mutated, got %v", mutations)
+	}
+	if config, ok := mutations["config"].(map[any]any); !ok || config["retries"].(int64) != 4 {
+		t.Errorf("Expected mutated `config.retries` to be 4, got %v", mutations["config"])
+	}
+
+	// writes are applied to the global variables
+	if val, err := s.GetGlobal(ctx, "other"); err != nil || val.(int64) != 2 {
+		t.Errorf(`GetGlobal("other") = %v, want 2`, val)
+	}
+
+	// reassigning a tracked global
+	_, mutations, err = s.EvaluateTracked(ctx, `limit = 20`, "config", "limit")
+	if err != nil {
+		t.Fatalf("EvaluateTracked failed with error: %v", err)
+	}
+	if len(mutations) != 1 || mutations["limit"].(int64) != 20 {
+		t.Errorf("Expected only `limit` to be mutated to 20, got %v", mutations)
+	}
+
+	// with a strict global table, which raises errors for undeclared (or removed) variables
+	if err := s.Execute(ctx, `setmetatable(_G, {__index = function(_, k) error("undeclared " .. k) end})`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	_, mutations, err = s.EvaluateTracked(ctx, `limit = nil`, "limit")
+	if err != nil {
+		t.Fatalf("EvaluateTracked failed with error: %v", err)
+	}
+	if value, ok := mutations["limit"]; len(mutations) != 1 || !ok || value != nil {
+		t.Errorf("Expected `limit` to be mutated to nil, got %v", mutations)
+	}
+	if _, _, err := s.EvaluateTracked(ctx, `return undeclared`, "config"); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "undeclared undeclared") {
+		t.Errorf("Expected a runtime error, got %v", err)
+	}
+}
+
+// TestContextInterruption tests that cancellation is observed by running Lua code
+// and context-aware Go functions, freeing the worker for subsequent operations.
+func TestContextInterruption(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// a blocking Go function which honors the context
+	err := s.RegisterFunctionContext(ctx, "wait", func(ctx context.Context, args []any) ([]any, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Second):
+			return []any{true}, nil
+		}
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunctionContext failed with error: %v", err)
+	}
+
+	for _, code := range []string{
+		`wait()`,            // blocked in a Go function
+		`while true do end`, // infinite loop
+		`while true do pcall(function() while true do end end) end`, // catching the interruption
+	} {
+		timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		start := time.Now()
+		err = s.Execute(timeoutCtx, code)
+		cancel()
+
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected context.DeadlineExceeded for `%s`, but got %v", code, err)
+		}
+
+		// the worker is freed promptly
+		results, err := s.Evaluate(ctx, `return 1`)
+		if err != nil || len(results) != 1 || results[0].(int64) != 1 {
+			t.Errorf("Evaluate after interruption returned %v (error: %v), want [1]", results, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Interrupting `%s` took too long: %v", code, elapsed)
+		}
+	}
+}
+
+// TestGCStats tests the GCStats function.
+func TestGCStats(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	before, err := s.GCStats(ctx)
+	if err != nil {
+		t.Fatalf("GCStats failed with error: %v", err)
+	}
+	if before.MemoryBytes <= 0 || before.Mode != "incremental" || !before.Running {
+		t.Errorf("Unexpected GC stats: %+v", before)
+	}
+
+	// allocate a large table
+	if err := s.Execute(ctx, `
+		big = {}
+		for i = 1, 100000 do big[i] = tostring(i) end
+		collectgarbage()
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	after, err := s.GCStats(ctx)
+	if err != nil {
+		t.Fatalf("GCStats failed with error: %v", err)
+	}
+	if after.MemoryKB <= before.MemoryKB+1024 {
+		t.Errorf("Expected memory to grow by more than 1MB, got %.1fKB -> %.1fKB", before.MemoryKB, after.MemoryKB)
+	}
+	if after.Cycles <= before.Cycles {
+		t.Errorf("Expected GC cycles to increase, got %d -> %d", before.Cycles, after.Cycles)
+	}
+
+	// change GC mode
+	if err := s.Execute(ctx, `collectgarbage("generational")`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if stats, _ := s.GCStats(ctx); stats.Mode != "generational" {
+		t.Errorf("Expected generational GC mode, got %s", stats.Mode)
+	}
+
+	// reading the mode does not change it
+	if results, err := s.Evaluate(ctx, `return collectgarbage("incremental")`); err != nil || results[0] != "generational" {
+		t.Errorf("Expected the previous mode to be generational, got %v (error: %v)", results, err)
+	}
+	if stats, _ := s.GCStats(ctx); stats.Mode != "incremental" {
+		t.Errorf("Expected incremental GC mode, got %s", stats.Mode)
+	}
+}
+
+// TestPeakMemory tests the high-water mark of memory during an evaluation.
+func TestPeakMemory(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// build a large temporary table, and release it
+	if _, err := s.Evaluate(ctx, `
+		local tmp = {}
+		for i = 1, 100000 do tmp[i] = tostring(i) end
+		tmp = nil
+		collectgarbage()
+		return true
+	`); err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	stats, err := s.GCStats(ctx)
+	if err != nil {
+		t.Fatalf("GCStats failed with error: %v", err)
+	}
+	if stats.PeakMemoryBytes <= stats.MemoryBytes+1024*1024 {
+		t.Errorf("Expected peak memory to exceed final memory by more than 1MB, got %d (final: %d)", stats.PeakMemoryBytes, stats.MemoryBytes)
+	}
+}
+
+// TestHoleMode tests converting tables with holes under each HoleMode.
+func TestHoleMode(t *testing.T) {
+	ctx := context.Background()
+
+	// holes as map (default)
+	s := NewState()
+	defer s.Close()
+
+	results, err := s.Evaluate(ctx, `return {1, nil, 3}`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if m, ok := results[0].(map[any]any); !ok || len(m) != 2 || m[int64(1)].(int64) != 1 || m[int64(3)].(int64) != 3 {
+		t.Errorf("Expected {1, nil, 3} to be map[1:1 3:3], got %#v", results[0])
+	}
+
+	// holes as nil
+	s2 := NewStateWithOptions(Options{Holes: HolesAsNil})
+	defer s2.Close()
+
+	results, err = s2.Evaluate(ctx, `return {1, nil, 3}, {nil, nil, 3, 4}, {[1000] = true}, {1, nil, a = 3}`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if sl, ok := results[0].([]any); !ok || len(sl) != 3 || sl[0].(int64) != 1 || sl[1] != nil || sl[2].(int64) != 3 {
+		t.Errorf("Expected {1, nil, 3} to be [1 <nil> 3], got %#v", results[0])
+	}
+	if sl, ok := results[1].([]any); !ok || len(sl) != 4 || sl[0] != nil || sl[3].(int64) != 4 {
+		t.Errorf("Expected {nil, nil, 3, 4} to be [<nil> <nil> 3 4], got %#v", results[1])
+	}
+	if _, ok := results[2].(map[any]any); !ok {
+		t.Errorf("Expected a very sparse table to be a map, got %#v", results[2])
+	}
+	if _, ok := results[3].(map[any]any); !ok {
+		t.Errorf("Expected a table with a string key to be a map, got %#v", results[3])
+	}
+}
+
+// TestTableConversion tests converting tables to slices or maps deterministically.
+func TestTableConversion(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	for code, expected := range map[string]any{
+		`return {}`:                               []any{},
+		`return {1, 2, 3}`:                        []any{int64(1), int64(2), int64(3)},
+		`return {false, true}`:                    []any{false, true},
+		`return {[1] = "a", [2] = "b"}`:           []any{"a", "b"},
+		`return {false, nil, true}`:               map[any]any{int64(1): false, int64(3): true},
+		`return {[2] = 1}`:                        map[any]any{int64(2): int64(1)},
+		`return {[0] = 0, 1}`:                     map[any]any{int64(0): int64(0), int64(1): int64(1)},
+		`return {1, 2, x = 3}`:                    map[any]any{int64(1): int64(1), int64(2): int64(2), "x": int64(3)},
+		`return {a = 1}`:                          map[any]any{"a": int64(1)},
+		`local t = {1, 2, 3} t[2] = nil return t`: map[any]any{int64(1): int64(1), int64(3): int64(3)},
+		`local t = {1, 2, 3} t[3] = nil return t`: []any{int64(1), int64(2)},
+	} {
+		// convert multiple times, as results should not depend on the internal layout of tables
+		for range 3 {
+			results, err := s.Evaluate(ctx, code)
+			if err != nil {
+				t.Fatalf("Evaluate(`%s`) failed with error: %v", code, err)
+			}
+			if !reflect.DeepEqual(results[0], expected) {
+				t.Errorf("Evaluate(`%s`) = %#v, want %#v", code, results[0], expected)
+			}
+		}
+	}
+}
+
+// TestEvaluateExplain tests tracing calls to registered Go functions.
+func TestEvaluateExplain(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.RegisterFunction(ctx, "double", func(args []any) ([]any, error) {
+		return []any{args[0].(int64) * 2}, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if err := s.RegisterModule(ctx, "str", map[string]GoFunction{
+		"upper": func(args []any) ([]any, error) {
+			return []any{strings.ToUpper(args[0].(string))}, nil
+		},
+	}); err != nil {
+		t.Fatalf("RegisterModule failed with error: %v", err)
+	}
+
+	results, trace, err := s.EvaluateExplain(ctx, `
+		local a = double(1)
+		local b = double(a)
+		return str.upper("x"), b
+	`)
+	if err != nil {
+		t.Fatalf("EvaluateExplain failed with error: %v", err)
+	}
+	if len(results) != 2 || results[0].(string) != "X" || results[1].(int64) != 4 {
+		t.Errorf("EvaluateExplain returned %v, want [X 4]", results)
+	}
+
+	expected := []struct {
+		function string
+		arg      any
+		result   any
+	}{
+		{"double", int64(1), int64(2)},
+		{"double", int64(2), int64(4)},
+		{"str.upper", "x", "X"},
+	}
+	if len(trace.Calls) != len(expected) {
+		t.Fatalf("Expected %d calls in the trace, got %+v", len(expected), trace.Calls)
+	}
+	for i, call := range trace.Calls {
+		if call.Function != expected[i].function || call.Args[0] != expected[i].arg || call.Results[0] != expected[i].result {
+			t.Errorf("Unexpected call #%d in the trace: %+v", i+1, call)
+		}
+	}
+	if len(trace.Results) != 2 || trace.Err != nil {
+		t.Errorf("Unexpected final result in the trace: %v, %v", trace.Results, trace.Err)
+	}
+
+	// errors are also traced
+	_, trace, err = s.EvaluateExplain(ctx, `double(1); error("fail")`)
+	if err == nil || len(trace.Calls) != 1 || trace.Err == nil {
+		t.Errorf("Expected an error with 1 traced call, got %v and %+v", err, trace)
+	}
+}
+
+// TestLuaError tests structured errors returned from Lua.
+func TestLuaError(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// syntax error
+	_, err := s.Evaluate(ctx, `a = b c`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || luaErr.Kind != KindSyntax {
+		t.Fatalf("Expected a syntax error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "lua load error: ") {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+	if !errors.Is(err, ErrSyntax) || errors.Is(err, ErrRuntime) || errors.Is(err, ErrMemory) {
+		t.Errorf("Expected a syntax error to match only ErrSyntax, got %v", err)
+	}
+
+	// runtime error with a traceback
+	err = s.Execute(ctx, `
+		function inner() error("failed") end
+		function outer() inner() end
+	`)
+	if err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	_, err = s.Evaluate(ctx, `outer()`)
+	if !errors.As(err, &luaErr) || luaErr.Kind != KindRuntime {
+		t.Fatalf("Expected a runtime error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "lua runtime error: ") || !strings.HasSuffix(luaErr.Message, "failed") {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+	if !errors.Is(err, ErrRuntime) || errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a runtime error to match only ErrRuntime, got %v", err)
+	}
+	if !strings.Contains(luaErr.Traceback, "stack traceback:") ||
+		!strings.Contains(luaErr.Traceback, "inner") ||
+		!strings.Contains(luaErr.Traceback, "outer") {
+		t.Errorf("Unexpected traceback: %s", luaErr.Traceback)
+	}
+
+	// also from Execute and CallGlobal
+	if err := s.Execute(ctx, `outer()`); !errors.As(err, &luaErr) || luaErr.Kind != KindRuntime || luaErr.Traceback == "" {
+		t.Errorf("Expected a runtime error with a traceback, got %v", err)
+	}
+	if _, err := s.CallGlobal(ctx, "outer"); !errors.As(err, &luaErr) || luaErr.Kind != KindRuntime || luaErr.Traceback == "" {
+		t.Errorf("Expected a runtime error with a traceback, got %v", err)
+	}
+}
+
+// TestErrorValue tests structured error objects raised by scripts.
+func TestErrorValue(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `
+		function fail_with_table() error({code = 42, msg = "bad"}) end
+		function fail_with_number() error(404) end
+		function fail_with_string() error("plain", 0) end
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	for name, expected := range map[string]any{
+		"fail_with_table":  map[any]any{"code": int64(42), "msg": "bad"},
+		"fail_with_number": int64(404),
+		"fail_with_string": "plain",
+	} {
+		_, err := s.CallGlobal(ctx, name)
+		var luaErr *LuaError
+		if !errors.As(err, &luaErr) || !errors.Is(err, ErrRuntime) {
+			t.Errorf("Expected a *LuaError from %s, got %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(luaErr.Value, expected) {
+			t.Errorf("Expected the error value %v from %s, got %v", expected, name, luaErr.Value)
+		}
+	}
+
+	// from coroutines
+	co, err := s.NewCoroutine(ctx, `error({reason = "in coroutine"})`)
+	if err != nil {
+		t.Fatalf("NewCoroutine failed with error: %v", err)
+	}
+	defer co.Close()
+	var luaErr *LuaError
+	if _, _, err := co.Resume(ctx); !errors.As(err, &luaErr) || !reflect.DeepEqual(luaErr.Value, map[any]any{"reason": "in coroutine"}) {
+		t.Errorf("Expected a structured error from the coroutine, got %v", err)
+	}
+}
+
+// TestStackOverflow tests that runaway recursion fails with ErrStackOverflow, leaving the state usable.
+func TestStackOverflow(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for _, code := range []string{
+		`local function f() return 1 + f() end return f()`,
+		`local t = setmetatable({}, {__index = function(t, k) return t[k] end}) return t.x`,
+		`local function f() return string.gsub("a", "a", f) end return f()`,
+	} {
+		_, err := s.Evaluate(ctx, code)
+		if !errors.Is(err, ErrStackOverflow) || !errors.Is(err, ErrRuntime) {
+			t.Errorf("Expected ErrStackOverflow for `%s`, got %v", code, err)
+		}
+
+		// still usable
+		if results, err := s.Evaluate(ctx, `return 1 + 2`); err != nil || results[0] != int64(3) {
+			t.Fatalf("Expected 3 after a stack overflow, got %v (error: %v)", results, err)
+		}
+	}
+
+	// ordinary runtime errors do not match
+	for _, code := range []string{`error("failed")`, `error("stack overflow in my parser")`, `local x = nil + 1`} {
+		if _, err := s.Evaluate(ctx, code); err == nil || errors.Is(err, ErrStackOverflow) {
+			t.Errorf("Expected a runtime error other than ErrStackOverflow for `%s`, got %v", code, err)
+		}
+	}
+}
+
+// TestErrorMessages tests the messages of errors raised with non-string error objects.
+func TestErrorMessages(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for code, expected := range map[string]string{
+		`error(42)`:    "42",
+		`error(3.14)`:  "3.14",
+		`error(1e100)`: "1e+100",
+		`error(2^63)`:  "9.2233720368548e+18",
+		`error(true)`:  "true",
+		`error(nil)`:   "nil",
+		`error(setmetatable({}, {__tostring = function() return "custom error" end}))`:         "custom error",
+		`error(setmetatable({}, {__tostring = function() error("failed in __tostring") end}))`: "(error object is a table value)",
+		`error(setmetatable({}, {__name = "MyError"}))`:                                        "MyError: 0x",
+		`error({})`: "table: 0x",
+	} {
+		for _, run := range []func() error{
+			func() error { return s.Execute(ctx, code) },
+			func() error {
+				co, err := s.NewCoroutine(ctx, code)
+				if err != nil {
+					return err
+				}
+				defer co.Close()
+				_, _, err = co.Resume(ctx)
+				return err
+			},
+		} {
+			var luaErr *LuaError
+			if err := run(); !errors.As(err, &luaErr) || !strings.HasPrefix(luaErr.Message, expected) {
+				t.Errorf("Expected the message %q for `%s`, got %v", expected, code, err)
+			}
+		}
+	}
+
+	// exact values are still available
+	var luaErr *LuaError
+	if err := s.Execute(ctx, `error(0.1 + 0.2)`); !errors.As(err, &luaErr) || luaErr.Value != 0.30000000000000004 {
+		t.Errorf("Expected the exact error value %v, got %v", 0.30000000000000004, err)
+	}
+}
+
+// TestReferenceCycles tests converting tables with reference cycles.
+func TestReferenceCycles(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `
+		local t = {name = "t"}
+		t.self = t
+
+		local a, b = {name = "a"}, {name = "b"}
+		a.b, b.a = b, a
+
+		local shared = {1, 2}
+		local dag = {x = shared, y = shared}
+
+		return t, a, dag
+	`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	// self-reference
+	if tbl := results[0].(map[any]any); tbl["name"] != "t" || tbl["self"] != "<cycle>" {
+		t.Errorf("Unexpected conversion of a self-referential table: %v", tbl)
+	}
+
+	// mutual references
+	if a := results[1].(map[any]any); a["b"].(map[any]any)["a"] != "<cycle>" {
+		t.Errorf("Unexpected conversion of mutually referencing tables: %v", a)
+	}
+
+	// shared (but not cyclic) references are converted as they are
+	if dag := results[2].(map[any]any); len(dag["x"].([]any)) != 2 || len(dag["y"].([]any)) != 2 {
+		t.Errorf("Unexpected conversion of shared tables: %v", dag)
+	}
+}
+
+// TestOrderedTables tests converting tables to *OrderedTable.
+func TestOrderedTables(t *testing.T) {
+	s := NewStateWithOptions(Options{OrderedTables: true})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `
+		local t = {name = "lua", version = 5.4, tags = {"a", "b"}, [10] = true}
+		local keys = {}
+		for k in pairs(t) do keys[#keys + 1] = k end
+		return t, keys
+	`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	table, ok := results[0].(*OrderedTable)
+	if !ok {
+		t.Fatalf("Expected *OrderedTable, got %T", results[0])
+	}
+	if table.Len() != 4 {
+		t.Errorf("Expected 4 entries, got %d", table.Len())
+	}
+
+	// keys should be in the iteration order of `pairs`
+	if keys := table.Keys(); !reflect.DeepEqual(keys, results[1]) {
+		t.Errorf("Expected keys %v, got %v", results[1], keys)
+	}
+
+	if v, ok := table.Get("name"); !ok || v != "lua" {
+		t.Errorf("Expected 'lua' for 'name', got %v", v)
+	}
+	if v, ok := table.Get(int64(10)); !ok || v != true {
+		t.Errorf("Expected true for 10, got %v", v)
+	}
+	if v, ok := table.Get("tags"); !ok || !reflect.DeepEqual(v, []any{"a", "b"}) {
+		t.Errorf("Expected arrays to be converted to slices, got %v", v)
+	}
+	if _, ok := table.Get("missing"); ok {
+		t.Error("Expected no value for a missing key")
+	}
+
+	// ordered tables can be passed back to Lua
+	if err := s.SetGlobal(ctx, "config", table); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return config.name, config.tags[2]`); err != nil || !reflect.DeepEqual(results, []any{"lua", "b"}) {
+		t.Errorf("Expected [lua b], got %v (error: %v)", results, err)
+	}
+
+	// also in struct fields and slices
+	type Holder struct {
+		Table  *OrderedTable   `lua:"table"`
+		Tables []*OrderedTable `lua:"tables"`
+		Any    any             `lua:"any"`
+	}
+	if err := s.SetGlobal(ctx, "holder", Holder{Table: table, Tables: []*OrderedTable{table}, Any: table}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return holder.table.name, holder.tables[1].version, holder.any.tags[1]`); err != nil || !reflect.DeepEqual(results, []any{"lua", 5.4, "a"}) {
+		t.Errorf("Expected [lua 5.4 a], got %v (error: %v)", results, err)
+	}
+
+	// without the option, tables are converted to maps
+	plain := NewState()
+	defer plain.Close()
+	if results, err := plain.Evaluate(ctx, `return {a = 1}`); err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	} else if _, ok := results[0].(map[any]any); !ok {
+		t.Errorf("Expected map[any]any, got %T", results[0])
+	}
+}
+
+// TestMaxMemoryBytes tests limiting the memory which a state can allocate.
+func TestMaxMemoryBytes(t *testing.T) {
+	s := NewStateWithLimits(Options{MaxMemoryBytes: 4 * 1024 * 1024})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// small allocations should succeed
+	if results, err := s.Evaluate(ctx, `local t = {} for i = 1, 1000 do t[i] = i end return #t`); err != nil || results[0] != int64(1000) {
+		t.Errorf("Expected 1000, got %v (error: %v)", results, err)
+	}
+
+	// building a huge table should fail with a memory error
+	_, err := s.Evaluate(ctx, `
+		local t = {}
+		for i = 1, 100000000 do t[i] = tostring(i) end
+		return #t
+	`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || luaErr.Kind != KindMemory || !errors.Is(err, ErrMemory) {
+		t.Fatalf("Expected a memory error, got %v", err)
+	}
+
+	// the state should still be usable after the memory is released
+	if results, err := s.Evaluate(ctx, `collectgarbage() return 1 + 1`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestMaxMemoryBytesGoResults tests that values returned by Go functions beyond the memory limit
+// fail with memory errors.
+func TestMaxMemoryBytesGoResults(t *testing.T) {
+	s := NewStateWithLimits(Options{MaxMemoryBytes: 1024 * 1024})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	huge := strings.Repeat("x", 4*1024*1024)
+	many := make([]any, 200000)
+	for i := range many {
+		many[i] = int64(i)
+	}
+	if err := s.RegisterModule(ctx, "big", map[string]GoFunction{
+		"string": func(args []any) ([]any, error) { return []any{huge}, nil },
+		"table":  func(args []any) ([]any, error) { return []any{many}, nil },
+		"small":  func(args []any) ([]any, error) { return []any{"ok"}, nil },
+	}); err != nil {
+		t.Fatalf("RegisterModule failed with error: %v", err)
+	}
+
+	for _, code := range []string{
+		`return #big.string()`,
+		`return #big.table()`,
+		`local co = coroutine.wrap(function() return #big.string() end) return co()`,
+	} {
+		_, err := s.Evaluate(ctx, code)
+		var luaErr *LuaError
+		if !errors.As(err, &luaErr) || luaErr.Kind != KindMemory {
+			t.Errorf("Expected a memory error for `%s`, got %v", code, err)
+		}
+
+		// still usable
+		if results, err := s.Evaluate(ctx, `collectgarbage() return big.small()`); err != nil || results[0] != "ok" {
+			t.Errorf("Expected ok, got %v (error: %v)", results, err)
+		}
+	}
+
+	// as well as in coroutines resumed from Go
+	co, err := s.NewCoroutine(ctx, `return #big.string()`)
+	if err != nil {
+		t.Fatalf("NewCoroutine failed with error: %v", err)
+	}
+	defer co.Close()
+	var luaErr *LuaError
+	if _, _, err := co.Resume(ctx); !errors.As(err, &luaErr) || luaErr.Kind != KindMemory {
+		t.Errorf("Expected a memory error, got %v", err)
+	}
+}
+
+// TestMaxInstructions tests limiting the number of instructions per operation.
+func TestMaxInstructions(t *testing.T) {
+	s := NewStateWithLimits(Options{MaxInstructions: 100000})
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// short scripts should succeed, each with its own budget
+	for range 3 {
+		if results, err := s.Evaluate(ctx, `local n = 0 for i = 1, 1000 do n = n + i end return n`); err != nil || results[0] != int64(500500) {
+			t.Errorf("Expected 500500, got %v (error: %v)", results, err)
+		}
+	}
+
+	// a long loop should exceed the limit well before the timeout
+	start := time.Now()
+	err := s.Execute(ctx, `while true do end`)
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Fatalf("Expected an instruction limit error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the limit to be exceeded quickly, took %v", elapsed)
+	}
+
+	// the error cannot be caught by `pcall`
+	start = time.Now()
+	err = s.Execute(ctx, `while true do pcall(function() while true do end end) end`)
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Fatalf("Expected an instruction limit error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the limit to be exceeded quickly, took %v", elapsed)
+	}
+
+	// (also in coroutines, which keep working afterward)
+	err = s.Execute(ctx, `while true do coroutine.wrap(function() pcall(function() while true do end end) end)() end`)
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Fatalf("Expected an instruction limit error, got %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `local n = 0 for i = 1, 1000 do pcall(function() n = n + i end) end return n`); err != nil || results[0] != int64(500500) {
+		t.Errorf("Expected 500500, got %v (error: %v)", results, err)
+	}
+}
+
+// TestMaxResults tests limiting the number of results returned to Go.
+func TestMaxResults(t *testing.T) {
+	s := NewStateWithOptions(Options{MaxResults: 3})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if results, err := s.Evaluate(ctx, `return 1, 2, 3`); err != nil || len(results) != 3 {
+		t.Errorf("Expected 3 results, got %v (error: %v)", results, err)
+	}
+	if _, err := s.Evaluate(ctx, `local t = {} for i = 1, 100000 do t[i] = i end return table.unpack(t)`); err == nil || !strings.Contains(err.Error(), "too many results (100000, max 3)") {
+		t.Errorf("Expected a too many results error, got %v", err)
+	}
+
+	co, err := s.NewCoroutine(ctx, `coroutine.yield(1, 2, 3, 4)`)
+	if err != nil {
+		t.Fatalf("NewCoroutine failed with error: %v", err)
+	}
+	defer co.Close()
+	if _, _, err := co.Resume(ctx); err == nil || !strings.Contains(err.Error(), "too many results") {
+		t.Errorf("Expected a too many results error, got %v", err)
+	}
+
+	// the stack should be left balanced
+	if results, err := s.Evaluate(ctx, `return select('#', 1, 2)`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestSandboxedState tests opening only selected standard libraries.
+func TestSandboxedState(t *testing.T) {
+	s := NewSandboxedState(LibMath, LibString, LibTable)
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// opened libraries should be available
+	results, err := s.Evaluate(ctx, `return math.max(1, 2), string.upper("lua"), table.concat({"a", "b"}), tostring(42)`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if !reflect.DeepEqual(results, []any{int64(2), "LUA", "ab", "42"}) {
+		t.Errorf("Unexpected results: %v", results)
+	}
+
+	// others should be nil
+	for _, name := range []string{"os", "io", "package", "require", "debug", "coroutine", "utf8", "dofile", "loadfile"} {
+		if results, err := s.Evaluate(ctx, `return `+name+` == nil`); err != nil || results[0] != true {
+			t.Errorf("Expected '%s' to be nil, got %v (error: %v)", name, results, err)
+		}
+	}
+	if err := s.Execute(ctx, `os.execute("echo sandbox")`); err == nil {
+		t.Error("Expected os.execute to be unavailable in a sandboxed state")
+	}
+
+	// binary chunks are rejected by `load`
+	results, err = s.Evaluate(ctx, `
+		local dumped = string.dump(function() return 1 end)
+		local f1, err1 = load(dumped)
+		local f2, err2 = load(dumped, "dumped", "b")
+		local f3, err3 = load(function() local d = dumped dumped = nil return d end)
+		return f1 == nil and f2 == nil and f3 == nil, err1`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if results[0] != true || !strings.Contains(results[1].(string), "binary chunk") {
+		t.Errorf("Expected load to reject binary chunks, got %v", results)
+	}
+
+	// while text chunks are loaded as usual (with or without an env)
+	if results, err := s.Evaluate(ctx, `
+		x = 1
+		return load("return 1 + 1")(), load("return x", "c", "t", {x = 5})(), load("return x", "c")()`); err != nil || !reflect.DeepEqual(results, []any{int64(2), int64(5), int64(1)}) {
+		t.Errorf("Expected [2 5 1], got %v (error: %v)", results, err)
+	}
+
+	// and by operations of the State
+	plain := NewState()
+	defer plain.Close()
+	bytecode, err := plain.Dump(ctx, `return 42`)
+	if err != nil {
+		t.Fatalf("Dump failed with error: %v", err)
+	}
+	if _, err := s.Evaluate(ctx, string(bytecode)); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a load error for bytecode, got %v", err)
+	}
+	if _, err := s.EvaluateReader(ctx, bytes.NewReader(bytecode), ""); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a load error for bytecode from a reader, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "dumped.luac")
+	if err := os.WriteFile(path, bytecode, 0o644); err != nil {
+		t.Fatalf("WriteFile failed with error: %v", err)
+	}
+	if err := s.ExecuteFile(ctx, path); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a load error for bytecode from a file, got %v", err)
+	}
+	if _, err := s.LoadBytecode(ctx, bytecode); err == nil || !strings.Contains(err.Error(), "not allowed in sandboxed states") {
+		t.Errorf("Expected LoadBytecode to be rejected, got %v", err)
+	}
+	if results, err := plain.Evaluate(ctx, string(bytecode)); err != nil || results[0] != int64(42) {
+		t.Errorf("Expected bytecode to be loaded in a state which is not sandboxed, got %v (error: %v)", results, err)
+	}
+}
+
+// TestSetOutput tests capturing the output of `print`.
+func TestSetOutput(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	var buf strings.Builder
+	if err := s.SetOutput(ctx, &buf); err != nil {
+		t.Fatalf("SetOutput failed with error: %v", err)
+	}
+
+	if err := s.Execute(ctx, `print("a", 1, true)`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `print() print(nil, 1.5, setmetatable({}, {__tostring = function() return "obj" end}))`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	if expected := "a\t1\ttrue\n\nnil\t1.5\tobj\n"; buf.String() != expected {
+		t.Errorf("Expected output %q, got %q", expected, buf.String())
+	}
+}
+
+// TestRun tests capturing what a script prints.
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	var buf strings.Builder
+	if err := s.SetOutput(ctx, &buf); err != nil {
+		t.Fatalf("SetOutput failed with error: %v", err)
+	}
+
+	if output, err := s.Run(ctx, `print("hello", 42) print(true)`); err != nil || output != "hello\t42\ntrue\n" {
+		t.Errorf("Expected 'hello\\t42\\ntrue\\n', got %q (error: %v)", output, err)
+	}
+
+	// output before an error is returned with it
+	if output, err := s.Run(ctx, `print("before") error("boom")`); !errors.Is(err, ErrRuntime) || output != "before\n" {
+		t.Errorf("Expected 'before\\n' with a runtime error, got %q (error: %v)", output, err)
+	}
+	if _, err := s.Run(ctx, `print(`); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+
+	// the previous print function is restored
+	if err := s.Execute(ctx, `print("restored")`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if buf.String() != "restored\n" {
+		t.Errorf("Expected 'restored\\n', got %q", buf.String())
+	}
+
+	// the same `print` replacement is reused, writing to the current writer
+	if _, err := s.Run(ctx, `captured = print`); err != nil {
+		t.Fatalf("Run failed with error: %v", err)
+	}
+	if output, err := s.Run(ctx, `print(captured == print)`); err != nil || output != "true\n" {
+		t.Errorf("Expected 'true\\n', got %q (error: %v)", output, err)
+	}
+}
+
+// TestCompile tests compiling a chunk and calling it repeatedly.
+func TestCompile(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	chunk, err := s.Compile(ctx, `local a, b = ... return a * b`, "=multiply")
+	if err != nil {
+		t.Fatalf("Compile failed with error: %v", err)
+	}
+
+	for i := range 10 {
+		results, err := chunk.Call(ctx, i, 3)
+		if err != nil {
+			t.Fatalf("Call failed with error: %v", err)
+		}
+		if results[0] != int64(i*3) {
+			t.Errorf("Expected %d, got %v", i*3, results[0])
+		}
+	}
+
+	// the chunk name should appear in error messages
+	if _, err := chunk.Call(ctx, "x", nil); err == nil || !strings.Contains(err.Error(), "multiply:1:") {
+		t.Errorf("Expected an error with the chunk name, got %v", err)
+	}
+
+	if err := chunk.Release(ctx); err != nil {
+		t.Fatalf("Release failed with error: %v", err)
+	}
+	if err := chunk.Release(ctx); err != nil {
+		t.Fatalf("Releasing again failed with error: %v", err)
+	}
+	if _, err := chunk.Call(ctx, 1, 2); err == nil {
+		t.Error("Expected error for calling a released chunk, got nil")
+	}
+
+	// syntax errors
+	var luaErr *LuaError
+	if _, err := s.Compile(ctx, `return +`, "=broken"); !errors.As(err, &luaErr) || luaErr.Kind != KindSyntax {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+}
+
+// TestCheck tests checking syntax without running code.
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Check(ctx, `ran = true error("not run")`); err != nil {
+		t.Errorf("Check failed with error: %v", err)
+	}
+	if value, err := s.GetGlobal(ctx, "ran"); err != nil || value != nil {
+		t.Errorf("Expected the code not to be run, got %v (error: %v)", value, err)
+	}
+
+	err := s.Check(ctx, "local x = 1\nif x then")
+	var luaErr *LuaError
+	if !errors.Is(err, ErrSyntax) || !errors.As(err, &luaErr) || !strings.Contains(luaErr.Message, "'end' expected") {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+}
+
+// TestEvaluateReader tests evaluating Lua code read from readers.
+func TestEvaluateReader(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// a large script, read in small and large chunks
+	var code strings.Builder
+	code.WriteString("local sum = 0\n")
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(&code, "sum = sum + %d\n", i)
+	}
+	code.WriteString("return sum, ...")
+	for _, r := range []io.Reader{
+		strings.NewReader(code.String()),
+		iotest.HalfReader(strings.NewReader(code.String())),
+	} {
+		if results, err := s.EvaluateReader(ctx, r, ""); err != nil || !reflect.DeepEqual(results, []any{int64(200010000)}) {
+			t.Errorf("Expected [200010000], got %v (error: %v)", results, err)
+		}
+	}
+
+	// syntax errors
+	var luaErr *LuaError
+	if _, err := s.EvaluateReader(ctx, strings.NewReader("return 1 +"), ""); !errors.As(err, &luaErr) || luaErr.Kind != KindSyntax || !strings.HasPrefix(luaErr.Message, "reader:1:") {
+		t.Errorf("Expected a syntax error from 'reader', got %v", err)
+	}
+	if _, err := s.EvaluateReader(ctx, strings.NewReader("\nerror('failed')"), "=script"); !errors.As(err, &luaErr) || !strings.HasPrefix(luaErr.Message, "script:2:") {
+		t.Errorf("Expected a runtime error from 'script', got %v", err)
+	}
+
+	// reader errors (even if the code read so far is valid)
+	errRead := errors.New("read failed")
+	if _, err := s.EvaluateReader(ctx, io.MultiReader(strings.NewReader("x = 1"), iotest.ErrReader(errRead)), ""); !errors.Is(err, errRead) || errors.As(err, &luaErr) {
+		t.Errorf("Expected the reader error, got %v", err)
+	}
+	if value, err := s.GetGlobal(ctx, "x"); err != nil || value != nil {
+		t.Errorf("Expected the partially-read code not to be run, got %v (error: %v)", value, err)
+	}
+	if results, err := s.Evaluate(ctx, `return select('#', 1, 2)`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestSyntaxErrorLine tests the line numbers of syntax errors.
+func TestSyntaxErrorLine(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	code := "local a = 1\nlocal b = 2\nlocal c = = 3\n"
+	for _, tc := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"Check", func() error { return s.Check(ctx, code) }},
+		{"Evaluate", func() error { _, err := s.Evaluate(ctx, code); return err }},
+		{"Evaluate (location-like code)", func() error { _, err := s.Evaluate(ctx, `x = "a:1: b"`+"\n\n"+`+`); return err }},
+		{"EvaluateNamed", func() error { _, err := s.EvaluateNamed(ctx, "=script", code); return err }},
+		{"ExecuteNamed", func() error { return s.ExecuteNamed(ctx, "@scripts/main.lua", code) }},
+	} {
+		var luaErr *LuaError
+		if err := tc.fn(); !errors.As(err, &luaErr) || luaErr.Kind != KindSyntax {
+			t.Errorf("%s: expected a syntax error, got %v", tc.name, err)
+		} else if luaErr.Line != 3 {
+			t.Errorf("%s: expected the line 3, got %d (%s)", tc.name, luaErr.Line, luaErr.Message)
+		}
+	}
+
+	// runtime errors
+	var luaErr *LuaError
+	if err := s.Execute(ctx, "\n\nerror('failed')"); !errors.As(err, &luaErr) || luaErr.Line != 0 {
+		t.Errorf("Expected a runtime error without the line, got %v", err)
+	}
+}
+
+// TestDumpAndLoadBytecode tests dumping bytecode and loading it in another state.
+func TestDumpAndLoadBytecode(t *testing.T) {
+	ctx := context.Background()
+
+	s1 := NewState()
+	defer s1.Close()
+
+	data, err := s1.Dump(ctx, `local n = ... local s = 0 for i = 1, n do s = s + i end return s`)
+	if err != nil {
+		t.Fatalf("Dump failed with error: %v", err)
+	}
+	if len(data) == 0 || data[0] != 0x1b {
+		t.Fatalf("Expected a binary chunk, got %q", data)
+	}
+
+	s2 := NewState()
+	defer s2.Close()
+
+	chunk, err := s2.LoadBytecode(ctx, data)
+	if err != nil {
+		t.Fatalf("LoadBytecode failed with error: %v", err)
+	}
+	defer chunk.Release(ctx)
+
+	if results, err := chunk.Call(ctx, 100); err != nil || results[0] != int64(5050) {
+		t.Errorf("Expected 5050, got %v (error: %v)", results, err)
+	}
+
+	// source code should be rejected
+	if _, err := s2.LoadBytecode(ctx, []byte(`return 1`)); err == nil {
+		t.Error("Expected error for loading source code as bytecode, got nil")
+	}
+
+	// so should syntax errors while dumping
+	if _, err := s1.Dump(ctx, `return +`); err == nil {
+		t.Error("Expected error for dumping invalid code, got nil")
+	}
+}
+
+// TestToStringMetamethod tests converting values of unsupported types with `__tostring`.
+func TestToStringMetamethod(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `return io.stdout, coroutine.create(function() end)`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	// userdata with `__tostring`
+	if str, ok := results[0].(string); !ok || !strings.HasPrefix(str, "file (") || str == "file (closed)" {
+		t.Errorf("Expected a file description, got %#v", results[0])
+	}
+	// thread without `__tostring`
+	if results[1] != "<unsupported Lua type: thread>" {
+		t.Errorf("Expected a placeholder, got %#v", results[1])
+	}
+
+	// functions with `__tostring` (failing or not)
+	results, err = s.Evaluate(ctx, `
+		debug.setmetatable(print, {__tostring = function(f) return f == print and "print" or error("broken") end})
+		return print, function() end
+	`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if results[0] != "print" {
+		t.Errorf("Expected 'print', got %#v", results[0])
+	}
+	if str, ok := results[1].(string); !ok || !strings.HasPrefix(str, "<unsupported Lua type: function (Lua function defined at ") {
+		t.Errorf("Expected a placeholder for a failing __tostring, got %#v", results[1])
+	}
+}
+
+// TestFunctionPlaceholders tests describing functions in their placeholders.
+func TestFunctionPlaceholders(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.RegisterFunction(ctx, "gofunc", func(args []any) ([]any, error) { return nil, nil }); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	results, err := s.EvaluateNamed(ctx, "=script", `
+		local function f() end
+		return print, gofunc, f, function() end`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	expected := []any{
+		"<unsupported Lua type: function (C function)>",
+		"<unsupported Lua type: function (C function)>",
+		"<unsupported Lua type: function (Lua function defined at script:2)>",
+		"<unsupported Lua type: function (Lua function defined at script:3)>",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+}
+
+// TestFunctionRefs tests converting Lua functions to callable references.
+func TestFunctionRefs(t *testing.T) {
+	s := NewStateWithOptions(Options{FunctionRefs: true})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `
+		local count = 0
+		return {
+			increment = function(n) count = count + (n or 1) return count end,
+			get = function() return count end,
+		}
+	`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	handlers, ok := results[0].(map[any]any)
+	if !ok {
+		t.Fatalf("Expected a table of handlers, got %#v", results[0])
+	}
+	increment, ok1 := handlers["increment"].(*LuaRef)
+	get, ok2 := handlers["get"].(*LuaRef)
+	if !ok1 || !ok2 {
+		t.Fatalf("Expected *LuaRef values, got %#v", handlers)
+	}
+	defer get.Close()
+
+	// functions can be called repeatedly, sharing upvalues
+	for range 3 {
+		if _, err := increment.Call(ctx, 2); err != nil {
+			t.Fatalf("Call failed with error: %v", err)
+		}
+	}
+	if results, err := get.Call(ctx); err != nil || results[0] != int64(6) {
+		t.Errorf("Expected 6, got %v (error: %v)", results, err)
+	}
+
+	if err := increment.Close(); err != nil {
+		t.Fatalf("Close failed with error: %v", err)
+	}
+	if err := increment.Close(); err != nil {
+		t.Fatalf("Closing again failed with error: %v", err)
+	}
+	if _, err := increment.Call(ctx); err == nil {
+		t.Error("Expected error for calling a closed reference, got nil")
+	}
+
+	// without the option, functions are converted to placeholders
+	plain := NewState()
+	defer plain.Close()
+	if results, err := plain.Evaluate(ctx, `return function() end`); err != nil || results[0] != `<unsupported Lua type: function (Lua function defined at [string "return function() end"]:1)>` {
+		t.Errorf("Expected a placeholder, got %v (error: %v)", results, err)
+	}
+}
+
+// TestReset tests resetting a state.
+func TestReset(t *testing.T) {
+	s := NewStateWithOptions(Options{FunctionRefs: true})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.Execute(ctx, `user_global = 42`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if err := s.RegisterFunction(ctx, "hello", func(args []any) ([]any, error) {
+		return []any{"hello"}, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	chunk, err := s.Compile(ctx, `return 1`, "")
+	if err != nil {
+		t.Fatalf("Compile failed with error: %v", err)
+	}
+	results, err := s.Evaluate(ctx, `return function() return 2 end`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	ref := results[0].(*LuaRef)
+
+	if err := s.Reset(ctx); err != nil {
+		t.Fatalf("Reset failed with error: %v", err)
+	}
+
+	// globals should be gone
+	if v, err := s.GetGlobal(ctx, "user_global"); err != nil || v != nil {
+		t.Errorf("Expected user_global to be nil after Reset, got %v", v)
+	}
+	if v, err := s.GetGlobal(ctx, "hello"); err != nil || v != nil {
+		t.Errorf("Expected hello to be nil after Reset, got %v", v)
+	}
+
+	// but the standard libraries should still work
+	if results, err := s.Evaluate(ctx, `return string.format("%d-%s", 1, "a")`); err != nil || results[0] != "1-a" {
+		t.Errorf("Expected 1-a, got %v (error: %v)", results, err)
+	}
+
+	// references to the previous state should be invalid
+	if _, err := chunk.Call(ctx); err == nil {
+		t.Error("Expected error for calling a chunk after Reset, got nil")
+	}
+	if _, err := ref.Call(ctx); err == nil {
+		t.Error("Expected error for calling a function reference after Reset, got nil")
+	}
+	if err := ref.Close(); err != nil {
+		t.Errorf("Close failed with error: %v", err)
+	}
+}
+
+// TestClone tests cloning the globals defined by scripts into a new state.
+func TestClone(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `
+		config = {name = "base", ports = {80, 443}, [1.5] = "float key"}
+		config.self = config
+		alias = config
+
+		local insert, count = table.insert, 0
+		function add(list, value)
+			count = count + 1
+			insert(list, value)
+			return count
+		end
+
+		Point = {}
+		Point.__index = Point
+		function Point.new(x, y) return setmetatable({x = x, y = y}, Point) end
+		function Point:sum() return self.x + self.y end
+		origin = Point.new(1, 2)
+
+		local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		fibonacci = fib
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	clone, err := s.Clone(ctx)
+	if err != nil {
+		t.Fatalf("Clone failed with error: %v", err)
+	}
+	defer clone.Close()
+
+	if results, err := clone.Evaluate(ctx, `
+		local list = {}
+		return config.name, config.ports[2], config[1.5], config.self == config, alias == config,
+			add(list, "a"), list[1], origin:sum(), getmetatable(origin) == Point, fibonacci(10)
+	`); err != nil || !reflect.DeepEqual(results, []any{"base", int64(443), "float key", true, true, int64(1), "a", int64(3), true, int64(55)}) {
+		t.Errorf("Expected cloned globals, got %v (error: %v)", results, err)
+	}
+
+	// independent of the original
+	if err := clone.Execute(ctx, `config.name = "clone" add({}, 1)`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return config.name, add({}, 1)`); err != nil || !reflect.DeepEqual(results, []any{"base", int64(1)}) {
+		t.Errorf("Expected the original to be unchanged, got %v (error: %v)", results, err)
+	}
+
+	// values which cannot be cloned
+	if err := s.RegisterFunction(ctx, "go_function", func(args []any) ([]any, error) { return nil, nil }); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if _, err := s.Clone(ctx); err == nil || !strings.Contains(err.Error(), "go_function") {
+		t.Errorf("Expected an error for a Go function, got %v", err)
+	}
+	if err := s.Execute(ctx, `go_function = nil co = coroutine.create(function() end)`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if _, err := s.Clone(ctx); err == nil || !strings.Contains(err.Error(), "thread") {
+		t.Errorf("Expected an error for a coroutine, got %v", err)
+	}
+}
+
+// TestEvaluateWithArgs tests passing arguments to evaluated code.
+func TestEvaluateWithArgs(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if results, err := s.EvaluateWithArgs(ctx, `local a, b = ... return a + b`, 5, 3); err != nil || results[0] != int64(8) {
+		t.Errorf("Expected 8, got %v (error: %v)", results, err)
+	}
+
+	// values are not interpolated into the code
+	if results, err := s.EvaluateWithArgs(ctx, `local s = ... return #s, select("#", ...)`, `"); os.exit() --`, nil); err != nil || !reflect.DeepEqual(results, []any{int64(16), int64(2)}) {
+		t.Errorf("Expected [16 2], got %v (error: %v)", results, err)
+	}
+
+	if _, err := s.EvaluateWithArgs(ctx, `return ...`, make(chan int)); err == nil || !strings.Contains(err.Error(), "argument 1") {
+		t.Errorf("Expected an argument error, got %v", err)
+	}
+}
+
+// TestNamedChunks tests error locations of named chunks.
+func TestNamedChunks(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if _, err := s.EvaluateNamed(ctx, "=config", "local x = 1\nreturn x + nil"); err == nil || !strings.Contains(err.Error(), "config:2:") {
+		t.Errorf("Expected an error at config:2, got %v", err)
+	}
+	if err := s.ExecuteNamed(ctx, "@script.lua", "x = 1\n\ny = ="); !errors.Is(err, ErrSyntax) || !strings.Contains(err.Error(), "script.lua:3:") {
+		t.Errorf("Expected a syntax error at script.lua:3, got %v", err)
+	}
+	if results, err := s.EvaluateNamed(ctx, "=config", `return x`); err != nil || !reflect.DeepEqual(results, []any{nil}) {
+		t.Errorf("Expected [<nil>], got %v (error: %v)", results, err)
+	}
+
+	// anonymous chunks embed the code
+	if _, err := s.Evaluate(ctx, `return 1 + nil`); err == nil || !strings.Contains(err.Error(), `[string "return 1 + nil"]:1:`) {
+		t.Errorf("Expected an error in the anonymous chunk, got %v", err)
+	}
+}
+
+// TestEvaluateExpr tests evaluating bare expressions.
+func TestEvaluateExpr(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for _, tc := range []struct {
+		code     string
+		expected []any
+	}{
+		{`1+2`, []any{int64(3)}},
+		{`math.sqrt(16)`, []any{4.0}},
+		{`"a" .. "b", 2 ^ 10`, []any{"ab", 1024.0}},
+		{`return 42`, []any{int64(42)}},
+		{`x = 7`, []any{}},
+		{`local y = x * 6 return y`, []any{int64(42)}},
+	} {
+		if results, err := s.EvaluateExpr(ctx, tc.code); err != nil || !reflect.DeepEqual(results, tc.expected) {
+			t.Errorf("Expected %v for `%s`, got %v (error: %v)", tc.expected, tc.code, results, err)
+		}
+	}
+
+	// genuine syntax errors are reported for the code itself
+	_, err := s.EvaluateExpr(ctx, `1 +`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || luaErr.Kind != KindSyntax || strings.Contains(luaErr.Message, "return") {
+		t.Errorf("Expected a syntax error for the code, got %v", err)
+	}
+	if _, err := s.EvaluateExpr(ctx, `x = = 1`); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+}
+
+// TestEvaluateIncremental tests evaluating inputs of an interactive console.
+func TestEvaluateIncremental(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	// complete statements and expressions
+	if results, incomplete, err := s.EvaluateIncremental(ctx, `x = 40`); err != nil || incomplete || len(results) != 0 {
+		t.Errorf("Expected no results, got %v (incomplete: %v, error: %v)", results, incomplete, err)
+	}
+	if results, incomplete, err := s.EvaluateIncremental(ctx, `x + 2, "two"`); err != nil || incomplete || !reflect.DeepEqual(results, []any{int64(42), "two"}) {
+		t.Errorf("Expected [42 two], got %v (incomplete: %v, error: %v)", results, incomplete, err)
+	}
+
+	// incomplete input, completed with more lines
+	input := "function add(a, b)"
+	for _, line := range []string{"  local sum = a + b", "  return sum"} {
+		if _, incomplete, err := s.EvaluateIncremental(ctx, input); err != nil || !incomplete {
+			t.Fatalf("Expected incomplete input for %q, got incomplete: %v, error: %v", input, incomplete, err)
+		}
+		input += "\n" + line
+	}
+	input += "\nend"
+	if _, incomplete, err := s.EvaluateIncremental(ctx, input); err != nil || incomplete {
+		t.Fatalf("Expected complete input, got incomplete: %v, error: %v", incomplete, err)
+	}
+	if results, _, err := s.EvaluateIncremental(ctx, `add(1, 2)`); err != nil || !reflect.DeepEqual(results, []any{int64(3)}) {
+		t.Errorf("Expected [3], got %v (error: %v)", results, err)
+	}
+	for _, code := range []string{`t = {1, 2,`, `s = "unfinished \`, `if true then`} {
+		if _, incomplete, err := s.EvaluateIncremental(ctx, code); err != nil || !incomplete {
+			t.Errorf("Expected incomplete input for %q, got incomplete: %v, error: %v", code, incomplete, err)
+		}
+	}
+
+	// actual errors
+	if _, incomplete, err := s.EvaluateIncremental(ctx, `x = = 1`); !errors.Is(err, ErrSyntax) || incomplete {
+		t.Errorf("Expected a syntax error, got incomplete: %v, error: %v", incomplete, err)
+	}
+	if _, incomplete, err := s.EvaluateIncremental(ctx, `error("boom")`); !errors.Is(err, ErrRuntime) || incomplete {
+		t.Errorf("Expected a runtime error, got incomplete: %v, error: %v", incomplete, err)
+	}
+}
+
+// TestSetSearchPath tests requiring modules from a configured search path.
+func TestSetSearchPath(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mymodule.lua"), []byte(`return {greet = function(name) return "hello, " .. name end}`), 0o644); err != nil {
+		t.Fatalf("Failed to write module file: %v", err)
+	}
+	path := filepath.Join(dir, "?.lua")
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `require("mymodule")`); err == nil {
+		t.Fatal("Expected error for requiring a module outside of the search path, got nil")
+	}
+	if err := s.SetSearchPath(ctx, path); err != nil {
+		t.Fatalf("SetSearchPath failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return require("mymodule").greet("lua"), package.path`); err != nil || !reflect.DeepEqual(results, []any{"hello, lua", path}) {
+		t.Errorf("Expected [hello, lua %s], got %v (error: %v)", path, results, err)
+	}
+	if err := s.SetCSearchPath(ctx, filepath.Join(dir, "?.so")); err != nil {
+		t.Fatalf("SetCSearchPath failed with error: %v", err)
+	}
+
+	// with an option
+	s2 := NewStateWithOptions(Options{SearchPath: path})
+	defer s2.Close()
+	if results, err := s2.Evaluate(ctx, `return require("mymodule").greet("go")`); err != nil || results[0] != "hello, go" {
+		t.Errorf("Expected 'hello, go', got %v (error: %v)", results, err)
+	}
+
+	// without the package library
+	s3 := NewSandboxedState()
+	defer s3.Close()
+	if err := s3.SetSearchPath(ctx, path); err == nil {
+		t.Error("Expected error for a state without the package library, got nil")
+	}
+}
+
+// TestUnloadModule tests reloading a required module after unloading it.
+func TestUnloadModule(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "reloaded.lua")
+	if err := os.WriteFile(file, []byte(`return {version = 1}`), 0o644); err != nil {
+		t.Fatalf("Failed to write module file: %v", err)
+	}
+
+	s := NewStateWithOptions(Options{SearchPath: filepath.Join(dir, "?.lua")})
+	defer s.Close()
+
+	if results, err := s.Evaluate(ctx, `old = require("reloaded") return old.version`); err != nil || results[0] != int64(1) {
+		t.Fatalf("Expected 1, got %v (error: %v)", results, err)
+	}
+	if err := os.WriteFile(file, []byte(`return {version = 2}`), 0o644); err != nil {
+		t.Fatalf("Failed to write module file: %v", err)
+	}
+
+	// cached until unloaded
+	if results, err := s.Evaluate(ctx, `return require("reloaded").version`); err != nil || results[0] != int64(1) {
+		t.Errorf("Expected the cached module (1), got %v (error: %v)", results, err)
+	}
+	if err := s.UnloadModule(ctx, "reloaded"); err != nil {
+		t.Fatalf("UnloadModule failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return require("reloaded").version, old.version`); err != nil || !reflect.DeepEqual(results, []any{int64(2), int64(1)}) {
+		t.Errorf("Expected the reloaded module [2 1], got %v (error: %v)", results, err)
+	}
+
+	// unloading modules which are not loaded is a no-op
+	if err := s.UnloadModule(ctx, "missing"); err != nil {
+		t.Errorf("UnloadModule for a module not loaded failed with error: %v", err)
+	}
+}
+
+// TestSetModuleFS tests loading Lua modules from an fs.FS.
+func TestSetModuleFS(t *testing.T) {
+	ctx := context.Background()
+
+	fsys := fstest.MapFS{
+		"greeter.lua":     {Data: []byte(`return {greet = function(name) return "hello, " .. name end}`)},
+		"util/init.lua":   {Data: []byte(`return {path = select(2, ...)}`)},
+		"util/string.lua": {Data: []byte(`return {upper = string.upper}`)},
+		"broken.lua":      {Data: []byte(`return {`)},
+	}
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.SetModuleFS(ctx, fsys); err != nil {
+		t.Fatalf("SetModuleFS failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return require("greeter").greet("lua")`); err != nil || results[0] != "hello, lua" {
+		t.Errorf("Expected 'hello, lua', got %v (error: %v)", results, err)
+	}
+	if results, err := s.Evaluate(ctx, `return require("util").path, require("util.string").upper("lua")`); err != nil || !reflect.DeepEqual(results, []any{"util/init.lua", "LUA"}) {
+		t.Errorf("Expected [util/init.lua LUA], got %v (error: %v)", results, err)
+	}
+	if err := s.Execute(ctx, `require("missing")`); err == nil || !strings.Contains(err.Error(), "no file 'missing.lua' in module FS") {
+		t.Errorf("Expected error for a missing module, got %v", err)
+	}
+	if err := s.Execute(ctx, `require("broken")`); err == nil || !strings.Contains(err.Error(), "broken.lua") {
+		t.Errorf("Expected error for a broken module, got %v", err)
+	}
+
+	// replacing the FS does not install another searcher
+	if err := s.SetModuleFS(ctx, fstest.MapFS{"other.lua": {Data: []byte(`return 42`)}}); err != nil {
+		t.Fatalf("SetModuleFS failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return require("other"), #package.searchers`); err != nil || !reflect.DeepEqual(results, []any{int64(42), int64(5)}) {
+		t.Errorf("Expected [42 5], got %v (error: %v)", results, err)
+	}
+
+	// without the package library
+	s2 := NewSandboxedState()
+	defer s2.Close()
+	if err := s2.SetModuleFS(ctx, fsys); err == nil {
+		t.Error("Expected error for a state without the package library, got nil")
+	}
+}
+
+// TestGetGlobals tests getting multiple global variables at once.
+func TestGetGlobals(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.Execute(ctx, `host = "localhost" port = 8080 tags = {"a", "b"}`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	globals, err := s.GetGlobals(ctx, "host", "port", "tags", "missing")
+	if err != nil {
+		t.Fatalf("GetGlobals failed with error: %v", err)
+	}
+	if expected := map[string]any{"host": "localhost", "port": int64(8080), "tags": []any{"a", "b"}, "missing": nil}; !reflect.DeepEqual(globals, expected) {
+		t.Errorf("Expected %v, got %v", expected, globals)
+	}
+
+	if globals, err := s.GetGlobals(ctx); err != nil || len(globals) != 0 {
+		t.Errorf("Expected no globals, got %v (error: %v)", globals, err)
+	}
+
+	// conversion errors fail the whole call, leaving the stack balanced
+	s2 := NewStateWithOptions(Options{MaxTableDepth: 1})
+	defer s2.Close()
+	if err := s2.Execute(ctx, `ok = 1 nested = {{}}`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if _, err := s2.GetGlobals(ctx, "ok", "nested"); err == nil || !strings.Contains(err.Error(), "'nested'") {
+		t.Errorf("Expected an error for 'nested', got %v", err)
+	}
+	if results, err := s2.Evaluate(ctx, `return select('#', 1, 2)`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestHasGlobal tests checking the presence of globals.
+func TestHasGlobal(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `present = 0 falsy = false cleared = 1 cleared = nil`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	for name, expected := range map[string]bool{
+		"present":   true,
+		"falsy":     true,
+		"print":     true,
+		"cleared":   false,
+		"undefined": false,
+	} {
+		if exists, err := s.HasGlobal(ctx, name); err != nil || exists != expected {
+			t.Errorf("Expected %v for global '%s', got %v (error: %v)", expected, name, exists, err)
+		}
+	}
+
+	s.Close()
+	if _, err := s.HasGlobal(ctx, "present"); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed, got %v", err)
+	}
+}
+
+// TestBytes tests passing byte slices as binary-safe Lua strings.
+func TestBytes(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	blob := []byte{0x00, 0xff, 'l', 'u', 'a', 0x00, 0x80}
+	if err := s.SetGlobal(ctx, "blob", blob); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return type(blob), #blob, blob:byte(2)`); err != nil || !reflect.DeepEqual(results, []any{"string", int64(7), int64(255)}) {
+		t.Errorf("Expected [string 7 255], got %v (error: %v)", results, err)
+	}
+	if value, err := s.GetGlobalBytes(ctx, "blob"); err != nil || !reflect.DeepEqual(value, blob) {
+		t.Errorf("Expected %v, got %v (error: %v)", blob, value, err)
+	}
+
+	// returned from a Go function
+	if err := s.RegisterFunction(ctx, "reversed", func(args []any) ([]any, error) {
+		b := []byte(args[0].(string))
+		slices.Reverse(b)
+		return []any{b}, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `reversed_blob = reversed(blob) empty = reversed("")`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if value, err := s.GetGlobalBytes(ctx, "reversed_blob"); err != nil || !reflect.DeepEqual(value, []byte{0x80, 0x00, 'a', 'u', 'l', 0xff, 0x00}) {
+		t.Errorf("Expected the reversed blob, got %v (error: %v)", value, err)
+	}
+	if value, err := s.GetGlobalBytes(ctx, "empty"); err != nil || len(value) != 0 {
+		t.Errorf("Expected an empty slice, got %v (error: %v)", value, err)
+	}
+
+	// struct fields
+	type file struct {
+		Data []byte `lua:"data"`
+	}
+	if err := s.SetGlobal(ctx, "file", file{Data: blob}); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	var out file
+	if err := UnmarshalGlobal(ctx, s, "file", &out); err != nil || !reflect.DeepEqual(out.Data, blob) {
+		t.Errorf("Expected %v, got %v (error: %v)", blob, out.Data, err)
+	}
+
+	if _, err := s.GetGlobalBytes(ctx, "file"); err == nil {
+		t.Error("Expected error for a non-string global, got nil")
+	}
+}
+
+// TestCoroutine tests resuming a coroutine step by step from Go.
+func TestCoroutine(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	co, err := s.NewCoroutine(ctx, `
+		local n = ...
+		for i = 1, n do
+			local ack = coroutine.yield(i, i * i)
+			assert(ack == "next")
+		end
+		return "finished"
+	`)
+	if err != nil {
+		t.Fatalf("NewCoroutine failed with error: %v", err)
+	}
+	defer co.Close()
+
+	results, done, err := co.Resume(ctx, 3)
+	for i := int64(1); i <= 3; i++ {
+		if err != nil || done || !reflect.DeepEqual(results, []any{i, i * i}) {
+			t.Fatalf("Expected [%d %d] yielded, got %v (done: %v, error: %v)", i, i*i, results, done, err)
+		}
+		results, done, err = co.Resume(ctx, "next")
+	}
+	if err != nil || !done || !reflect.DeepEqual(results, []any{"finished"}) {
+		t.Errorf("Expected [finished] returned, got %v (done: %v, error: %v)", results, done, err)
+	}
+	if _, _, err := co.Resume(ctx); err == nil {
+		t.Error("Expected error for resuming a dead coroutine, got nil")
+	}
+
+	// errors
+	failing, err := s.NewCoroutine(ctx, `coroutine.yield() error("boom")`)
+	if err != nil {
+		t.Fatalf("NewCoroutine failed with error: %v", err)
+	}
+	if _, done, err := failing.Resume(ctx); err != nil || done {
+		t.Fatalf("Expected a yield, got done: %v, error: %v", done, err)
+	}
+	if _, _, err := failing.Resume(ctx); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected a runtime error, got %v", err)
+	}
+	if _, _, err := failing.Resume(ctx); err == nil {
+		t.Error("Expected error for resuming a failed coroutine, got nil")
+	}
+	if _, err := s.NewCoroutine(ctx, `coroutine.yield(`); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+
+	// closed
+	if err := failing.Close(); err != nil {
+		t.Fatalf("Close failed with error: %v", err)
+	}
+	if err := failing.Close(); err != nil {
+		t.Errorf("Expected closing twice to be a no-op, got %v", err)
+	}
+	if _, _, err := failing.Resume(ctx); err == nil {
+		t.Error("Expected error for resuming a closed coroutine, got nil")
+	}
+
+	// the state is still usable
+	if results, err := s.Evaluate(ctx, `return 1 + 1`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestSeedRandom tests reproducible random sequences.
+func TestSeedRandom(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	const code = `return math.random(1, 1000000), math.random()`
+
+	if err := s.SeedRandom(ctx, 42); err != nil {
+		t.Fatalf("SeedRandom failed with error: %v", err)
+	}
+	first, err := s.Evaluate(ctx, code)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+
+	if err := s.SeedRandom(ctx, 42); err != nil {
+		t.Fatalf("SeedRandom failed with error: %v", err)
+	}
+	if second, err := s.Evaluate(ctx, code); err != nil || !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same sequence %v, got %v (error: %v)", first, second, err)
+	}
+
+	if err := s.SeedRandom(ctx, 43); err != nil {
+		t.Fatalf("SeedRandom failed with error: %v", err)
+	}
+	if third, err := s.Evaluate(ctx, code); err != nil || reflect.DeepEqual(first, third) {
+		t.Errorf("Expected a different sequence from %v, got %v (error: %v)", first, third, err)
+	}
+
+	// without the math library
+	s2 := NewSandboxedState()
+	defer s2.Close()
+	if err := s2.SeedRandom(ctx, 42); err == nil {
+		t.Error("Expected error for a state without the math library, got nil")
+	}
+}
+
+// TestOSExit tests that `os.exit` does not terminate the host process.
+func TestOSExit(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for _, code := range []string{`os.exit(1)`, `os.exit(true, true)`, `pcall(os.exit) os.exit()`} {
+		if err := s.Execute(ctx, code); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "os.exit is disabled") {
+			t.Errorf("Expected 'os.exit is disabled' error for `%s`, got %v", code, err)
+		}
+	}
+
+	// still disabled after a reset
+	if err := s.Reset(ctx); err != nil {
+		t.Fatalf("Reset failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `os.exit(0)`); err == nil {
+		t.Error("Expected error for os.exit after a reset, got nil")
+	}
+
+	if results, err := s.Evaluate(ctx, `return debug.getupvalue(os.exit, 1) == nil, "still running"`); err != nil || results[0] != false || results[1] != "still running" {
+		t.Errorf("Expected [false still running], got %v (error: %v)", results, err)
+	}
+
+	// os.exit is kept with AllowExit
+	s2 := NewStateWithOptions(Options{AllowExit: true})
+	defer s2.Close()
+	if results, err := s2.Evaluate(ctx, `return debug.getupvalue(os.exit, 1) == nil`); err != nil || results[0] != true {
+		t.Errorf("Expected the original os.exit, got %v (error: %v)", results, err)
+	}
+}
+
+// TestGetGlobalTable tests getting string-keyed tables.
+func TestGetGlobalTable(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []Options{{}, {OrderedTables: true}} {
+		s := NewStateWithOptions(opts)
+		defer s.Close()
+
+		if err := s.Execute(ctx, `
+			config = {name = "app", port = 8080, debug = false, tags = {"a", "b"}}
+			empty = {}
+			array = {1, 2, 3}
+			mixed = {name = "app", [1] = "one"}
+			scalar = 42
+		`); err != nil {
+			t.Fatalf("Execute failed with error: %v", err)
+		}
+
+		expected := map[string]any{"name": "app", "port": int64(8080), "debug": false, "tags": []any{"a", "b"}}
+		if table, err := s.GetGlobalTable(ctx, "config"); err != nil || !reflect.DeepEqual(table, expected) {
+			t.Errorf("Expected %v, got %v (error: %v)", expected, table, err)
+		}
+		if table, err := s.GetGlobalTable(ctx, "empty"); err != nil || table == nil || len(table) != 0 {
+			t.Errorf("Expected an empty map, got %v (error: %v)", table, err)
+		}
+		for _, name := range []string{"array", "mixed", "scalar", "undefined"} {
+			if _, err := s.GetGlobalTable(ctx, name); err == nil {
+				t.Errorf("Expected error for global '%s', got nil", name)
+			}
+		}
+	}
+}
+
+// TestRangeGlobalArray tests iterating over global arrays.
+func TestRangeGlobalArray(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `
+		numbers = {}
+		for i = 1, 100000 do numbers[i] = i * 2 end
+		records = {{name = "a"}, {name = "b"}}
+		empty = {}
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	var count int
+	var sum int64
+	if err := s.RangeGlobalArray(ctx, "numbers", func(index int, value any) bool {
+		count++
+		if index != count {
+			t.Errorf("Expected index %d, got %d", count, index)
+		}
+		sum += value.(int64)
+		return true
+	}); err != nil {
+		t.Fatalf("RangeGlobalArray failed with error: %v", err)
+	}
+	if count != 100000 || sum != 100000*100001 {
+		t.Errorf("Expected 100000 elements summing to %d, got %d summing to %d", 100000*100001, count, sum)
+	}
+
+	// early exit
+	var names []any
+	if err := s.RangeGlobalArray(ctx, "records", func(index int, value any) bool {
+		names = append(names, value.(map[any]any)["name"])
+		return false
+	}); err != nil || !reflect.DeepEqual(names, []any{"a"}) {
+		t.Errorf("Expected [a], got %v (error: %v)", names, err)
+	}
+
+	if err := s.RangeGlobalArray(ctx, "empty", func(int, any) bool {
+		t.Error("Expected no calls for an empty array")
+		return true
+	}); err != nil {
+		t.Errorf("RangeGlobalArray failed with error: %v", err)
+	}
+	if err := s.RangeGlobalArray(ctx, "undefined", func(int, any) bool { return true }); err == nil {
+		t.Error("Expected error for a non-table global, got nil")
+	}
+}
+
+// counter is a Go object exposed to Lua in TestPushUserdata.
+type counter struct {
+	count int64
+}
+
+// TestPushUserdata tests exposing Go objects as userdata.
+func TestPushUserdata(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	c := &counter{}
+	methods := map[string]func(self any, args []any) ([]any, error){
+		"add": func(self any, args []any) ([]any, error) {
+			n, ok := args[0].(int64)
+			if !ok {
+				return nil, fmt.Errorf("integer expected, got %T", args[0])
+			}
+			self.(*counter).count += n
+			return []any{self.(*counter).count}, nil
+		},
+		"get": func(self any, args []any) ([]any, error) {
+			return []any{self.(*counter).count}, nil
+		},
+	}
+	if err := s.PushUserdata(ctx, "counter", c, methods); err != nil {
+		t.Fatalf("PushUserdata failed with error: %v", err)
+	}
+	if err := s.RegisterFunction(ctx, "is_counter", func(args []any) ([]any, error) {
+		return []any{args[0] == c}, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+
+	if results, err := s.Evaluate(ctx, `counter:add(2) return counter:add(3), counter:get(), type(counter), is_counter(counter)`); err != nil || !reflect.DeepEqual(results, []any{int64(5), int64(5), "userdata", true}) {
+		t.Errorf("Expected [5 5 userdata true], got %v (error: %v)", results, err)
+	}
+	if c.count != 5 {
+		t.Errorf("Expected the Go object to be updated to 5, got %d", c.count)
+	}
+
+	// userdata values are converted to the objects
+	if value, err := s.GetGlobal(ctx, "counter"); err != nil || value != c {
+		t.Errorf("Expected the Go object, got %v (error: %v)", value, err)
+	}
+
+	// errors
+	if err := s.Execute(ctx, `counter:add("x")`); err == nil || !strings.Contains(err.Error(), "integer expected") {
+		t.Errorf("Expected an error from the method, got %v", err)
+	}
+	if err := s.Execute(ctx, `counter.get({})`); err == nil || !strings.Contains(err.Error(), "should be called on its object") {
+		t.Errorf("Expected an error for calling without the object, got %v", err)
+	}
+	if err := s.Execute(ctx, `counter:undefined()`); err == nil {
+		t.Error("Expected an error for an undefined method, got nil")
+	}
+
+	// metatables cannot be tampered with for faking objects
+	if results, err := s.Evaluate(ctx, `getmetatable(counter).__luago_object = nil return is_counter(counter)`); err != nil || results[0] != true {
+		t.Errorf("Expected true, got %v (error: %v)", results, err)
+	}
+
+	// collected, along with the functions of its methods
+	if err := s.Execute(ctx, `add = counter.add counter = nil collectgarbage()`); err != nil {
+		t.Errorf("Execute failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `add({}, 1)`); err == nil || !strings.Contains(err.Error(), "not registered anymore") {
+		t.Errorf("Expected an error for a released method, got %v", err)
+	}
+
+	// closed with live userdata
+	s2 := NewState()
+	if err := s2.PushUserdata(ctx, "obj", &counter{}, methods); err != nil {
+		t.Fatalf("PushUserdata failed with error: %v", err)
+	}
+	s2.Close()
+}
+
+// TestBatch tests running multiple operations in a single batch.
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	var got any
+	var saved *Tx
+	if err := s.Batch(ctx, func(tx *Tx) error {
+		saved = tx
+		for i := range 10 {
+			if err := tx.SetGlobal(fmt.Sprintf("v%d", i), i); err != nil {
+				return err
+			}
+		}
+		if err := tx.Execute(`sum = 0 for i = 0, 9 do sum = sum + _G["v" .. i] end`); err != nil {
+			return err
+		}
+		var err error
+		got, err = tx.GetGlobal("sum")
+		return err
+	}); err != nil {
+		t.Fatalf("Batch failed with error: %v", err)
+	}
+	if got != int64(45) {
+		t.Errorf("Expected 45, got %v", got)
+	}
+
+	// errors abort the batch
+	if err := s.Batch(ctx, func(tx *Tx) error {
+		if err := tx.Execute(`first = true error("boom")`); err != nil {
+			return err
+		}
+		return tx.SetGlobal("second", true)
+	}); !errors.Is(err, ErrRuntime) {
+		t.Errorf("Expected a runtime error, got %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return first, second`); err != nil || !reflect.DeepEqual(results, []any{true, nil}) {
+		t.Errorf("Expected [true <nil>], got %v (error: %v)", results, err)
+	}
+	sentinel := errors.New("sentinel")
+	if err := s.Batch(ctx, func(tx *Tx) error { return sentinel }); !errors.Is(err, sentinel) {
+		t.Errorf("Expected the sentinel error, got %v", err)
+	}
+
+	// the transaction is invalid after the batch
+	if err := saved.Execute(`x = 1`); err == nil {
+		t.Error("Expected error for a finished batch, got nil")
+	}
+}
+
+// TestFloatRoundTrip tests that floats are passed to Lua and back without losing any bits.
+func TestFloatRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for _, f := range []float64{
+		0.1, 0.1 + 0.2, 1.0 / 3, math.Pi, -math.E,
+		math.MaxFloat64, math.SmallestNonzeroFloat64, 2.2250738585072014e-308,
+		math.Copysign(0, -1), 1 << 53, 1<<53 + 2, 1e100, math.Inf(1), math.Inf(-1),
+		math.Nextafter(1, 2),
+	} {
+		if err := s.SetGlobal(ctx, "f", f); err != nil {
+			t.Fatalf("SetGlobal failed with error: %v", err)
+		}
+		results, err := s.Evaluate(ctx, `return f, f * 1.0`)
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v", err)
+		}
+		for _, result := range results {
+			if got, ok := result.(float64); !ok || math.Float64bits(got) != math.Float64bits(f) {
+				t.Errorf("Expected %v (%#x), got %v", f, math.Float64bits(f), result)
+			}
+		}
+	}
+
+	// NaN stays NaN
+	if err := s.SetGlobal(ctx, "f", math.NaN()); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return f, f ~= f`); err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	} else if got, ok := results[0].(float64); !ok || !math.IsNaN(got) || results[1] != true {
+		t.Errorf("Expected NaN, got %v", results)
+	}
+}
+
+// TestFloatKeys tests that float keys with integral values are taken as integer keys
+// (as Lua normalizes them), and other float keys are kept as float64.
+func TestFloatKeys(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []Options{{}, {NumbersAsFloat64: true}, {Holes: HolesAsNil}} {
+		s := NewStateWithOptions(opts)
+
+		results, err := s.Evaluate(ctx, `local arr = {}
+arr[1.0] = "a"
+arr[2] = "b"
+arr[3.0] = "c"
+
+local holes = {}
+holes[1.0] = "a"
+holes[3.0] = "c"
+
+return arr, {[1.0] = "a", [2.5] = "b", [2^53] = "c"}, holes`)
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v", err)
+		}
+
+		if expected := []any{"a", "b", "c"}; !reflect.DeepEqual(results[0], expected) {
+			t.Errorf("Expected %v with %+v, got %#v", expected, opts, results[0])
+		}
+		if expected := map[any]any{int64(1): "a", 2.5: "b", int64(1 << 53): "c"}; !reflect.DeepEqual(results[1], expected) {
+			t.Errorf("Expected %v with %+v, got %#v", expected, opts, results[1])
+		}
+		var expected any = map[any]any{int64(1): "a", int64(3): "c"}
+		if opts.Holes == HolesAsNil {
+			expected = []any{"a", nil, "c"}
+		}
+		if !reflect.DeepEqual(results[2], expected) {
+			t.Errorf("Expected %v with %+v, got %#v", expected, opts, results[2])
+		}
+
+		s.Close()
+	}
+}
+
+// TestNonRepresentableKeys tests converting tables with keys which cannot be Go map keys.
+func TestNonRepresentableKeys(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []Options{{}, {OrderedTables: true}, {FunctionRefs: true}} {
+		s := NewStateWithOptions(opts)
+		defer s.Close()
+
+		results, err := s.Evaluate(ctx, `
+			local k1, k2 = {}, {1, 2}
+			return {[k1] = "empty", [k2] = "array", [print] = "function", name = "value"}
+		`)
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v (options: %+v)", err, opts)
+		}
+
+		var keys []string
+		switch table := results[0].(type) {
+		case map[any]any:
+			for k := range table {
+				keys = append(keys, fmt.Sprint(k))
+			}
+		case *OrderedTable:
+			for _, k := range table.Keys() {
+				keys = append(keys, fmt.Sprint(k))
+			}
+		default:
+			t.Fatalf("Expected a table, got %T (options: %+v)", results[0], opts)
+		}
+
+		slices.Sort(keys)
+		if len(keys) != 4 || keys[3] != "name" ||
+			!strings.HasPrefix(keys[0], "<function: ") ||
+			!strings.HasPrefix(keys[1], "<table: ") || !strings.HasPrefix(keys[2], "<table: ") || keys[1] == keys[2] {
+			t.Errorf("Expected distinct representations of keys, got %v (options: %+v)", keys, opts)
+		}
+	}
+}
+
+// TestStructMarshaling tests converting Go structs to Lua tables and back.
+func TestStructMarshaling(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	type Server struct {
+		Host string `lua:"host"`
+		Port int    `lua:"port"`
+	}
+	type Config struct {
+		Name     string         `lua:"name"`
+		Debug    bool           `lua:"debug,omitempty"`
+		Tags     []string       `lua:"tags"`
+		Servers  []Server       `lua:"servers"`
+		Primary  *Server        `lua:"primary"`
+		Limits   map[string]int `lua:"limits,omitempty"`
+		Ignored  string         `lua:"-"`
+		Untagged float64
+		secret   string
+	}
+
+	config := Config{
+		Name:     "app",
+		Tags:     []string{"a", "b"},
+		Servers:  []Server{{Host: "localhost", Port: 8080}},
+		Primary:  &Server{Host: "primary", Port: 80},
+		Ignored:  "ignored",
+		Untagged: 1.5,
+		secret:   "secret",
+	}
+	if err := s.SetGlobal(ctx, "config", config); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+
+	results, err := s.Evaluate(ctx, `
+		return config.name, config.debug, config.tags[2], config.servers[1].port,
+			config.primary.host, config.Ignored, config.Untagged, config.secret
+	`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if expected := []any{"app", nil, "b", int64(8080), "primary", nil, 1.5, nil}; !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+
+	// and back
+	if err := s.Execute(ctx, `
+		config.debug = true
+		config.servers[2] = {host = "remote", port = 9090}
+		config.limits = {cpu = 2}
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	var out Config
+	if err := UnmarshalGlobal(ctx, s, "config", &out); err != nil {
+		t.Fatalf("UnmarshalGlobal failed with error: %v", err)
+	}
+	expected := Config{
+		Name:     "app",
+		Debug:    true,
+		Tags:     []string{"a", "b"},
+		Servers:  []Server{{Host: "localhost", Port: 8080}, {Host: "remote", Port: 9090}},
+		Primary:  &Server{Host: "primary", Port: 80},
+		Limits:   map[string]int{"cpu": 2},
+		Untagged: 1.5,
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, out)
+	}
+
+	// type mismatches
+	if err := s.Execute(ctx, `config.servers[1].port = "not a number"`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if err := UnmarshalGlobal(ctx, s, "config", &out); err == nil || !strings.Contains(err.Error(), "field servers: index 0: field port") {
+		t.Errorf("Expected an error for a type mismatch, got %v", err)
+	}
+	if err := UnmarshalGlobal(ctx, s, "config", out); err == nil {
+		t.Error("Expected error for a non-pointer destination, got nil")
+	}
+}
+
+// TestGC tests controlling the garbage collector.
+func TestGC(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	before, err := s.MemoryKB(ctx)
+	if err != nil || before <= 0 {
+		t.Fatalf("MemoryKB = %d (error: %v)", before, err)
+	}
+
+	// accumulate garbage with the collector stopped
+	if err := s.GC(ctx, GCStop); err != nil {
+		t.Fatalf("GC failed with error: %v", err)
+	}
+	if stats, _ := s.GCStats(ctx); stats.Running {
+		t.Error("Expected the garbage collector to be stopped")
+	}
+	if err := s.Execute(ctx, `for i = 1, 100000 do local t = {i} end`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	grown, _ := s.MemoryKB(ctx)
+	if grown <= before+1024 {
+		t.Errorf("Expected memory to grow by more than 1MB, got %dKB -> %dKB", before, grown)
+	}
+
+	// collect it
+	if err := s.GC(ctx, GCRestart); err != nil {
+		t.Fatalf("GC failed with error: %v", err)
+	}
+	if err := s.GC(ctx, GCStep); err != nil {
+		t.Fatalf("GC failed with error: %v", err)
+	}
+	if err := s.GC(ctx, GCCollect); err != nil {
+		t.Fatalf("GC failed with error: %v", err)
+	}
+	if collected, _ := s.MemoryKB(ctx); collected >= grown {
+		t.Errorf("Expected memory to shrink after collection, got %dKB -> %dKB", grown, collected)
+	}
+
+	if err := s.GC(ctx, GCMode(100)); err == nil {
+		t.Error("Expected error for an unknown GC mode, got nil")
+	}
+}
+
+// TestMaxTableDepth tests limiting the depth of nested tables in conversions.
+func TestMaxTableDepth(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	// a pathologically nested table
+	if err := s.Execute(ctx, `
+		deep = {}
+		local t = deep
+		for i = 1, 50000 do t.next = {} t = t.next end
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if _, err := s.Evaluate(ctx, `return deep`); err == nil || !strings.Contains(err.Error(), "max table depth (1000) exceeded") {
+		t.Errorf("Expected a max table depth error from Evaluate, got %v", err)
+	}
+	if _, err := s.GetGlobal(ctx, "deep"); err == nil || !strings.Contains(err.Error(), "max table depth") {
+		t.Errorf("Expected a max table depth error from GetGlobal, got %v", err)
+	}
+	if err := s.RegisterFunction(ctx, "consume", func(args []any) ([]any, error) {
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `consume(deep)`); err == nil || !strings.Contains(err.Error(), "argument 1: max table depth") {
+		t.Errorf("Expected a max table depth error for an argument, got %v", err)
+	}
+
+	// the state should still be usable
+	if results, err := s.Evaluate(ctx, `return {{{1}}}`); err != nil || !reflect.DeepEqual(results[0], []any{[]any{[]any{int64(1)}}}) {
+		t.Errorf("Expected [[[1]]], got %v (error: %v)", results, err)
+	}
+
+	// with a custom limit
+	s2 := NewStateWithOptions(Options{MaxTableDepth: 3})
+	defer s2.Close()
+	if _, err := s2.Evaluate(ctx, `return {{{1}}}`); err != nil {
+		t.Errorf("Expected 3 levels to be converted, got error: %v", err)
+	}
+	if _, err := s2.Evaluate(ctx, `return {{{{1}}}}`); err == nil {
+		t.Error("Expected error for 4 levels, got nil")
+	}
+	if err := s2.SetGlobal(ctx, "nested", []any{[]any{[]any{[]any{1}}}}); err == nil {
+		t.Error("Expected error for setting 4 levels, got nil")
+	}
+}
+
+// TestStackGrowth tests pushing and converting many values, which needs the Lua stack to grow.
+func TestStackGrowth(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewStateWithOptions(Options{MaxTableDepth: -1})
+	defer s.Close()
+
+	// many arguments
+	args := make([]any, 100_000)
+	for i := range args {
+		args[i] = i
+	}
+	if results, err := s.EvaluateWithArgs(ctx, `return select("#", ...), select(-1, ...)`, args...); err != nil || !reflect.DeepEqual(results, []any{int64(100_000), int64(99_999)}) {
+		t.Errorf("Expected [100000 99999], got %v (error: %v)", results, err)
+	}
+
+	// too many arguments fail cleanly
+	if _, err := s.EvaluateWithArgs(ctx, `return ...`, make([]any, 2_000_000)...); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("Expected a stack overflow error, got %v", err)
+	}
+
+	// too many results of a Go function fail cleanly
+	if err := s.RegisterFunction(ctx, "many", func(args []any) ([]any, error) {
+		return make([]any, 2_000_000), nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `many()`); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("Expected a stack overflow error, got %v", err)
+	}
+
+	// wide and deep tables
+	wide := make(map[any]any, 100_000)
+	for i := range 100_000 {
+		wide[fmt.Sprintf("key%d", i)] = int64(i)
+	}
+	var deep any = "bottom"
+	for range 10_000 {
+		deep = []any{deep}
+	}
+	if err := s.SetGlobal(ctx, "wide", wide); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if err := s.SetGlobal(ctx, "deep", deep); err != nil {
+		t.Fatalf("SetGlobal failed with error: %v", err)
+	}
+	if value, err := s.GetGlobal(ctx, "wide"); err != nil || !reflect.DeepEqual(value, wide) {
+		t.Errorf("Expected the wide table back (error: %v)", err)
+	}
+	if value, err := s.GetGlobal(ctx, "deep"); err != nil || !reflect.DeepEqual(value, deep) {
+		t.Errorf("Expected the deep table back (error: %v)", err)
+	}
+
+	// the stack is balanced after all
+	if results, err := s.Evaluate(ctx, `return 1`); err != nil || !reflect.DeepEqual(results, []any{int64(1)}) {
+		t.Errorf("Expected [1], got %v (error: %v)", results, err)
+	}
+}
+
+// TestCallPath tests calling functions by their dotted paths.
+func TestCallPath(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.Execute(ctx, `
+		a = {b = {c = function(x) return x * 2 end}}
+
+		Counter = {}
+		Counter.__index = Counter
+		function Counter.new() return setmetatable({count = 0}, Counter) end
+		function Counter:add(n) self.count = self.count + n return self.count end
+		obj = Counter.new()
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	if results, err := s.CallPath(ctx, "a.b.c", 21); err != nil || results[0] != int64(42) {
+		t.Errorf("Expected 42, got %v (error: %v)", results, err)
+	}
+	if results, err := s.CallPath(ctx, "string.upper", "lua"); err != nil || results[0] != "LUA" {
+		t.Errorf("Expected LUA, got %v (error: %v)", results, err)
+	}
+	if results, err := s.CallPath(ctx, "print"); err != nil || len(results) != 0 {
+		t.Errorf("Expected no results, got %v (error: %v)", results, err)
+	}
+
+	// method calls (through __index)
+	for _, expected := range []int64{3, 6} {
+		if results, err := s.CallPath(ctx, "obj:add", 3); err != nil || results[0] != expected {
+			t.Errorf("Expected %d, got %v (error: %v)", expected, results, err)
+		}
+	}
+
+	// errors
+	for path, msg := range map[string]string{
+		"a.x.c":     "'a.x' is not indexable (a nil value)",
+		"a.b":       "'a.b' is not a function (a table value)",
+		"a..c":      "empty field name",
+		"a:b.c":     "':' should be the last separator",
+		"obj:count": "'obj:count' is not a function (a number value)",
+	} {
+		if _, err := s.CallPath(ctx, path); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("CallPath(%q): expected error containing %q, got %v", path, msg, err)
+		}
+	}
+}
+
+// TestWithRawState tests running a function with the raw Lua state.
+func TestWithRawState(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	var pointers []unsafe.Pointer
+	for range 2 {
+		if err := s.WithRawState(ctx, func(L unsafe.Pointer) error {
+			pointers = append(pointers, L)
+			return nil
+		}); err != nil {
+			t.Fatalf("WithRawState failed with error: %v", err)
+		}
+	}
+	if pointers[0] == nil || pointers[0] != pointers[1] {
+		t.Errorf("Expected the same non-nil lua_State, got %v", pointers)
+	}
+
+	expected := errors.New("failed")
+	if err := s.WithRawState(ctx, func(L unsafe.Pointer) error { return expected }); !errors.Is(err, expected) {
+		t.Errorf("Expected the error from fn, got %v", err)
+	}
+
+	s.Close()
+	if err := s.WithRawState(ctx, func(L unsafe.Pointer) error { return nil }); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed, got %v", err)
+	}
+}
+
+// TestStop tests interrupting the running operation.
+func TestStop(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// stopping an idle state has no effect on later operations
+	s.Stop()
+	if results, err := s.Evaluate(ctx, `return 1`); err != nil || results[0] != int64(1) {
+		t.Errorf("Expected 1, got %v (error: %v)", results, err)
+	}
+
+	// stop an infinite loop from another goroutine
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+	}()
+	start := time.Now()
+	if err := s.Execute(ctx, `while true do end`); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the loop to be stopped promptly, took %v", elapsed)
+	}
+
+	// the state should still be usable
+	if results, err := s.Evaluate(ctx, `return 2`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+
+	// stopping cannot be caught by `pcall`
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Stop()
+	}()
+	start = time.Now()
+	if err := s.Execute(ctx, `while true do pcall(function() while true do end end) end`); !errors.Is(err, ErrStopped) {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the loop to be stopped promptly, took %v", elapsed)
+	}
+	if results, err := s.Evaluate(ctx, `return 3`); err != nil || results[0] != int64(3) {
+		t.Errorf("Expected 3, got %v (error: %v)", results, err)
+	}
+}
+
+// TestIntegerPrecision tests that integers beyond 2^53 survive conversions exactly.
+func TestIntegerPrecision(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	const big = int64(1)<<53 + 1 // not representable as float64
+
+	// returned from Lua, in tables mixed with floats
+	if results, err := s.Evaluate(ctx, `
+		local big = math.tointeger(2^53) + 1
+		return big, {big, 1.5, math.maxinteger}, {[big] = "key"}, math.mininteger
+	`); err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	} else if !reflect.DeepEqual(results, []any{
+		big,
+		[]any{big, 1.5, int64(math.MaxInt64)},
+		map[any]any{big: "key"},
+		int64(math.MinInt64),
+	}) {
+		t.Errorf("Expected exact integers, got %v", results)
+	}
+
+	// through arguments and results of registered functions
+	var received any
+	if err := s.RegisterFunction(ctx, "echo", func(args []any) ([]any, error) {
+		received = args[0]
+		return args, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `local v = echo(math.tointeger(2^53) + 1) return v, math.type(v), v == math.tointeger(2^53) + 1`); err != nil || !reflect.DeepEqual(results, []any{big, "integer", true}) {
+		t.Errorf("Expected [%d integer true], got %v (error: %v)", big, results, err)
+	}
+	if received != big {
+		t.Errorf("Expected the argument %d, got %v (%T)", big, received, received)
+	}
+
+	// through globals
+	for _, v := range []any{big, int64(math.MaxInt64), int64(math.MinInt64), []any{big}} {
+		if err := s.SetGlobal(ctx, "v", v); err != nil {
+			t.Fatalf("SetGlobal failed with error: %v", err)
+		}
+		if value, err := s.GetGlobal(ctx, "v"); err != nil || !reflect.DeepEqual(value, v) {
+			t.Errorf("Expected %v, got %v (error: %v)", v, value, err)
+		}
+	}
+	if results, err := s.EvaluateWithArgs(ctx, `local v = ... return v + 1, math.type(v)`, big); err != nil || !reflect.DeepEqual(results, []any{big + 1, "integer"}) {
+		t.Errorf("Expected [%d integer], got %v (error: %v)", big+1, results, err)
+	}
+}
+
+// TestNumbersAsFloat64 tests converting all numbers to float64.
+func TestNumbersAsFloat64(t *testing.T) {
+	s := NewStateWithOptions(Options{NumbersAsFloat64: true})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	results, err := s.Evaluate(ctx, `return 5, 5.0, 2.5, {1, 2.0}, {a = 3, [10] = 4}`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	expected := []any{5.0, 5.0, 2.5, []any{1.0, 2.0}, map[any]any{"a": 3.0, int64(10): 4.0}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, results)
+	}
+
+	// large integers lose precision
+	if results, err := s.Evaluate(ctx, `return math.maxinteger`); err != nil || results[0] != float64(math.MaxInt64) {
+		t.Errorf("Expected %v, got %v (error: %v)", float64(math.MaxInt64), results, err)
+	}
+
+	// by default, integers are converted to int64
+	plain := NewState()
+	defer plain.Close()
+	if results, err := plain.Evaluate(ctx, `return 5, 5.0`); err != nil || !reflect.DeepEqual(results, []any{int64(5), 5.0}) {
+		t.Errorf("Expected [5 5.0], got %#v (error: %v)", results, err)
+	}
+}
+
+// TestMetamethods tests converting tables with metatables.
+func TestMetamethods(t *testing.T) {
+	ctx := context.Background()
+
+	const code = `
+		local Base = {kind = "base", version = 1}
+		Base.__index = Base
+		local Point = setmetatable({kind = "point"}, Base)
+		Point.__index = Point
+
+		local p = setmetatable({x = 1, y = 2}, Point)
+		local proxy = setmetatable({}, {
+			__len = function() return 3 end,
+			__index = function(_, i) return i * 10 end,
+		})
+		return p, proxy
+	`
+
+	// raw fields by default
+	s := NewState()
+	defer s.Close()
+	results, err := s.Evaluate(ctx, code)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if expected := map[any]any{"x": int64(1), "y": int64(2)}; !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("Expected %v, got %v", expected, results[0])
+	}
+	if expected := []any{}; !reflect.DeepEqual(results[1], expected) {
+		t.Errorf("Expected %v, got %v", expected, results[1])
+	}
+
+	// resolved with the option
+	s2 := NewStateWithOptions(Options{Metamethods: true})
+	defer s2.Close()
+	results, err = s2.Evaluate(ctx, code)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if expected := map[any]any{"x": int64(1), "y": int64(2), "kind": "point", "version": int64(1)}; !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("Expected %v, got %v", expected, results[0])
+	}
+	if expected := []any{int64(10), int64(20), int64(30)}; !reflect.DeepEqual(results[1], expected) {
+		t.Errorf("Expected %v, got %v", expected, results[1])
+	}
+
+	// cycles through metatables
+	if results, err := s2.Evaluate(ctx, `
+		local class = {}
+		class.__index = class
+		local obj = setmetatable({}, class)
+		obj.self = obj
+		return obj
+	`); err != nil || results[0].(map[any]any)["self"] != "<cycle>" {
+		t.Errorf("Expected a cycle, got %v (error: %v)", results, err)
+	}
+
+	// errors in metamethods
+	if _, err := s2.Evaluate(ctx, `return setmetatable({}, {__len = function() error("bad length") end})`); !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "bad length") {
+		t.Errorf("Expected a runtime error, got %v", err)
+	}
+
+	// error objects with metatables keep their tracebacks
+	_, err = s2.Evaluate(ctx, `
+		local Error = {kind = "app"}
+		Error.__index = Error
+		local function fail() error(setmetatable({code = 42}, Error)) end
+		fail()
+	`)
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("Expected a runtime error, got %v", err)
+	}
+	if !strings.Contains(luaErr.Traceback, "stack traceback:") || !strings.Contains(luaErr.Traceback, "fail") {
+		t.Errorf("Expected a traceback, got %q", luaErr.Traceback)
+	}
+	if expected := map[any]any{"code": int64(42), "kind": "app"}; !reflect.DeepEqual(luaErr.Value, expected) {
+		t.Errorf("Expected the resolved error value %v, got %v", expected, luaErr.Value)
+	}
+}
+
+// TestEmptyTableAsMap tests converting empty tables to maps.
+func TestEmptyTableAsMap(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		opts     Options
+		expected any
+	}{
+		{Options{}, []any{}},
+		{Options{EmptyTableAsMap: true}, map[any]any{}},
+	} {
+		s := NewStateWithOptions(tc.opts)
+		defer s.Close()
+
+		results, err := s.Evaluate(ctx, `return {}, {nested = {}}, {1, 2}`)
+		if err != nil {
+			t.Fatalf("Evaluate failed with error: %v", err)
+		}
+		if !reflect.DeepEqual(results[0], tc.expected) {
+			t.Errorf("Expected %#v, got %#v (options: %+v)", tc.expected, results[0], tc.opts)
+		}
+		if nested := results[1].(map[any]any)["nested"]; !reflect.DeepEqual(nested, tc.expected) {
+			t.Errorf("Expected nested %#v, got %#v (options: %+v)", tc.expected, nested, tc.opts)
+		}
+		if !reflect.DeepEqual(results[2], []any{int64(1), int64(2)}) {
+			t.Errorf("Expected [1 2], got %v (options: %+v)", results[2], tc.opts)
+		}
+	}
+
+	// with ordered tables
+	s := NewStateWithOptions(Options{EmptyTableAsMap: true, OrderedTables: true})
+	defer s.Close()
+	if results, err := s.Evaluate(ctx, `return {}`); err != nil {
+		t.Errorf("Evaluate failed with error: %v", err)
+	} else if table, ok := results[0].(*OrderedTable); !ok || table.Len() != 0 {
+		t.Errorf("Expected an empty *OrderedTable, got %#v", results[0])
+	}
+}
+
+// TestFalseyArrays tests array detection for tables with false values.
+func TestFalseyArrays(t *testing.T) {
+	ctx := context.Background()
+
+	for _, opts := range []Options{{}, {Holes: HolesAsNil}, {OrderedTables: true}} {
+		s := NewStateWithOptions(opts)
+
+		for code, expected := range map[string]any{
+			`return {true, false, true}`:   []any{true, false, true},
+			`return {false, false, false}`: []any{false, false, false},
+			`return {[1] = false}`:         []any{false},
+			`return {false, 0, ""}`:        []any{false, int64(0), ""},
+			`return {{false}, {false, true}}`: []any{
+				[]any{false},
+				[]any{false, true},
+			},
+		} {
+			results, err := s.Evaluate(ctx, code)
+			if err != nil {
+				t.Fatalf("Evaluate(`%s`) failed with error: %v", code, err)
+			}
+			if !reflect.DeepEqual(results[0], expected) {
+				t.Errorf("Evaluate(`%s`) with %+v = %#v, want %#v", code, opts, results[0], expected)
+			}
+		}
+
+		// false values also round-trip through SetGlobal
+		if err := s.SetGlobal(ctx, "flags", []any{true, false, true}); err != nil {
+			t.Fatalf("SetGlobal failed with error: %v", err)
+		}
+		if results, err := s.Evaluate(ctx, `return #flags, flags`); err != nil || !reflect.DeepEqual(results, []any{int64(3), []any{true, false, true}}) {
+			t.Errorf("Expected [3 [true false true]], got %#v (error: %v)", results, err)
+		}
+
+		s.Close()
+	}
+}
+
+// TestContextWhileBusy tests that operations honor their contexts while the worker is busy.
+func TestContextWhileBusy(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	longCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Execute(longCtx, `while true do end`)
+	}()
+	time.Sleep(50 * time.Millisecond) // let the loop start
+
+	for name, op := range map[string]func(ctx context.Context) error{
+		"Execute": func(ctx context.Context) error { return s.Execute(ctx, `x = 1`) },
+		"Evaluate": func(ctx context.Context) error {
+			_, err := s.Evaluate(ctx, `return 1`)
+			return err
+		},
+		"GetGlobal": func(ctx context.Context) error {
+			_, err := s.GetGlobal(ctx, "x")
+			return err
+		},
+	} {
+		ctx, cancelOp := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := op(ctx)
+		cancelOp()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded from %s, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected %s to return promptly, took %v", name, elapsed)
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from the long-running Execute, got %v", err)
+	}
+
+	// the state is still usable
+	if results, err := s.Evaluate(context.Background(), `return x`); err != nil || !reflect.DeepEqual(results, []any{nil}) {
+		t.Errorf("Expected [<nil>], got %v (error: %v)", results, err)
+	}
+}
+
+// TestCancelStress tests rapidly cancelled contexts, which should never run cancelled operations
+// nor leak goroutines.
+func TestCancelStress(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	var executed atomic.Int64
+	if err := s.RegisterFunction(context.Background(), "mark", func(args []any) ([]any, error) {
+		executed.Add(1)
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+
+	baseline := runtime.NumGoroutine()
+
+	// operations with contexts cancelled beforehand are never run
+	for range 100 {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Execute(ctx, `mark()`); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+	}
+	if n := executed.Load(); n != 0 {
+		t.Fatalf("Expected no executions with cancelled contexts, got %d", n)
+	}
+
+	// contexts cancelled at random moments, from concurrent goroutines
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					time.Sleep(time.Duration((i*100+j)%50) * time.Microsecond)
+					cancel()
+				}()
+				err := s.Execute(ctx, `mark() for _ = 1, 10000 do end`)
+				if err != nil && !errors.Is(err, context.Canceled) {
+					t.Errorf("Expected nil or context.Canceled, got %v", err)
+				}
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the state is still usable, and goroutines are not leaked
+	if results, err := s.Evaluate(context.Background(), `return 1`); err != nil || !reflect.DeepEqual(results, []any{int64(1)}) {
+		t.Errorf("Expected [1], got %v (error: %v)", results, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("Expected at most %d goroutines, got %d", baseline, n)
+	}
+}
+
+// TestSetLineHook tests tracing executed lines.
+func TestSetLineHook(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	var sources []string
+	var lines []int
+	if err := s.SetLineHook(ctx, func(source string, line int) {
+		sources = append(sources, source)
+		lines = append(lines, line)
+	}); err != nil {
+		t.Fatalf("SetLineHook failed with error: %v", err)
+	}
+
+	if err := s.ExecuteNamed(ctx, "=script", `local sum = 0
+for i = 1, 2 do
+  sum = sum + i
+end
+result = sum`); err != nil {
+		t.Fatalf("ExecuteNamed failed with error: %v", err)
+	}
+	if expected := []int{1, 2, 3, 2, 3, 2, 5}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected lines %v, got %v", expected, lines)
+	}
+	if sources[0] != "script" {
+		t.Errorf("Expected the source 'script', got %q", sources[0])
+	}
+
+	// removed
+	if err := s.SetLineHook(ctx, nil); err != nil {
+		t.Fatalf("SetLineHook failed with error: %v", err)
+	}
+	lines = nil
+	if err := s.Execute(ctx, `x = 1`); err != nil || lines != nil {
+		t.Errorf("Expected no lines after removing the hook, got %v (error: %v)", lines, err)
+	}
+
+	// coexists with interruptions
+	if err := s.SetLineHook(ctx, func(string, int) {}); err != nil {
+		t.Fatalf("SetLineHook failed with error: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := s.Execute(timeout, `while true do end`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// panics are raised as Lua errors
+	if err := s.SetLineHook(ctx, func(string, int) { panic("hook failure") }); err != nil {
+		t.Fatalf("SetLineHook failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `x = 2`); err == nil || !strings.Contains(err.Error(), "hook failure") {
+		t.Errorf("Expected an error from the panicking hook, got %v", err)
+	}
+}
+
+// TestSetGlobalFunc tests registering ordinary Go functions.
+func TestSetGlobalFunc(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	for name, fn := range map[string]any{
+		"add":   func(a, b int) int { return a + b },
+		"upper": func(s string) (string, error) { return strings.ToUpper(s), nil },
+		"fail":  func() error { return errors.New("failed") },
+		"sum": func(prefix string, nums ...float64) string {
+			var sum float64
+			for _, n := range nums {
+				sum += n
+			}
+			return fmt.Sprintf("%s%g", prefix, sum)
+		},
+		"names": func(people []struct{ Name string }) []string {
+			var names []string
+			for _, p := range people {
+				names = append(names, p.Name)
+			}
+			return names
+		},
+		"deadline": func(ctx context.Context) bool {
+			_, ok := ctx.Deadline()
+			return ok
+		},
+		"nothing": func(v any) {},
+	} {
+		if err := s.SetGlobalFunc(ctx, name, fn); err != nil {
+			t.Fatalf("SetGlobalFunc(%s) failed with error: %v", name, err)
+		}
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	results, err := s.Evaluate(timeout, `return add(1, 2), upper("lua"), sum("total: "), sum("total: ", 1, 2.5), names({{Name = "a"}, {Name = "b"}}), deadline(), nothing(nil)`)
+	if err != nil {
+		t.Fatalf("Evaluate failed with error: %v", err)
+	}
+	if expected := []any{int64(3), "LUA", "total: 0", "total: 3.5", []any{"a", "b"}, true}; !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+
+	// mismatches raise Lua errors
+	for code, expected := range map[string]string{
+		`add(1)`:          "bad call to 'add': wrong number of arguments (expected 2, got 1)",
+		`add(1, 2, 3)`:    "wrong number of arguments (expected 2, got 3)",
+		`add(1, "x")`:     "bad argument #2 to 'add'",
+		`add(1, 1.5)`:     "bad argument #2 to 'add'",
+		`add(nil, 1)`:     "bad argument #1 to 'add': int expected, got nil",
+		`sum()`:           "expected at least 1, got 0",
+		`sum("a", 1, {})`: "bad argument #3 to 'sum'",
+		`fail()`:          "failed",
+	} {
+		if err := s.Execute(ctx, code); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing %q for `%s`, got %v", expected, code, err)
+		}
+	}
+
+	// not a function
+	if err := s.SetGlobalFunc(ctx, "bad", 42); err == nil {
+		t.Error("Expected an error for registering a non-function, got nil")
+	}
+}
+
+// TestTraceback tests getting tracebacks from within Go functions.
+func TestTraceback(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	var tb string
+	if err := s.RegisterFunctionContext(ctx, "log", func(ctx context.Context, args []any) ([]any, error) {
+		var err error
+		tb, err = s.Traceback(ctx)
+		return nil, err
+	}); err != nil {
+		t.Fatalf("RegisterFunctionContext failed with error: %v", err)
+	}
+
+	if err := s.ExecuteNamed(ctx, "=script", `local function inner()
+  log()
+end
+function outer()
+  inner()
+end
+outer()`); err != nil {
+		t.Fatalf("ExecuteNamed failed with error: %v", err)
+	}
+	for _, expected := range []string{"stack traceback:", "script:2: in", "script:5: in function 'outer'", "script:7: in main chunk"} {
+		if !strings.Contains(tb, expected) {
+			t.Errorf("Expected the traceback to contain %q, got: %s", expected, tb)
+		}
+	}
+
+	// between operations
+	if tb, err := s.Traceback(ctx); err != nil || strings.Contains(tb, "script:") {
+		t.Errorf("Expected an empty traceback, got %q (error: %v)", tb, err)
+	}
+}
+
+// TestSetDefaultTimeout tests the default timeout of operations.
+func TestSetDefaultTimeout(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	s.SetDefaultTimeout(100 * time.Millisecond)
+
+	// an infinite loop with a background context should still terminate
+	start := time.Now()
+	if err := s.Execute(context.Background(), `while true do end`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the loop to time out promptly, took %v", elapsed)
+	}
+
+	// deadlines of contexts take precedence
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := s.Execute(ctx, `local t = os.clock() while os.clock() - t < 0.2 do end`); err != nil {
+		t.Errorf("Expected the deadline of the context to be used, got %v", err)
+	}
+
+	// no timeout
+	s.SetDefaultTimeout(0)
+	if err := s.Execute(context.Background(), `local t = os.clock() while os.clock() - t < 0.2 do end`); err != nil {
+		t.Errorf("Expected no timeout, got %v", err)
+	}
+}
+
+// TestPanickingFunction tests recovering from panics in registered Go functions.
+func TestPanickingFunction(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.RegisterFunction(ctx, "buggy", func(args []any) ([]any, error) {
+		var m map[string]int
+		m["boom"] = 1 // panics
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+
+	_, err := s.Evaluate(ctx, `return buggy()`)
+	if !errors.Is(err, ErrRuntime) || !strings.Contains(err.Error(), "panic in Go function: assignment to entry in nil map") {
+		t.Errorf("Expected a runtime error from the panic, got %v", err)
+	}
+
+	// the panic is catchable in Lua
+	if results, err := s.Evaluate(ctx, `local ok, err = pcall(buggy) return ok`); err != nil || results[0] != false {
+		t.Errorf("Expected pcall to catch the panic, got %v (error: %v)", results, err)
+	}
+
+	// the state should still be usable
+	if results, err := s.Evaluate(ctx, `return 1 + 1`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestChunkCache tests reusing functions compiled from the same code.
+func TestChunkCache(t *testing.T) {
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, -1} {
+		s := NewStateWithOptions(Options{ChunkCacheSize: size})
+
+		for i := 1; i <= 3; i++ {
+			// cached chunks are run afresh, with their arguments
+			if err := s.Execute(ctx, `count = (count or 0) + 1`); err != nil {
+				t.Fatalf("Execute failed with error: %v", err)
+			}
+			results, err := s.EvaluateWithArgs(ctx, `local n = ... return count * n`, i)
+			if err != nil {
+				t.Fatalf("EvaluateWithArgs failed with error: %v", err)
+			}
+			if len(results) != 1 || results[0] != int64(i*i) {
+				t.Errorf("Expected [%d] with the cache size %d, got %v", i*i, size, results)
+			}
+
+			// evicts the other one with the size 1
+			if _, err := s.Evaluate(ctx, `return 1`); err != nil {
+				t.Fatalf("Evaluate failed with error: %v", err)
+			}
+		}
+
+		// chunk names are a part of the keys
+		if err := s.ExecuteNamed(ctx, "=other", `error("failed")`); err == nil || !strings.Contains(err.Error(), "other:1:") {
+			t.Errorf("Expected an error from 'other', got %v", err)
+		}
+		if err := s.ExecuteNamed(ctx, "=another", `error("failed")`); err == nil || !strings.Contains(err.Error(), "another:1:") {
+			t.Errorf("Expected an error from 'another', got %v", err)
+		}
+
+		// syntax errors are not cached
+		for range 2 {
+			if err := s.Execute(ctx, `x = `); err == nil {
+				t.Errorf("Expected a syntax error")
+			}
+		}
+
+		// the cache is cleared on Reset
+		if err := s.Reset(ctx); err != nil {
+			t.Fatalf("Reset failed with error: %v", err)
+		}
+		if err := s.Execute(ctx, `count = (count or 0) + 1`); err != nil {
+			t.Fatalf("Execute failed with error: %v", err)
+		}
+		if count, err := s.GetGlobal(ctx, "count"); err != nil || count != int64(1) {
+			t.Errorf("Expected the count 1 after Reset, got %v (error: %v)", count, err)
+		}
+
+		s.Close()
+	}
+}
+
+// TestCloseTimeout tests closing states with a grace period.
+func TestCloseTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	// idle
+	s := NewState()
+	if err := s.CloseTimeout(time.Second); err != nil {
+		t.Errorf("CloseTimeout failed with error: %v", err)
+	}
+	if err := s.CloseTimeout(time.Second); err != nil {
+		t.Errorf("CloseTimeout failed with error: %v", err)
+	}
+
+	// running Lua code is interrupted
+	sched := NewScheduler(1)
+	defer sched.Close()
+	for _, s := range []*State{NewState(), NewStateOnScheduler(sched)} {
+		result := make(chan error, 1)
+		go func() {
+			result <- s.Execute(ctx, `while true do end`)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		if err := s.CloseTimeout(time.Second); err != nil {
+			t.Errorf("CloseTimeout failed with error: %v", err)
+		}
+		if err := <-result; !errors.Is(err, ErrStopped) {
+			t.Errorf("Expected ErrStopped, got %v", err)
+		}
+	}
+
+	// blocking Go functions are not
+	s = NewState()
+	release := make(chan struct{})
+	if err := s.RegisterFunction(ctx, "block", func(args []any) ([]any, error) {
+		<-release
+		return nil, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Execute(ctx, `block()`)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.CloseTimeout(50 * time.Millisecond); !errors.Is(err, ErrCloseTimeout) {
+		t.Errorf("Expected ErrCloseTimeout, got %v", err)
+	}
+	if err := s.Execute(ctx, `x = 1`); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed, got %v", err)
+	}
+
+	// closed after the function returns
+	close(release)
+	<-result
+	s.Close()
+}
+
+// TestStrictGlobals tests accessing global variables when `_G` raises errors for undeclared ones.
+func TestStrictGlobals(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.Execute(ctx, `
+		declared = {1, 2}
+		function f() return "f" end
+		setmetatable(_G, {__index = function(_, k) error("undeclared " .. k) end})
+	`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	var luaErr *LuaError
+	if _, err := s.GetGlobal(ctx, "missing"); !errors.As(err, &luaErr) || !strings.Contains(luaErr.Message, "undeclared missing") {
+		t.Errorf("Expected a LuaError for GetGlobal, got %v", err)
+	}
+	if _, err := s.HasGlobal(ctx, "missing"); !errors.As(err, &luaErr) {
+		t.Errorf("Expected a LuaError for HasGlobal, got %v", err)
+	}
+	if _, err := s.GetGlobalBytes(ctx, "missing"); !errors.As(err, &luaErr) {
+		t.Errorf("Expected a LuaError for GetGlobalBytes, got %v", err)
+	}
+	if _, err := s.GetGlobalTable(ctx, "missing"); !errors.As(err, &luaErr) {
+		t.Errorf("Expected a LuaError for GetGlobalTable, got %v", err)
+	}
+	if err := s.RangeGlobalArray(ctx, "missing", func(int, any) bool { return true }); !errors.As(err, &luaErr) {
+		t.Errorf("Expected a LuaError for RangeGlobalArray, got %v", err)
+	}
+	if _, err := s.CallGlobal(ctx, "missing"); !errors.As(err, &luaErr) {
+		t.Errorf("Expected a LuaError for CallGlobal, got %v", err)
+	}
+
+	// declared variables are still accessible, and the state keeps working
+	if value, err := s.GetGlobal(ctx, "declared"); err != nil || !reflect.DeepEqual(value, []any{int64(1), int64(2)}) {
+		t.Errorf("Expected [1 2], got %v (error: %v)", value, err)
+	}
+	if results, err := s.CallGlobal(ctx, "f"); err != nil || results[0] != "f" {
+		t.Errorf("Expected f, got %v (error: %v)", results, err)
+	}
+	if err := s.SeedRandom(ctx, 42); err != nil {
+		t.Errorf("SeedRandom failed with error: %v", err)
+	}
+	if err := s.SetSearchPath(ctx, "./?.lua"); err != nil {
+		t.Errorf("SetSearchPath failed with error: %v", err)
+	}
+
+	// registering functions honors a strict `__newindex`
+	if err := s.Execute(ctx, `setmetatable(_G, {__newindex = function(_, k) error("cannot declare " .. k) end})`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if err := s.RegisterFunction(ctx, "g", func(args []any) ([]any, error) { return nil, nil }); !errors.As(err, &luaErr) || !strings.Contains(luaErr.Message, "cannot declare g") {
+		t.Errorf("Expected a LuaError for RegisterFunction, got %v", err)
+	}
+	if err := s.SetGlobal(ctx, "x", 1); !errors.As(err, &luaErr) || !strings.Contains(luaErr.Message, "cannot declare x") {
+		t.Errorf("Expected a LuaError for SetGlobal, got %v", err)
+	}
+	if err := s.Batch(ctx, func(tx *Tx) error {
+		return tx.SetGlobal("y", 2)
+	}); !errors.As(err, &luaErr) || !strings.Contains(luaErr.Message, "cannot declare y") {
+		t.Errorf("Expected a LuaError for Tx.SetGlobal, got %v", err)
+	}
+	if results, err := s.Evaluate(ctx, `return 1 + 1`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestPoisoned tests that errors outside of protected mode poison states instead of aborting.
+func TestPoisoned(t *testing.T) {
+	ctx := context.Background()
+
+	sched := NewScheduler(1)
+	defer sched.Close()
+
+	for _, s := range []*State{NewState(), NewStateOnScheduler(sched)} {
+		// unloading a module calls `__newindex` of `package.loaded` outside of protected mode
+		if err := s.Execute(ctx, `setmetatable(package.loaded, {__newindex = function() error("no modules") end})`); err != nil {
+			t.Fatalf("Execute failed with error: %v", err)
+		}
+		if err := s.UnloadModule(ctx, "missing"); !errors.Is(err, ErrPoisoned) || !strings.Contains(err.Error(), "no modules") {
+			t.Errorf("Expected ErrPoisoned, got %v", err)
+		}
+
+		if err := s.Execute(ctx, `return 1`); !errors.Is(err, ErrPoisoned) {
+			t.Errorf("Expected ErrPoisoned, got %v", err)
+		}
+		s.Close()
+	}
+
+	// the scheduler keeps working for other states
+	s := NewStateOnScheduler(sched)
+	defer s.Close()
+	if results, err := s.Evaluate(ctx, `return 1 + 1`); err != nil || results[0] != int64(2) {
+		t.Errorf("Expected 2, got %v (error: %v)", results, err)
+	}
+}
+
+// TestScheduler tests running many states on a few shared worker threads.
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+
+	sched := NewScheduler(2)
+	defer sched.Close()
+
+	states := make([]*State, 20)
+	for i := range states {
+		states[i] = NewStateOnScheduler(sched)
+		if err := states[i].SetGlobal(ctx, "id", i); err != nil {
+			t.Fatalf("SetGlobal failed with error: %v", err)
+		}
+	}
+
+	// concurrent operations on each state (serialized) and across states (on shared workers)
+	var wg sync.WaitGroup
+	for i, s := range states {
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for range 10 {
+					if err := s.Execute(ctx, `counter = (counter or 0) + 1`); err != nil {
+						t.Errorf("Execute failed with error: %v", err)
+					}
+					if results, err := s.Evaluate(ctx, `return id`); err != nil || results[0] != int64(i) {
+						t.Errorf("Expected %d, got %v (error: %v)", i, results, err)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, s := range states {
+		if counter, err := s.GetGlobal(ctx, "counter"); err != nil || counter != int64(30) {
+			t.Errorf("Expected the counter 30, got %v (error: %v)", counter, err)
+		}
+	}
+
+	// interruptions, Reset, and Clone
+	s := states[0]
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := s.Execute(timeout, `while true do end`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if err := s.Reset(ctx); err != nil {
+		t.Fatalf("Reset failed with error: %v", err)
+	}
+	if err := s.Execute(ctx, `x = 42`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	clone, err := s.Clone(ctx)
+	if err != nil {
+		t.Fatalf("Clone failed with error: %v", err)
+	}
+	if x, err := clone.GetGlobal(ctx, "x"); err != nil || x != int64(42) {
+		t.Errorf("Expected 42 from the clone, got %v (error: %v)", x, err)
+	}
+	clone.Close()
+
+	for _, s := range states {
+		s.Close()
+	}
+	if err := states[1].Execute(ctx, `x = 1`); !errors.Is(err, ErrStateClosed) {
+		t.Errorf("Expected ErrStateClosed, got %v", err)
+	}
+}
+
+// BenchmarkEvaluateRepeated benchmarks evaluating the same code repeatedly.
+func BenchmarkEvaluateRepeated(b *testing.B) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	code := `local sum = 0
+for i = 1, 10 do
+  sum = sum + i
+end
+return sum`
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := s.Evaluate(ctx, code); err != nil {
+			b.Fatalf("Evaluate failed with error: %v", err)
+		}
+	}
+}
+
+// BenchmarkEvaluateArray benchmarks converting array-heavy results.
+func BenchmarkEvaluateArray(b *testing.B) {
+	ctx := context.Background()
+
+	s := NewState()
+	defer s.Close()
+
+	if err := s.Execute(ctx, `rows = {}
+for i = 1, 100 do
+  rows[i] = {i, i * 2, i * 3, "row"}
+end`); err != nil {
+		b.Fatalf("Execute failed with error: %v", err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := s.Evaluate(ctx, `return rows`); err != nil {
+			b.Fatalf("Evaluate failed with error: %v", err)
+		}
+	}
+}
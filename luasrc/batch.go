@@ -0,0 +1,63 @@
+// batch.go
+
+package luasrc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tx runs operations of a batch (see State.Batch) directly on the worker goroutine.
+//
+// It is only valid within the function passed to Batch.
+type Tx struct {
+	s    *State
+	done bool
+}
+
+// Batch runs fn on the worker goroutine in a single round-trip, so that the operations
+// of tx (e.g. for initializing a state with many globals and scripts) do not pay
+// the synchronization of separate calls.
+//
+// The first error returned from fn aborts the batch, and is returned.
+// As fn runs on the worker goroutine, it must not call methods of the State itself.
+func (s *State) Batch(ctx context.Context, fn func(tx *Tx) error) error {
+	return s.run(ctx, func() error {
+		tx := &Tx{s: s}
+		defer func() { tx.done = true }()
+
+		return fn(tx)
+	})
+}
+
+// check returns an error if the batch of tx has already finished.
+func (tx *Tx) check() error {
+	if tx.done {
+		return fmt.Errorf("batch has already finished")
+	}
+	return nil
+}
+
+// Execute executes a string of Lua code.
+func (tx *Tx) Execute(code string) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.s.execute(code, code)
+}
+
+// GetGlobal gets a global variable from the Lua state.
+func (tx *Tx) GetGlobal(name string) (any, error) {
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	return tx.s.getGlobal(name)
+}
+
+// SetGlobal sets a Go value as a global variable in the Lua state.
+func (tx *Tx) SetGlobal(name string, value any) error {
+	if err := tx.check(); err != nil {
+		return err
+	}
+	return tx.s.setGlobal(name, value)
+}
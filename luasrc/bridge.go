@@ -5,17 +5,15 @@ package luasrc
 
 // #cgo darwin CFLAGS: -DLUA_USE_MACOSX
 // #cgo linux CFLAGS: -DLUA_USE_LINUX
-// #cgo LDFLAGS: -lm
+// #cgo windows CFLAGS: -DLUA_USE_WINDOWS
+// #cgo !windows LDFLAGS: -lm
 /*
+#include <stdint.h>
 #include <stdlib.h>
 #include "lua.h"
 #include "lauxlib.h"
 #include "lualib.h"
 
-static int bridge_dostring(lua_State* L, const char* s) {
-  return luaL_dostring(L, s);
-}
-
 static void bridge_pop(lua_State* L, int n) {
   lua_pop(L, n);
 }
@@ -28,21 +26,338 @@ static lua_Number bridge_tonumber(lua_State* L, int i) {
   return lua_tonumber(L, i);
 }
 
-static int bridge_pcall(lua_State* L, int nargs, int nresults, int errfunc) {
-  return lua_pcall(L, nargs, nresults, errfunc);
+// bridge_allocator keeps track of the memory allocated by a Lua state.
+typedef struct {
+  size_t used;
+  size_t limit;   // 0 for no limit
+  int enforcing;  // whether the limit is enforced (only while running Lua code in protected mode, not Go code)
+} bridge_allocator;
+
+// bridge_alloc is a lua_Alloc function which fails allocations exceeding the limit,
+// making Lua raise a memory error.
+static void* bridge_alloc(void* ud, void* ptr, size_t osize, size_t nsize) {
+  bridge_allocator* a = (bridge_allocator*)ud;
+  void* p;
+
+  if (ptr == NULL) {
+    osize = 0; // osize is the type of the object being allocated
+  }
+  if (nsize == 0) {
+    free(ptr);
+    a->used -= osize;
+    return NULL;
+  }
+  if (a->enforcing && a->limit > 0 && nsize > osize && a->used + (nsize - osize) > a->limit) {
+    return NULL;
+  }
+  p = realloc(ptr, nsize);
+  if (p != NULL) {
+    a->used = a->used - osize + nsize;
+  }
+  return p;
+}
+
+// bridge_set_allocator replaces the allocator of a newly-created state with bridge_alloc,
+// starting from the memory already in use.
+static bridge_allocator* bridge_set_allocator(lua_State* L, size_t limit) {
+  bridge_allocator* a = (bridge_allocator*)malloc(sizeof(bridge_allocator));
+  a->used = (size_t)lua_gc(L, LUA_GCCOUNT) * 1024 + (size_t)lua_gc(L, LUA_GCCOUNTB);
+  a->limit = limit;
+  a->enforcing = 0;
+  lua_setallocf(L, bridge_alloc, a);
+  return a;
+}
+
+static const char* traceback_key = "lua-go.traceback";
+
+// bridge_message_handler keeps the traceback of an error in the registry,
+// leaving the error object as it is.
+static int bridge_message_handler(lua_State* L) {
+  luaL_traceback(L, L, NULL, 1);
+  lua_setfield(L, LUA_REGISTRYINDEX, traceback_key);
+  lua_settop(L, 1);
+  return 1;
+}
+
+// bridge_pcall_traceback calls a function in protected mode, keeping the traceback of an error.
+static int bridge_pcall_traceback(lua_State* L, int nargs, int nresults) {
+  int base = lua_gettop(L) - nargs; // function index
+  int status, enforcing;
+  bridge_allocator* a;
+
+  lua_pushnil(L);
+  lua_setfield(L, LUA_REGISTRYINDEX, traceback_key);
+
+  // enforce the memory limit only in protected mode, as memory errors
+  // outside of it would make Lua panic
+  lua_getallocf(L, (void**)&a);
+  enforcing = a->enforcing;
+  a->enforcing = 1;
+
+  lua_pushcfunction(L, bridge_message_handler);
+  lua_insert(L, base);
+  status = lua_pcall(L, nargs, nresults, base);
+  lua_remove(L, base);
+
+  a->enforcing = enforcing;
+
+  return status;
+}
+
+// bridge_resume resumes the thread co with nargs arguments on its stack.
+//
+// Like bridge_pcall_traceback, the memory limit is enforced while the thread is running.
+// On error, the traceback of the thread is pushed onto L.
+static int bridge_resume(lua_State* L, lua_State* co, int nargs, int* nresults) {
+  int status, enforcing;
+  bridge_allocator* a;
+
+  lua_getallocf(L, (void**)&a);
+  enforcing = a->enforcing;
+  a->enforcing = 1;
+
+  status = lua_resume(co, L, nargs, nresults);
+
+  a->enforcing = enforcing;
+
+  if (status != LUA_OK && status != LUA_YIELD) {
+    luaL_traceback(L, co, NULL, 0);
+  }
+  return status;
+}
+
+static void bridge_push_traceback(lua_State* L) {
+  lua_getfield(L, LUA_REGISTRYINDEX, traceback_key);
 }
 
 static const char* bridge_get_lua_version_string() {
   return LUA_RELEASE;
 }
+
+static void bridge_set_handle(lua_State* L, uintptr_t h) {
+  *(uintptr_t*)lua_getextraspace(L) = h;
+}
+
+// (non-static, also used in callback.go)
+uintptr_t bridge_get_handle(lua_State* L) {
+  return *(uintptr_t*)lua_getextraspace(L);
+}
+
+// (non-static, also used in callback.go)
+lua_Integer bridge_function_id(lua_State* L) {
+  return lua_tointeger(L, lua_upvalueindex(1));
+}
+
+// bridge_suspend_limit stops enforcing the memory limit while Go code pushes values onto the stack
+// (as a memory error there would unwind through Go frames), and returns whether it was enforced.
+static int bridge_suspend_limit(lua_State* L) {
+  bridge_allocator* a;
+  int enforcing;
+
+  lua_getallocf(L, (void**)&a);
+  enforcing = a->enforcing;
+  a->enforcing = 0;
+  return enforcing;
+}
+
+// bridge_restore_limit enforces the memory limit again if it was enforced, raising a memory error
+// (from C) when the values pushed while it was suspended exceed the limit.
+static void bridge_restore_limit(lua_State* L, int enforcing) {
+  bridge_allocator* a;
+
+  lua_getallocf(L, (void**)&a);
+  a->enforcing = enforcing;
+  if (enforcing && a->limit > 0 && a->used > a->limit) {
+    // allocations fail beyond the limit, unless an emergency collection frees enough memory
+    lua_newuserdatauv(L, 0, 0);
+    lua_pop(L, 1);
+  }
+}
+
+// implemented in Go (callback.go)
+extern int bridgeCallFunction(lua_State* L);
+
+// bridge_function_trampoline calls the registered Go function, and raises
+// a Lua error (with position information) when it returns a negative value.
+static int bridge_function_trampoline(lua_State* L) {
+  int enforcing = bridge_suspend_limit(L);
+  int n = bridgeCallFunction(L);
+  bridge_restore_limit(L, enforcing);
+  if (n < 0) {
+    luaL_where(L, 1);
+    lua_insert(L, -2);
+    lua_concat(L, 2);
+    return lua_error(L);
+  }
+  return n;
+}
+
+// implemented in Go (callback.go)
+extern int bridgeHook(lua_State* L);
+extern int bridgeLineHook(lua_State* L, char* source, int line);
+
+// bridge_hook is called periodically (and on each line with a line hook) while running Lua code,
+// and raises a Lua error when the running operation should be interrupted.
+static void bridge_hook(lua_State* L, lua_Debug* ar) {
+  int enforcing, interrupted;
+
+  if (ar->event == LUA_HOOKLINE) {
+    lua_getinfo(L, "S", ar);
+  }
+  enforcing = bridge_suspend_limit(L);
+  if (ar->event == LUA_HOOKLINE) {
+    interrupted = bridgeLineHook(L, ar->short_src, ar->currentline);
+  } else {
+    interrupted = bridgeHook(L);
+  }
+  bridge_restore_limit(L, enforcing);
+  if (interrupted != 0) {
+    lua_error(L);
+  }
+}
+
+// implemented in Go (callback.go), never returns
+extern void bridgePanic(lua_State* L);
+
+// bridge_panic is the panic handler for errors outside of protected mode,
+// which would abort the process if it returned.
+static int bridge_panic(lua_State* L) {
+  bridgePanic(L);
+  return 0;
+}
+
+static void bridge_set_panic(lua_State* L) {
+  lua_atpanic(L, bridge_panic);
+}
+
+static void bridge_set_hook(lua_State* L, int count, int lines) {
+  lua_sethook(L, bridge_hook, LUA_MASKCOUNT | (lines ? LUA_MASKLINE : 0), count);
+}
+
+// bridge_set_loaded sets the value on the top of the stack as `package.loaded[name]`, without popping it.
+static void bridge_set_loaded(lua_State* L, const char* name) {
+  luaL_getsubtable(L, LUA_REGISTRYINDEX, LUA_LOADED_TABLE);
+  lua_pushvalue(L, -2);
+  lua_setfield(L, -2, name);
+  lua_pop(L, 1);
+}
+
+static void bridge_push_globals(lua_State* L) {
+  lua_pushglobaltable(L);
+}
+
+// bridge_get_global returns the global variable with the name given as the argument.
+static int bridge_get_global(lua_State* L) {
+  lua_getglobal(L, lua_tostring(L, 1));
+  return 1;
+}
+
+static void bridge_push_get_global(lua_State* L) {
+  lua_pushcfunction(L, bridge_get_global);
+}
+
+// bridge_set_global sets the global variable with the name (1st argument) to the value (2nd).
+static int bridge_set_global(lua_State* L) {
+  lua_settop(L, 2);
+  lua_setglobal(L, lua_tostring(L, 1));
+  return 0;
+}
+
+static void bridge_push_set_global(lua_State* L) {
+  lua_pushcfunction(L, bridge_set_global);
+}
+
+static void bridge_push_function(lua_State* L, lua_Integer id) {
+  lua_pushinteger(L, id);
+  lua_pushcclosure(L, bridge_function_trampoline, 1);
+}
+
+static int bridge_tolstring(lua_State* L) {
+  luaL_tolstring(L, 1, NULL);
+  return 1;
+}
+
+// bridge_tostring pushes the result of the `__tostring` metamethod of the value at the given index
+// (called in protected mode) and returns 1, or pushes nothing and returns 0 when there is no such
+// metamethod or it fails.
+static int bridge_tostring(lua_State* L, int idx) {
+  idx = lua_absindex(L, idx);
+  if (luaL_getmetafield(L, idx, "__tostring") == LUA_TNIL) {
+    return 0;
+  }
+  lua_pop(L, 1);
+
+  lua_pushcfunction(L, bridge_tolstring);
+  lua_pushvalue(L, idx);
+  if (lua_pcall(L, 1, 1, 0) != LUA_OK) {
+    lua_pop(L, 1);
+    return 0;
+  }
+  return 1;
+}
+
+// bridge_push_function_info pushes a description of the function at the given index:
+// whether it is a C function, or where a Lua function is defined.
+static void bridge_push_function_info(lua_State* L, int idx) {
+  lua_Debug ar;
+  if (lua_iscfunction(L, idx)) {
+    lua_pushliteral(L, "C function");
+    return;
+  }
+  lua_pushvalue(L, idx);
+  lua_getinfo(L, ">S", &ar);
+  lua_pushfstring(L, "Lua function defined at %s:%d", ar.short_src, ar.linedefined);
+}
+
+// bridge_push_error_string pushes the message of the error object at the given index converted with
+// luaL_tolstring (honoring `__tostring`), or a description of the object when the conversion fails.
+static void bridge_push_error_string(lua_State* L, int idx) {
+  idx = lua_absindex(L, idx);
+  lua_checkstack(L, 2);
+  lua_pushcfunction(L, bridge_tolstring);
+  lua_pushvalue(L, idx);
+  if (lua_pcall(L, 1, 1, 0) != LUA_OK || lua_type(L, -1) != LUA_TSTRING) {
+    lua_pop(L, 1);
+    lua_pushfstring(L, "(error object is a %s value)", luaL_typename(L, idx));
+  }
+}
+
+// bridge_table_count returns the number of entries in the table at the given (absolute) index,
+// and sets *seq to whether its keys are exactly 1..n (so that it can be converted to a slice).
+static int bridge_table_count(lua_State* L, int idx, int* seq) {
+  lua_Integer n = (lua_Integer)lua_rawlen(L, idx);
+  lua_Integer k;
+  int count = 0, inRange = 0;
+
+  lua_pushnil(L);
+  while (lua_next(L, idx) != 0) {
+    count++;
+    if (lua_isinteger(L, -2)) {
+      k = lua_tointeger(L, -2);
+      if (k >= 1 && k <= n) {
+        inRange++;
+      }
+    }
+    lua_pop(L, 1);
+  }
+  *seq = count > 0 && count == n && inRange == count;
+  return count;
+}
 */
 import "C"
 
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"reflect"
 	"runtime"
+	"runtime/cgo"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -52,18 +367,127 @@ func Version() string {
 	return C.GoString(C.bridge_get_lua_version_string())
 }
 
+// VersionNumber returns the numeric components of the Lua version (e.g., 5, 4, 8),
+// from the LUA_VERSION_RELEASE_NUM macro of lua.h.
+func VersionNumber() (major, minor, patch int) {
+	num := int(C.LUA_VERSION_RELEASE_NUM) // e.g. 50408
+	return num / 10000, num / 100 % 100, num % 100
+}
+
+// cIndex is the C string "__index".
+var cIndex = C.CString("__index")
+
+// hookCount is the number of instructions between interruption checks.
+const hookCount = 1000
+
 // State represents a Lua state.
 type State struct {
 	s      *C.lua_State
+	alloc  *C.bridge_allocator
 	opChan chan func()
-	done   chan struct{}
+	done   chan struct{} // closed by Close
+	closed chan struct{} // closed when the worker goroutine has closed the state
+
+	// held while an operation is sent to, or running on, Options.Scheduler (nil without it)
+	turn chan struct{}
+
+	// closed when the state is poisoned by an error outside of protected mode (see bridgePanic),
+	// with the error to return from operations afterward
+	poisoned  chan struct{}
+	poisonErr error
+
+	closeOnce sync.Once
+
+	opts   Options
+	handle cgo.Handle
+
+	// context of the running operation, only accessed from the worker goroutine
+	ctx context.Context
+
+	// registered Go functions, only accessed from the worker goroutine
+	funcs      map[int64]function
+	lastFuncID int64
+
+	// writer of the `print` replacement of SetOutput and Run, and its registry reference
+	// (0 if not created yet), only accessed from the worker goroutine
+	output   io.Writer
+	printRef C.int
+
+	// Go objects exposed as userdata, only accessed from the worker goroutine
+	objects      map[int64]goObject
+	lastObjectID int64
+
+	// Lua state (or thread) calling the running Go function (nil if none), only accessed from the worker goroutine
+	caller *C.lua_State
+
+	// trace of the running operation (nil if not tracing), only accessed from the worker goroutine
+	trace *Trace
+
+	// tables being converted by toGoValue, only accessed from the worker goroutine
+	ancestors map[unsafe.Pointer]bool
+
+	// whether to convert Lua functions to thunks, only accessed from the worker goroutine
+	thunks      bool
+	lastThunkID int64
+
+	// high-water mark of memory in use (in bytes) during the last evaluation
+	peakMemory int64
+
+	// number of instructions between hook calls, and instructions executed
+	// (approximately) by the current operation
+	hookCount    int
+	instructions int64
+
+	// error message of the interruption of the current operation (empty if not interrupted),
+	// raised again on every instruction until the operation unwinds
+	interrupted string
+
+	// incremented on every Reset, for invalidating references to the previous lua_State
+	generation int64
+
+	// whether Stop was requested for the current operation (set from any goroutine),
+	// and whether the current operation was interrupted by it
+	stopping atomic.Bool
+	stopped  bool
+
+	// default timeout (time.Duration) of operations whose contexts have no deadlines
+	defaultTimeout atomic.Int64
+
+	// called on each executed line (nil if not set), only accessed from the worker goroutine
+	lineHook func(source string, line int)
+
+	// functions compiled by Execute and Evaluate (nil if disabled), only accessed from the worker goroutine
+	chunks *chunkCache
+
+	// file system for loading Lua modules (nil if not set), only accessed from the worker goroutine
+	moduleFS fs.FS
 }
 
 // NewState creates a new Lua state and opens the standard libraries.
 func NewState() *State {
+	return NewStateWithOptions(Options{})
+}
+
+// NewStateWithOptions creates a new Lua state with given options and opens the standard libraries.
+func NewStateWithOptions(opts Options) *State {
 	s := &State{
-		opChan: make(chan func()),
-		done:   make(chan struct{}),
+		opChan:   make(chan func()),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		poisoned: make(chan struct{}),
+		opts:     opts,
+		funcs:    make(map[int64]function),
+		objects:  make(map[int64]goObject),
+
+		ancestors: make(map[unsafe.Pointer]bool),
+	}
+
+	if opts.Scheduler != nil {
+		s.turn = make(chan struct{}, 1)
+		s.handle = cgo.NewHandle(s)
+		opts.Scheduler.do(s.open)
+
+		return s
 	}
 
 	var wg sync.WaitGroup
@@ -73,8 +497,11 @@ func NewState() *State {
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 
-		s.s = C.luaL_newstate()
-		C.luaL_openlibs(s.s)
+		// keep a handle to this state in the extra space of lua_State,
+		// so that callbacks from C can find it
+		s.handle = cgo.NewHandle(s)
+
+		s.open()
 
 		wg.Done()
 
@@ -83,8 +510,10 @@ func NewState() *State {
 			case op := <-s.opChan:
 				op()
 			case <-s.done:
-				C.lua_close(s.s)
-				s.s = nil
+				defer close(s.closed)
+
+				s.closeState()
+				s.handle.Delete()
 				return
 			}
 		}
@@ -96,20 +525,228 @@ func NewState() *State {
 	return s
 }
 
-// Close closes the Lua state.
+// open opens a new lua_State with the options of this State.
+// This function must be called from within the locked OS thread.
+func (s *State) open() {
+	s.s = C.luaL_newstate()
+	s.alloc = C.bridge_set_allocator(s.s, C.size_t(s.opts.maxMemoryBytes()))
+	s.openLibraries()
+	if !s.opts.AllowExit {
+		s.disableExit()
+	}
+	if s.opts.SearchPath != "" {
+		_ = s.setPackageField("path", s.opts.SearchPath)
+	}
+	if s.opts.CSearchPath != "" {
+		_ = s.setPackageField("cpath", s.opts.CSearchPath)
+	}
+
+	C.bridge_set_handle(s.s, C.uintptr_t(s.handle))
+	C.bridge_set_panic(s.s)
+
+	s.chunks = newChunkCache(s.opts.chunkCacheSize())
+
+	// check interruptions (and the instruction limit) periodically
+	s.hookCount = hookCount
+	if max := s.opts.maxInstructions(); max > 0 && max < s.hookCount {
+		s.hookCount = max
+	}
+	s.setHook(s.s, s.hookCount)
+
+	s.countGCCycles()
+
+	if max := s.opts.maxCoroutines(); max > 0 {
+		s.guardCoroutines(max)
+	}
+}
+
+// closeState closes the current lua_State, and releases its resources.
+// This function must be called from within the locked OS thread.
+func (s *State) closeState() {
+	C.lua_close(s.s)
+	s.s = nil
+	C.free(unsafe.Pointer(s.alloc))
+	s.alloc = nil
+}
+
+// SetLineHook sets fn to be called on each line of Lua code executed (e.g. for a step debugger),
+// with the source (chunk name) and the line number. A nil fn removes the hook.
+//
+// Without a line hook, running Lua code is not slowed down by it. Note that coroutines which
+// already exist keep running without (or with) the previous hook.
+// As fn is called on the worker goroutine, it must not call methods of this State itself.
+func (s *State) SetLineHook(ctx context.Context, fn func(source string, line int)) error {
+	return s.run(ctx, func() error {
+		s.lineHook = fn
+		s.setHook(s.s, s.hookCount)
+
+		return nil
+	})
+}
+
+// setHook sets the hook of the thread L, called every count instructions (and on each line
+// with a line hook).
+// This function must be called from within the locked OS thread.
+func (s *State) setHook(L *C.lua_State, count int) {
+	C.bridge_set_hook(L, C.int(count), boolToInt(s.lineHook != nil))
+}
+
+// SetDefaultTimeout sets the default timeout of operations (e.g. Execute or Evaluate)
+// whose contexts have no deadlines, so that scripts cannot run unbounded even with
+// context.Background(). Zero (the default) means no timeout.
+//
+// Like deadlines of contexts, the timeout interrupts running Lua code between instructions.
+func (s *State) SetDefaultTimeout(d time.Duration) {
+	s.defaultTimeout.Store(int64(d))
+}
+
+// Stop interrupts the operation (e.g. Execute or Evaluate) which is currently running,
+// making it fail with ErrStopped at the next check between Lua instructions.
+//
+// It is safe to call Stop from any goroutine. It has no effect on operations started afterward.
+func (s *State) Stop() {
+	s.stopping.Store(true)
+}
+
+// Reset closes the current lua_State and opens a fresh one (with the same options)
+// on the same worker goroutine, which is cheaper than creating a new State.
+//
+// All globals are wiped and the standard libraries are re-opened, so everything set up
+// on the previous lua_State is gone: registered Go functions and modules, redirected output, etc.
+// Chunks and LuaRefs of the previous lua_State become invalid, and fail when called.
+func (s *State) Reset(ctx context.Context) error {
+	return s.run(ctx, func() error {
+		s.closeState()
+
+		s.generation++
+		s.funcs = make(map[int64]function)
+		s.objects = make(map[int64]goObject)
+		s.output, s.printRef = nil, 0
+		s.peakMemory = 0
+
+		s.open()
+
+		return nil
+	})
+}
+
+// Close closes the Lua state, and waits until it is closed.
+//
+// It is safe to call Close multiple times. Operations on a closed state fail with ErrStateClosed.
 func (s *State) Close() {
-	close(s.done)
+	s.beginClose()
+	<-s.closed
 }
 
-// Execute executes a string of Lua code.
-func (s *State) Execute(ctx context.Context, code string) error {
-	if s.s == nil {
-		return fmt.Errorf("lua state is closed")
+// CloseTimeout interrupts the running operation (like Stop), closes the Lua state,
+// and waits up to the grace period d until it is closed.
+//
+// If the state is not closed in time, it returns ErrCloseTimeout. It happens when the running
+// operation cannot be interrupted, e.g. while a Go or C function called from Lua blocks
+// (interruptions are checked only between Lua instructions). Then the state is closed
+// when the operation returns, and until then its worker goroutine (with its locked OS thread)
+// is stuck, which is effectively leaked if the operation never returns.
+func (s *State) CloseTimeout(d time.Duration) error {
+	s.Stop()
+	s.beginClose()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-s.closed:
+		return nil
+	case <-timer.C:
+		return ErrCloseTimeout
+	}
+}
+
+// poison marks the state as poisoned with the given error, and closes it without closing
+// the lua_State (which is unusable), so that operations fail with the error afterward.
+func (s *State) poison(err error) {
+	s.poisonErr = err
+	close(s.poisoned)
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	close(s.closed)
+}
+
+// closedErr returns the error for operations on the closed state.
+func (s *State) closedErr() error {
+	select {
+	case <-s.poisoned:
+		return s.poisonErr
+	default:
+		return ErrStateClosed
+	}
+}
+
+// beginClose makes the worker goroutine (or the scheduler) close the Lua state
+// after the running operation, without waiting for it.
+func (s *State) beginClose() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		if s.opts.Scheduler != nil {
+			go func() {
+				defer close(s.closed)
+
+				// wait for the running operation, and close the state on the scheduler
+				s.turn <- struct{}{}
+				s.opts.Scheduler.do(func() {
+					s.closeState()
+					s.handle.Delete()
+				})
+			}()
+		}
+	})
+}
+
+// ExecuteFile executes a Lua script file.
+//
+// Error messages reference the file name and line numbers, as Lua normally reports.
+func (s *State) ExecuteFile(ctx context.Context, path string) error {
+	return s.run(ctx, func() error {
+		cPath := C.CString(path)
+		defer C.free(unsafe.Pointer(cPath))
+
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top) // Discard returned values (or the error message)
+
+		switch status := C.luaL_loadfilex(s.s, cPath, s.loadMode()); status {
+		case C.LUA_OK:
+		case C.LUA_ERRFILE:
+			return fmt.Errorf("lua error: %s", goString(s.s, -1))
+		default:
+			return s.loadError(s.s, status)
+		}
+		return s.pcall(s.s, 0, C.LUA_MULTRET)
+	})
+}
+
+// run runs fn on the worker goroutine (or a worker thread of Options.Scheduler) and waits for its result.
+//
+// When ctx is done before fn starts, fn is not run at all; when it is done while fn is running,
+// the Lua code is interrupted (see bridgeHook).
+//
+// Values produced by fn should only be read by the caller when run returns
+// a nil error.
+func (s *State) run(ctx context.Context, fn func() error) error {
+	if timeout := time.Duration(s.defaultTimeout.Load()); timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
 	}
 
+	// buffered, so that the worker never blocks on sending the result of an abandoned operation
 	resultChan := make(chan error, 1)
 
-	s.opChan <- func() {
+	op := func() {
+		// skip fn if ctx was done while the operation was waiting for the worker
 		select {
 		case <-ctx.Done():
 			resultChan <- ctx.Err()
@@ -117,15 +754,43 @@ func (s *State) Execute(ctx context.Context, code string) error {
 		default:
 		}
 
-		cCode := C.CString(code)
-		defer C.free(unsafe.Pointer(cCode))
+		s.ctx = ctx
+		s.instructions = 0
+		s.stopping.Store(false)
+		s.stopped = false
+		s.interrupted = ""
+		defer func() { s.ctx = nil }()
 
-		if status := C.bridge_dostring(s.s, cCode); status != C.LUA_OK {
-			errStr := C.GoString(C.lua_tolstring(s.s, -1, nil))
-			C.bridge_pop(s.s, 1)
-			resultChan <- fmt.Errorf("lua error: %s", errStr)
-		} else {
-			resultChan <- nil
+		err := fn()
+		if s.interrupted != "" {
+			// restore the hook, which was made to run on every instruction
+			s.interrupted = ""
+			if s.s != nil {
+				s.setHook(s.s, s.hookCount)
+			}
+		}
+		if err != nil && ctx.Err() != nil {
+			// interrupted by the context
+			err = ctx.Err()
+		} else if err != nil && s.stopped {
+			// interrupted by Stop
+			err = ErrStopped
+		}
+		resultChan <- err
+	}
+
+	// wait for the worker (which may be busy with another operation) as long as ctx allows
+	if s.opts.Scheduler != nil {
+		if err := s.dispatch(ctx, op); err != nil {
+			return err
+		}
+	} else {
+		select {
+		case s.opChan <- op:
+		case <-s.done:
+			return s.closedErr()
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
@@ -134,173 +799,1042 @@ func (s *State) Execute(ctx context.Context, code string) error {
 		return ctx.Err()
 	case err := <-resultChan:
 		return err
+	case <-s.poisoned:
+		return s.poisonErr
 	}
 }
 
+// Execute executes a string of Lua code.
+func (s *State) Execute(ctx context.Context, code string) error {
+	return s.run(ctx, func() error {
+		return s.execute(code, code)
+	})
+}
+
+// ExecuteNamed executes a string of Lua code as a chunk with the given name, which is used
+// in error messages instead of the code itself (e.g. "=config" for `config:1:`,
+// or "@script.lua" for `script.lua:1:`).
+func (s *State) ExecuteNamed(ctx context.Context, name, code string) error {
+	return s.run(ctx, func() error {
+		return s.execute(name, code)
+	})
+}
+
+// execute executes a string of Lua code as a chunk with the given name.
+// This function must be called from within the locked OS thread.
+func (s *State) execute(name, code string) error {
+	top := C.lua_gettop(s.s)
+	defer C.lua_settop(s.s, top) // Discard returned values (or the error message)
+
+	if err := s.loadCached(s.s, code, name); err != nil {
+		return err
+	}
+	return s.pcall(s.s, 0, C.LUA_MULTRET)
+}
+
 // GetGlobal gets a global variable from the Lua state.
-func (s *State) GetGlobal(ctx context.Context, name string) any {
-	if s.s == nil {
-		return fmt.Errorf("lua state is closed")
+//
+// It fails if the state is closed, ctx is done, or the variable cannot be converted
+// (e.g. nested too deeply).
+func (s *State) GetGlobal(ctx context.Context, name string) (any, error) {
+	var result any
+
+	if err := s.run(ctx, func() error {
+		var err error
+		result, err = s.getGlobal(name)
+		return err
+	}); err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	resultChan := make(chan any, 1)
+// GetGlobals gets global variables with the given names at once (in a single operation),
+// and returns them keyed by their names. Undefined variables are included as nil.
+func (s *State) GetGlobals(ctx context.Context, names ...string) (map[string]any, error) {
+	var globals map[string]any
 
-	s.opChan <- func() {
-		select {
-		case <-ctx.Done():
-			resultChan <- nil
-			return
-		default:
+	if err := s.run(ctx, func() error {
+		values := make(map[string]any, len(names))
+		for _, name := range names {
+			value, err := s.getGlobal(name)
+			if err != nil {
+				return err
+			}
+			values[name] = value
 		}
+		globals = values
 
-		cName := C.CString(name)
-		defer C.free(unsafe.Pointer(cName))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return globals, nil
+}
+
+// getGlobal gets a global variable from the Lua state.
+// This function must be called from within the locked OS thread.
+func (s *State) getGlobal(name string) (any, error) {
+	if err := s.pushGlobal(s.s, name); err != nil {
+		return nil, err
+	}
+	defer C.bridge_pop(s.s, 1)
+
+	result, err := s.toGoValue(s.s, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get global '%s': %w", name, err)
+	}
+	return result, nil
+}
+
+// pushGlobal pushes the value of a global variable, in protected mode as indexing the global table
+// can call metamethods (e.g. of a "strict" `_G` which raises errors for undeclared variables).
+// On error, nothing is pushed.
+// This function must be called from within the locked OS thread.
+func (s *State) pushGlobal(L *C.lua_State, name string) error {
+	C.bridge_push_get_global(L)
+	cName := C.CString(name)
+	C.lua_pushstring(L, cName)
+	C.free(unsafe.Pointer(cName))
+	if err := s.pcall(L, 1, 1); err != nil {
+		C.bridge_pop(L, 1) // Pop the error object
+		return err
+	}
+	return nil
+}
+
+// storeGlobal pops the value on the top of the stack and sets it as a global variable,
+// in protected mode as it can call `__newindex` of the global table.
+// This function must be called from within the locked OS thread.
+func (s *State) storeGlobal(L *C.lua_State, name string) error {
+	C.bridge_push_set_global(L)
+	cName := C.CString(name)
+	C.lua_pushstring(L, cName)
+	C.free(unsafe.Pointer(cName))
+	C.lua_rotate(L, -3, -1) // [function, name, value]
+	if err := s.pcall(L, 2, 0); err != nil {
+		C.bridge_pop(L, 1) // Pop the error object
+		return err
+	}
+	return nil
+}
+
+// HasGlobal returns whether a global variable has a non-nil value.
+//
+// Note that Lua does not distinguish an unset global from a global set to nil,
+// so both are reported as false.
+func (s *State) HasGlobal(ctx context.Context, name string) (bool, error) {
+	var exists bool
+
+	if err := s.run(ctx, func() error {
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
+		exists = C.lua_type(s.s, -1) != C.LUA_TNIL
+		C.bridge_pop(s.s, 1)
 
-		C.lua_getglobal(s.s, cName)
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// GetGlobalBytes gets a global Lua string as a byte slice, without UTF-8 assumptions.
+//
+// It fails if the variable is not a string (or a number).
+func (s *State) GetGlobalBytes(ctx context.Context, name string) ([]byte, error) {
+	var result []byte
+
+	if err := s.run(ctx, func() error {
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
 		defer C.bridge_pop(s.s, 1)
 
-		resultChan <- s.toGoValue(-1)
+		if C.lua_isstring(s.s, -1) == 0 {
+			return fmt.Errorf("global '%s' is not a string: %s", name, C.GoString(C.lua_typename(s.s, C.lua_type(s.s, -1))))
+		}
+		result = goBytes(s.s, -1)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	select {
-	case <-ctx.Done():
+// RangeGlobalArray calls fn for each element (with its 1-based index) of a global array,
+// until fn returns false, without converting the whole array to a Go slice.
+//
+// Elements are read in order from index 1 up to the length of the table (as the `#` operator
+// without metamethods). It fails if the variable is not a table, or an element cannot be converted.
+// As fn runs on the worker goroutine, it must not call methods of the State itself.
+func (s *State) RangeGlobalArray(ctx context.Context, name string, fn func(index int, value any) bool) error {
+	return s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top)
+
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
+		if C.lua_type(s.s, -1) != C.LUA_TTABLE {
+			return fmt.Errorf("global '%s' is not a table: %s", name, C.GoString(C.lua_typename(s.s, C.lua_type(s.s, -1))))
+		}
+
+		length := int(C.lua_rawlen(s.s, -1))
+		for i := 1; i <= length; i++ {
+			C.lua_rawgeti(s.s, -1, C.lua_Integer(i))
+			value, err := s.toGoValue(s.s, -1)
+			C.bridge_pop(s.s, 1)
+			if err != nil {
+				return fmt.Errorf("failed to get global '%s' at index %d: %w", name, i, err)
+			}
+
+			if !fn(i, value) {
+				break
+			}
+		}
 		return nil
-	case res := <-resultChan:
-		return res
+	})
+}
+
+// SetGlobal sets a Go value as a global variable in the Lua state.
+//
+// Supported types are nil, booleans, integers, floats, strings, byte slices (pushed as
+// Lua strings), slices, arrays, map[any]any, maps with string, integer, or boolean keys
+// (e.g. map[string]any from `encoding/json`), structs, and pointers to them (with elements
+// of supported types).
+// Values of other types are rejected with an error.
+//
+// Structs are converted to tables keyed by their exported field names, or names in
+// `lua:"name"` struct tags. Fields tagged `lua:"-"` are skipped, and fields tagged
+// `lua:",omitempty"` are omitted when they are empty.
+func (s *State) SetGlobal(ctx context.Context, name string, value any) error {
+	return s.run(ctx, func() error {
+		return s.setGlobal(name, value)
+	})
+}
+
+// setGlobal sets a Go value as a global variable in the Lua state.
+// This function must be called from within the locked OS thread.
+func (s *State) setGlobal(name string, value any) error {
+	if err := s.pushGoValue(s.s, value); err != nil {
+		return fmt.Errorf("failed to set global '%s': %w", name, err)
 	}
+	return s.storeGlobal(s.s, name)
 }
 
 // Evaluate executes a string of Lua code and returns its results.
 func (s *State) Evaluate(ctx context.Context, code string) ([]any, error) {
-	if s.s == nil {
-		return nil, fmt.Errorf("lua state is closed")
-	}
+	return s.evaluate(ctx, code, code, false)
+}
 
-	resultChan := make(chan struct {
-		results []any
-		err     error
-	}, 1)
+// EvaluateTimeout executes a string of Lua code and returns its results, like Evaluate with
+// a context which times out after the given duration (for callers which do not deal with contexts).
+//
+// When the timeout expires, the Lua code is interrupted between instructions (freeing the worker
+// for other operations), and context.DeadlineExceeded is returned.
+func (s *State) EvaluateTimeout(code string, timeout time.Duration) ([]any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	s.opChan <- func() {
-		select {
-		case <-ctx.Done():
-			resultChan <- struct {
-				results []any
-				err     error
-			}{nil, ctx.Err()}
-			return
-		default:
+	return s.Evaluate(ctx, code)
+}
+
+// EvaluateNamed executes a string of Lua code as a chunk with the given name and returns its results.
+// The name is used in error messages instead of the code itself (e.g. "=config" for `config:1:`,
+// or "@script.lua" for `script.lua:1:`).
+func (s *State) EvaluateNamed(ctx context.Context, name, code string) ([]any, error) {
+	return s.evaluate(ctx, name, code, false)
+}
+
+// EvaluateWithArgs executes a string of Lua code with given arguments and returns its results.
+//
+// The arguments are passed to the chunk as varargs, e.g. `local a, b = ...`,
+// so values need not be interpolated into the code.
+func (s *State) EvaluateWithArgs(ctx context.Context, code string, args ...any) ([]any, error) {
+	return s.evaluate(ctx, code, code, false, args...)
+}
+
+// EvaluateIsolated executes a string of Lua code in a fresh environment and returns its results.
+//
+// The code can read global variables, but its writes to global variables are
+// kept in the environment, which is discarded afterward.
+func (s *State) EvaluateIsolated(ctx context.Context, code string) ([]any, error) {
+	var results []any
+
+	err := s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+
+		if err := s.load(s.s, code); err != nil {
+			return err
 		}
 
-		cCode := C.CString(code)
-		defer C.free(unsafe.Pointer(cCode))
+		// _ENV = setmetatable({}, {__index = _G})
+		C.lua_createtable(s.s, 0, 0)
+		C.lua_createtable(s.s, 0, 1)
+		C.bridge_push_globals(s.s)
+		C.lua_setfield(s.s, -2, cIndex)
+		C.lua_setmetatable(s.s, -2)
+		C.lua_setupvalue(s.s, -2, 1)
 
+		var err error
+		results, err = s.call(s.s, top, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// EvaluateThunks executes a string of Lua code and returns its results,
+// converting returned Lua functions to one-shot *Thunk values.
+func (s *State) EvaluateThunks(ctx context.Context, code string) ([]any, error) {
+	return s.evaluate(ctx, code, code, true)
+}
+
+// evaluate executes a string of Lua code as a chunk with the given name with given arguments,
+// and returns its results.
+func (s *State) evaluate(ctx context.Context, name, code string, thunks bool, args ...any) ([]any, error) {
+	return s.evaluateWith(ctx, func() error {
+		// Load the string as a Lua chunk (or reuse the cached one)
+		return s.loadCached(s.s, code, name)
+	}, thunks, args...)
+}
+
+// evaluateWith calls the function pushed by load with given arguments, and returns its results.
+func (s *State) evaluateWith(ctx context.Context, load func() error, thunks bool, args ...any) ([]any, error) {
+	var results []any
+
+	err := s.run(ctx, func() error {
 		// Save the current stack top to determine how many values were pushed
 		top := C.lua_gettop(s.s)
 
-		// Load the string as a Lua chunk
-		status := C.luaL_loadstring(s.s, cCode)
-		if status != C.LUA_OK {
-			errStr := C.GoString(C.lua_tolstring(s.s, -1, nil))
-			C.bridge_pop(s.s, 1) // Pop the error message
-			resultChan <- struct {
-				results []any
-				err     error
-			}{nil, fmt.Errorf("lua load error: %s", errStr)}
-			return
+		if err := load(); err != nil {
+			return err
 		}
 
-		// Call the loaded chunk (0 arguments, LUA_MULTRET results, 0 message handler)
-		status = C.bridge_pcall(s.s, 0, C.LUA_MULTRET, 0)
-		if status != C.LUA_OK {
-			errStr := C.GoString(C.lua_tolstring(s.s, -1, nil))
-			C.bridge_pop(s.s, 1) // Pop the error message
-			resultChan <- struct {
-				results []any
-				err     error
-			}{nil, fmt.Errorf("lua runtime error: %s", errStr)}
-			return
+		if err := checkStack(s.s, len(args)); err != nil {
+			C.lua_settop(s.s, top)
+			return err
+		}
+		for i, arg := range args {
+			if err := s.pushGoValue(s.s, arg); err != nil {
+				C.lua_settop(s.s, top)
+				return fmt.Errorf("argument %d: %w", i+1, err)
+			}
 		}
 
-		// Get the number of results pushed onto the stack
-		numResults := C.lua_gettop(s.s) - top
-		results := make([]any, numResults)
+		// Reset the high-water mark of memory for this evaluation
+		s.peakMemory = memoryBytes(s.s)
 
-		for i := 0; i < int(numResults); i++ {
-			idx := top + C.int(i) + 1 // Index of the result on the stack
-			results[i] = s.toGoValue(idx)
+		// Call the loaded chunk with the arguments
+		if err := s.pcall(s.s, len(args), C.LUA_MULTRET); err != nil {
+			C.lua_settop(s.s, top) // Pop the error message
+			s.samplePeakMemory(s.s)
+			return err
 		}
 
-		// Pop all results from the stack
-		C.bridge_pop(s.s, numResults)
+		// (functions are converted to thunks only in the results, not in arguments
+		// of Go functions called while running the chunk)
+		s.thunks = thunks
+		defer func() { s.thunks = false }()
 
-		resultChan <- struct {
-			results []any
-			err     error
-		}{results, nil}
+		var err error
+		results, err = s.popResults(s.s, top)
+		s.samplePeakMemory(s.s)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return results, nil
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case res := <-resultChan:
-		return res.results, res.err
+// CallGlobal calls a global Lua function with given arguments and returns its results.
+func (s *State) CallGlobal(ctx context.Context, name string, args ...any) ([]any, error) {
+	var results []any
+
+	err := s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
+		if C.lua_type(s.s, -1) != C.LUA_TFUNCTION {
+			typeName := C.GoString(C.lua_typename(s.s, C.lua_type(s.s, -1)))
+			C.lua_settop(s.s, top)
+			return fmt.Errorf("global '%s' is not a function (a %s value)", name, typeName)
+		}
+
+		if err := checkStack(s.s, len(args)); err != nil {
+			C.lua_settop(s.s, top)
+			return err
+		}
+		for i, arg := range args {
+			if err := s.pushGoValue(s.s, arg); err != nil {
+				C.lua_settop(s.s, top)
+				return fmt.Errorf("argument %d: %w", i+1, err)
+			}
+		}
+
+		var err error
+		results, err = s.call(s.s, top, len(args))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// load loads a string of Lua code as a function on the top of the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) load(L *C.lua_State, code string) error {
+	return s.loadNamed(L, code, code)
+}
+
+// loadNamed loads a string of Lua code as a chunk with the given name, and pushes it onto the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) loadNamed(L *C.lua_State, code, name string) error {
+	cCode := C.CString(code)
+	defer C.free(unsafe.Pointer(cCode))
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	if status := C.luaL_loadbufferx(L, cCode, C.size_t(len(code)), cName, s.loadMode()); status != C.LUA_OK {
+		err := s.loadError(L, status)
+		C.bridge_pop(L, 1) // Pop the error message
+		return err
+	}
+	return nil
+}
+
+// loadError returns a *LuaError for the load error (with the given status) on the top of the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) loadError(L *C.lua_State, status C.int) error {
+	if status == C.LUA_ERRMEM {
+		return &LuaError{Kind: KindMemory, Message: goString(L, -1)}
+	}
+	msg := goString(L, -1)
+	return &LuaError{Kind: KindSyntax, Message: msg, Line: errorLine(msg)}
+}
+
+// pcall calls the function with nargs arguments above it in protected mode,
+// and returns a *LuaError (with a traceback) on error.
+// On error, the error object is left on the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) pcall(L *C.lua_State, nargs int, nresults C.int) error {
+	status := C.bridge_pcall_traceback(L, C.int(nargs), nresults)
+	if status == C.LUA_OK {
+		return nil
+	}
+
+	// (read the traceback first, as converting the error object may call Lua functions
+	// in protected mode again, e.g. for resolving metatables, which resets it)
+	err := &LuaError{Kind: KindRuntime}
+	C.bridge_push_traceback(L)
+	err.Traceback = goString(L, -1)
+	C.bridge_pop(L, 1)
+
+	// (convert the error object before its message, as lua_tolstring converts numbers in place)
+	if status == C.LUA_ERRMEM {
+		err.Kind = KindMemory
+	} else {
+		err.Value = s.errorValue(L, -1)
+	}
+	err.Message = errorMessage(L, -1)
+
+	return err
+}
+
+// resume resumes the thread co with nargs arguments on its stack, and returns its results
+// (yielded or returned) with whether it has yielded.
+// The results (or the error object) are popped from the stack of co.
+// This function must be called from within the locked OS thread.
+func (s *State) resume(L, co *C.lua_State, nargs int) (results []any, yielded bool, err error) {
+	var numResults C.int
+	status := C.bridge_resume(L, co, C.int(nargs), &numResults)
+	if status != C.LUA_OK && status != C.LUA_YIELD {
+		err := &LuaError{Kind: KindRuntime, Traceback: goString(L, -1)}
+		if status == C.LUA_ERRMEM {
+			err.Kind = KindMemory
+		} else {
+			err.Value = s.errorValue(co, -1)
+		}
+		err.Message = errorMessage(co, -1)
+		C.bridge_pop(L, 1)  // Pop the traceback
+		C.lua_settop(co, 0) // Pop the error object
+		return nil, false, err
+	}
+
+	top := C.lua_gettop(co) - numResults
+	defer C.lua_settop(co, top)
+
+	if err := s.checkResults(int(numResults)); err != nil {
+		return nil, false, err
+	}
+	results = make([]any, numResults)
+	for i := range results {
+		if results[i], err = s.toGoValue(co, top+C.int(i)+1); err != nil {
+			return nil, false, fmt.Errorf("result %d: %w", i+1, err)
+		}
+	}
+	return results, status == C.LUA_YIELD, nil
+}
+
+// errorMessage returns the message of the error object at the given index: strings and numbers
+// as they are, and other values (e.g. tables) converted like `tostring`.
+// This function must be called from within the locked OS thread.
+func errorMessage(L *C.lua_State, idx C.int) string {
+	switch C.lua_type(L, idx) {
+	case C.LUA_TSTRING, C.LUA_TNUMBER:
+		return goString(L, idx)
+	}
+
+	C.bridge_push_error_string(L, idx)
+	defer C.bridge_pop(L, 1)
+
+	return goString(L, -1)
+}
+
+// errorValue converts the error object at the given index to a Go value,
+// or returns nil if it cannot be converted.
+// This function must be called from within the locked OS thread.
+func (s *State) errorValue(L *C.lua_State, idx C.int) any {
+	value, err := s.toGoValue(L, idx)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// call calls the function at top+1 with nargs arguments above it, and returns its results.
+// The stack is restored to top afterward.
+// This function must be called from within the locked OS thread.
+func (s *State) call(L *C.lua_State, top C.int, nargs int) ([]any, error) {
+	// Call the function (LUA_MULTRET results)
+	if err := s.pcall(L, nargs, C.LUA_MULTRET); err != nil {
+		C.lua_settop(L, top) // Pop the error message
+		return nil, err
+	}
+
+	return s.popResults(L, top)
+}
+
+// popResults converts the values above top (e.g. results of a call) to Go values, and pops them.
+// This function must be called from within the locked OS thread.
+func (s *State) popResults(L *C.lua_State, top C.int) ([]any, error) {
+	// Get the number of results pushed onto the stack
+	numResults := C.lua_gettop(L) - top
+	if err := s.checkResults(int(numResults)); err != nil {
+		C.lua_settop(L, top)
+		return nil, err
+	}
+	results := make([]any, numResults)
+
+	for i := 0; i < int(numResults); i++ {
+		idx := top + C.int(i) + 1 // Index of the result on the stack
+
+		var err error
+		if results[i], err = s.toGoValue(L, idx); err != nil {
+			C.lua_settop(L, top)
+			return nil, fmt.Errorf("result %d: %w", i+1, err)
+		}
+	}
+
+	// Pop all results from the stack
+	C.lua_settop(L, top)
+
+	return results, nil
+}
+
+// RegisterFunction registers a Go function as a global Lua function with the given name.
+//
+// The function is called on the worker goroutine, so it must not call
+// methods of this State itself.
+func (s *State) RegisterFunction(ctx context.Context, name string, fn GoFunction) error {
+	return s.run(ctx, func() error {
+		s.pushFunction(s.s, s.wrapGoFunction(name, fn))
+		return s.storeGlobal(s.s, name)
+	})
+}
+
+// RegisterModule registers Go functions as a module table with the given name.
+//
+// The module is set as a global variable, and also as `package.loaded[name]`
+// so that `require(name)` returns it.
+func (s *State) RegisterModule(ctx context.Context, name string, funcs map[string]GoFunction) error {
+	return s.run(ctx, func() error {
+		cName := C.CString(name)
+		defer C.free(unsafe.Pointer(cName))
+
+		C.lua_createtable(s.s, 0, C.int(len(funcs)))
+		for fnName, fn := range funcs {
+			cFnName := C.CString(fnName)
+			s.pushFunction(s.s, s.wrapGoFunction(name+"."+fnName, fn))
+			C.lua_setfield(s.s, -2, cFnName)
+			C.free(unsafe.Pointer(cFnName))
+		}
+
+		C.bridge_set_loaded(s.s, cName)
+		return s.storeGlobal(s.s, name)
+	})
+}
+
+// RegisterFunctionContext registers a context-aware Go function as a global Lua function with the given name.
+//
+// The function receives the context of the running operation (e.g. Execute or Evaluate),
+// and should honor its cancellation when it blocks (e.g. on I/O), so that the operation
+// can be interrupted promptly. Passing the context to Traceback returns the caller's stack.
+func (s *State) RegisterFunctionContext(ctx context.Context, name string, fn GoFunctionContext) error {
+	return s.RegisterFunction(ctx, name, func(args []any) ([]any, error) {
+		return fn(context.WithValue(s.ctx, callerKey{}, s), args)
+	})
+}
+
+// pushFunction pushes an internal function as a Lua C closure.
+// This function must be called from within the locked OS thread.
+func (s *State) pushFunction(L *C.lua_State, fn function) {
+	s.lastFuncID++
+	s.funcs[s.lastFuncID] = fn
+
+	C.bridge_push_function(L, C.lua_Integer(s.lastFuncID))
+}
+
+// wrapGoFunction wraps a GoFunction as an internal function which converts
+// arguments and results between Lua and Go.
+//
+// The name is used for recording calls in traces.
+func (s *State) wrapGoFunction(name string, fn GoFunction) function {
+	return func(L *C.lua_State) (int, error) {
+		numArgs := int(C.lua_gettop(L))
+		args := make([]any, numArgs)
+		for i := range numArgs {
+			var err error
+			if args[i], err = s.toGoValue(L, C.int(i+1)); err != nil {
+				return 0, fmt.Errorf("argument %d: %w", i+1, err)
+			}
+		}
+
+		results, err := fn(args)
+		if s.trace != nil {
+			s.trace.Calls = append(s.trace.Calls, TraceCall{
+				Function: name,
+				Args:     args,
+				Results:  results,
+				Err:      err,
+			})
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := checkStack(L, len(results)); err != nil {
+			return 0, err
+		}
+		for _, result := range results {
+			if err := s.pushGoValue(L, result); err != nil {
+				return 0, err
+			}
+		}
+		return len(results), nil
 	}
 }
 
 // toGoValue converts a Lua value at the given index to a Go value.
+//
+// Tables are converted deterministically, based only on the keys present in them:
+//   - an empty table is converted to an empty []any,
+//   - a table whose keys are exactly 1..n (its raw length n equals the number of entries,
+//     and every key in 1..n is present) is converted to []any,
+//   - other tables (with non-integer keys, holes, or not starting at 1) are converted to
+//     map[any]any (or *OrderedTable), unless Options.Holes says otherwise.
+//
+// Keys keep their types (e.g. `t[true] = 1` has the bool key true), so a table with any
+// non-integer key, including a boolean one, is never converted to a slice.
+//
+// Note that nil values are not stored in Lua tables, so `{false, nil, true}` has only
+// the keys 1 and 3, and is not an array.
+//
+// A table which references itself (directly or through nested tables) is converted
+// with the placeholder string "<cycle>" in place of the reference, and tables nested
+// deeper than Options.MaxTableDepth are rejected with an error.
+// This function must be called from within the locked OS thread.
+func (s *State) toGoValue(L *C.lua_State, idx C.int) (any, error) {
+	return s.toGoValueAt(L, idx, 0)
+}
+
+// toGoValueAt converts a Lua value at the given index, nested in depth tables, to a Go value.
 // This function must be called from within the locked OS thread.
-func (s *State) toGoValue(idx C.int) any {
-	switch C.lua_type(s.s, idx) {
+func (s *State) toGoValueAt(L *C.lua_State, idx C.int, depth int) (any, error) {
+	switch C.lua_type(L, idx) {
 	case C.LUA_TSTRING:
-		return C.GoString(C.lua_tolstring(s.s, idx, nil))
+		return goString(L, idx), nil
 	case C.LUA_TBOOLEAN:
-		return C.lua_toboolean(s.s, idx) != 0
+		return C.lua_toboolean(L, idx) != 0, nil
 	case C.LUA_TNUMBER:
-		if C.lua_isinteger(s.s, idx) != 0 {
-			return int64(C.bridge_tointeger(s.s, idx))
+		if s.opts.NumbersAsFloat64 {
+			return float64(C.bridge_tonumber(L, idx)), nil
 		}
-		return float64(C.bridge_tonumber(s.s, idx))
+		return goNumber(L, idx), nil
 	case C.LUA_TTABLE:
-		absIdx := C.lua_absindex(s.s, idx)
-		goMap := make(map[any]any)
+		// guard against reference cycles (e.g. `t.self = t`) and pathological nesting
+		ptr := C.lua_topointer(L, idx)
+		if s.ancestors[ptr] {
+			return "<cycle>", nil
+		}
+		if max := s.opts.maxTableDepth(); max > 0 && depth >= max {
+			return nil, fmt.Errorf("max table depth (%d) exceeded", max)
+		}
+		if C.lua_checkstack(L, 5) == 0 {
+			return nil, fmt.Errorf("stack overflow while converting nested tables")
+		}
+		s.ancestors[ptr] = true
+		defer delete(s.ancestors, ptr)
 
-		C.lua_pushnil(s.s) // first key
-		for C.lua_next(s.s, absIdx) != 0 {
-			// key is at -2, value is at -1
-			key := s.toGoValue(-2)
-			value := s.toGoValue(-1)
-			goMap[key] = value
-			C.bridge_pop(s.s, 1) // remove value, keep key for next iteration
+		absIdx := C.lua_absindex(L, idx)
+		if s.opts.Metamethods {
+			// convert a copy with its metatable resolved instead
+			resolved, err := s.pushResolvedTable(L, absIdx)
+			if err != nil {
+				return nil, err
+			}
+			if resolved {
+				defer C.bridge_pop(L, 1)
+				absIdx = C.lua_gettop(L)
+			}
 		}
 
-		// check if the map can be converted to a slice
-		if len(goMap) > 0 {
-			isSlice := true
-			for i := 1; i <= len(goMap); i++ {
-				if _, ok := goMap[int64(i)]; !ok {
-					isSlice = false
-					break
+		// convert a sequence directly to a slice, without building a map first
+		var seq C.int
+		count := int(C.bridge_table_count(L, absIdx, &seq))
+		if count == 0 && !s.opts.EmptyTableAsMap {
+			return []any{}, nil // empty table is an empty slice
+		}
+		if seq != 0 {
+			goSlice := make([]any, count)
+			for i := range goSlice {
+				C.lua_rawgeti(L, absIdx, C.lua_Integer(i+1))
+				value, err := s.toGoValueAt(L, -1, depth+1)
+				C.bridge_pop(L, 1)
+				if err != nil {
+					return nil, err
 				}
+				goSlice[i] = value
 			}
+			return goSlice, nil
+		}
 
-			if isSlice {
-				goSlice := make([]any, len(goMap))
-				for i := 1; i <= len(goMap); i++ {
-					goSlice[i-1] = goMap[int64(i)]
-				}
-				return goSlice
+		goMap := make(map[any]any, count)
+
+		var ordered *OrderedTable
+		if s.opts.OrderedTables {
+			ordered = newOrderedTable()
+		}
+
+		top := C.lua_gettop(L)
+		C.lua_pushnil(L) // first key
+		for C.lua_next(L, absIdx) != 0 {
+			// key is at -2, value is at -1
+			// (numeric keys are always converted to int64 or float64, for detecting arrays,
+			// and keys which cannot be used as Go map keys are converted to strings)
+			var key any
+			var err error
+			switch C.lua_type(L, -2) {
+			case C.LUA_TNUMBER:
+				key = goNumber(L, -2)
+			case C.LUA_TTABLE, C.LUA_TFUNCTION:
+				key = keyString(L, -2)
+			default:
+				key, err = s.toGoValueAt(L, -2, depth+1)
+			}
+			if err != nil {
+				C.lua_settop(L, top)
+				return nil, err
+			}
+			value, err := s.toGoValueAt(L, -1, depth+1)
+			if err != nil {
+				C.lua_settop(L, top)
+				return nil, err
+			}
+			goMap[key] = value
+			if ordered != nil {
+				ordered.set(key, value)
+			}
+			C.bridge_pop(L, 1) // remove value, keep key for next iteration
+		}
+
+		if len(goMap) > 0 && s.opts.Holes == HolesAsNil {
+			if goSlice, ok := sliceWithHoles(goMap); ok {
+				return goSlice, nil
 			}
-		} else {
-			return []any{} // empty table is an empty slice
 		}
 
-		return goMap
+		if ordered != nil {
+			return ordered, nil
+		}
+		return goMap, nil
 	case C.LUA_TNIL:
+		return nil, nil
+	case C.LUA_TFUNCTION:
+		if s.thunks {
+			return s.newThunk(L, idx), nil
+		}
+		if s.opts.FunctionRefs {
+			return s.newLuaRef(L, idx), nil
+		}
+		fallthrough
+	default:
+		if obj, ok := s.object(L, idx); ok {
+			return obj, nil
+		}
+
+		// Return a string representation for other types like function, userdata, etc.,
+		// with their `__tostring` metamethods if any
+		if C.bridge_tostring(L, idx) != 0 {
+			defer C.bridge_pop(L, 1)
+			return goString(L, -1), nil
+		}
+
+		// (functions are described for debugging, e.g. `<unsupported Lua type: function (C function)>`)
+		typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+		if C.lua_type(L, idx) == C.LUA_TFUNCTION && C.lua_checkstack(L, 2) != 0 {
+			C.bridge_push_function_info(L, idx)
+			defer C.bridge_pop(L, 1)
+			return fmt.Sprintf("<unsupported Lua type: %s (%s)>", typeName, goString(L, -1)), nil
+		}
+
+		// FIXME: support userdata and thread
+		return fmt.Sprintf("<unsupported Lua type: %s>", typeName), nil
+	}
+}
+
+// keyString returns a string representation of a table key which cannot be used as a Go map key
+// (e.g. a table, or a function), like "<table: 0x1234>". It is unique for each Lua object.
+// This function must be called from within the locked OS thread.
+func keyString(L *C.lua_State, idx C.int) string {
+	typeName := C.GoString(C.lua_typename(L, C.lua_type(L, idx)))
+	return fmt.Sprintf("<%s: %p>", typeName, C.lua_topointer(L, idx))
+}
+
+// goNumber returns the Lua number at the given index as an int64 (for integers) or a float64.
+// This function must be called from within the locked OS thread.
+func goNumber(L *C.lua_State, idx C.int) any {
+	if C.lua_isinteger(L, idx) != 0 {
+		return int64(C.bridge_tointeger(L, idx))
+	}
+	return float64(C.bridge_tonumber(L, idx))
+}
+
+// pushBytes pushes a byte slice onto the Lua stack as a (binary-safe) Lua string.
+// This function must be called from within the locked OS thread.
+func pushBytes(L *C.lua_State, b []byte) {
+	if len(b) == 0 {
+		C.lua_pushlstring(L, nil, 0)
+		return
+	}
+	C.lua_pushlstring(L, (*C.char)(unsafe.Pointer(&b[0])), C.size_t(len(b)))
+}
+
+// goBytes returns the Lua string (or number) at the given index as a byte slice.
+// This function must be called from within the locked OS thread.
+func goBytes(L *C.lua_State, idx C.int) []byte {
+	var length C.size_t
+	cStr := C.lua_tolstring(L, idx, &length)
+	if cStr == nil {
 		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(cStr), C.int(length))
+}
+
+// goString returns the Lua string (or number) at the given index as a Go string.
+// Unlike C.GoString, it preserves embedded NUL bytes.
+// This function must be called from within the locked OS thread.
+func goString(L *C.lua_State, idx C.int) string {
+	var length C.size_t
+	cStr := C.lua_tolstring(L, idx, &length)
+	if cStr == nil {
+		return ""
+	}
+	return C.GoStringN(cStr, C.int(length))
+}
+
+// pushGoValue pushes a Go value onto the Lua stack.
+// This function must be called from within the locked OS thread.
+func (s *State) pushGoValue(L *C.lua_State, value any) error {
+	return s.pushGoValueAt(L, value, 0)
+}
+
+// pushGoValueAt pushes a Go value, nested in depth tables, onto the Lua stack.
+// This function must be called from within the locked OS thread.
+func (s *State) pushGoValueAt(L *C.lua_State, value any, depth int) error {
+	switch v := value.(type) {
+	case nil:
+		C.lua_pushnil(L)
+	case bool:
+		if v {
+			C.lua_pushboolean(L, 1)
+		} else {
+			C.lua_pushboolean(L, 0)
+		}
+	case int:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case int8:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case int16:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case int32:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case int64:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case uint:
+		pushUnsigned(L, uint64(v))
+	case uint8:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case uint16:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case uint32:
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	case uint64:
+		pushUnsigned(L, v)
+	case float32:
+		C.lua_pushnumber(L, C.lua_Number(v))
+	case float64:
+		C.lua_pushnumber(L, C.lua_Number(v))
+	case string:
+		cStr := C.CString(v)
+		defer C.free(unsafe.Pointer(cStr))
+
+		C.lua_pushlstring(L, cStr, C.size_t(len(v)))
+	case []byte:
+		pushBytes(L, v)
+	case []any:
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		C.lua_createtable(L, C.int(len(v)), 0)
+		for i, elem := range v {
+			if err := s.pushGoValueAt(L, elem, depth+1); err != nil {
+				C.bridge_pop(L, 1) // Pop the table
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+			C.lua_rawseti(L, -2, C.lua_Integer(i+1))
+		}
+	case map[any]any:
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		C.lua_createtable(L, 0, C.int(len(v)))
+		for key, elem := range v {
+			if key == nil {
+				C.bridge_pop(L, 1) // Pop the table
+				return fmt.Errorf("nil is not allowed as a table key")
+			}
+			if f, ok := key.(float64); ok && math.IsNaN(f) {
+				C.bridge_pop(L, 1) // Pop the table
+				return fmt.Errorf("NaN is not allowed as a table key")
+			}
+			if err := s.pushGoValueAt(L, key, depth+1); err != nil {
+				C.bridge_pop(L, 1) // Pop the table
+				return fmt.Errorf("key %v: %w", key, err)
+			}
+			if err := s.pushGoValueAt(L, elem, depth+1); err != nil {
+				C.bridge_pop(L, 2) // Pop the key and the table
+				return fmt.Errorf("value for key %v: %w", key, err)
+			}
+			C.lua_rawset(L, -3)
+		}
+	case *OrderedTable:
+		if v == nil {
+			C.lua_pushnil(L)
+			break
+		}
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		C.lua_createtable(L, 0, C.int(v.Len()))
+		for i, key := range v.keys {
+			if err := s.pushGoValueAt(L, key, depth+1); err != nil {
+				C.bridge_pop(L, 1) // Pop the table
+				return fmt.Errorf("key %v: %w", key, err)
+			}
+			if err := s.pushGoValueAt(L, v.values[i], depth+1); err != nil {
+				C.bridge_pop(L, 2) // Pop the key and the table
+				return fmt.Errorf("value for key %v: %w", key, err)
+			}
+			C.lua_rawset(L, -3)
+		}
 	default:
-		// Return a string representation for other types like function, userdata, etc.
-		// FIXME: support function, userdata, and thread
-		return fmt.Sprintf("<unsupported Lua type: %s>", C.GoString(C.lua_typename(s.s, C.lua_type(s.s, idx))))
+		// pointers (dereferenced, or nil), structs, typed slices, named basic types, etc.
+		return s.pushReflectValue(L, reflect.ValueOf(value), depth)
+	}
+	return nil
+}
+
+// checkTableDepth checks whether a table can be pushed at the given depth of nested tables,
+// making sure that the stack has room for converting its elements.
+// This function must be called from within the locked OS thread.
+func (s *State) checkTableDepth(L *C.lua_State, depth int) error {
+	if max := s.opts.maxTableDepth(); max > 0 && depth >= max {
+		return fmt.Errorf("max table depth (%d) exceeded", max)
+	}
+	if C.lua_checkstack(L, 3) == 0 {
+		return fmt.Errorf("stack overflow while converting nested tables")
+	}
+	return nil
+}
+
+// checkResults returns an error if the number of results exceeds Options.MaxResults.
+func (s *State) checkResults(n int) error {
+	if max := s.opts.maxResults(); max > 0 && n > max {
+		return fmt.Errorf("too many results (%d, max %d)", n, max)
+	}
+	return nil
+}
+
+// checkStack ensures that n more values can be pushed onto the Lua stack, growing it if needed.
+// This function must be called from within the locked OS thread.
+func checkStack(L *C.lua_State, n int) error {
+	if n > math.MaxInt32 || C.lua_checkstack(L, C.int(n)) == 0 {
+		return fmt.Errorf("stack overflow: cannot push %d values", n)
+	}
+	return nil
+}
+
+// pushUnsigned pushes an unsigned integer onto the Lua stack,
+// as a float if it doesn't fit in a Lua integer.
+func pushUnsigned(L *C.lua_State, v uint64) {
+	if v > math.MaxInt64 {
+		C.lua_pushnumber(L, C.lua_Number(v))
+	} else {
+		C.lua_pushinteger(L, C.lua_Integer(v))
+	}
+}
+
+// sliceWithHoles converts a map with only positive integer keys to a slice
+// up to its highest key, filling holes with nil.
+//
+// To avoid huge allocations for very sparse tables, it fails when less than
+// half of the slice would be filled.
+func sliceWithHoles(goMap map[any]any) ([]any, bool) {
+	var maxKey int64
+	for key := range goMap {
+		i, ok := key.(int64)
+		if !ok || i < 1 {
+			return nil, false
+		}
+		maxKey = max(maxKey, i)
+	}
+	if maxKey > int64(len(goMap))*2 {
+		return nil, false
+	}
+
+	goSlice := make([]any, maxKey)
+	for key, value := range goMap {
+		goSlice[key.(int64)-1] = value
 	}
+	return goSlice, true
 }
@@ -0,0 +1,213 @@
+// callback.go
+
+package luasrc
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include "lua.h"
+
+// defined in bridge.go
+extern uintptr_t bridge_get_handle(lua_State* L);
+extern lua_Integer bridge_function_id(lua_State* L);
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// GoFunction is a Go function which can be called from Lua.
+//
+// Lua arguments are converted to Go values, and returned values are
+// converted back to Lua values. A non-nil error is raised as a Lua error.
+type GoFunction func(args []any) ([]any, error)
+
+// GoFunctionContext is a Go function which can be called from Lua,
+// receiving the context of the running operation.
+type GoFunctionContext func(ctx context.Context, args []any) ([]any, error)
+
+// function is an internal function called with the raw Lua state.
+// It returns the number of values pushed onto the stack.
+type function func(L *C.lua_State) (int, error)
+
+// stateOf returns the State which owns the given Lua state (or thread).
+func stateOf(L *C.lua_State) *State {
+	return cgo.Handle(C.bridge_get_handle(L)).Value().(*State)
+}
+
+// bridgeCallFunction is called from C when a registered function is called from Lua.
+// On error, it pushes the error message and returns -1.
+//
+//export bridgeCallFunction
+func bridgeCallFunction(L *C.lua_State) C.int {
+	s := stateOf(L)
+
+	fn, ok := s.funcs[int64(C.bridge_function_id(L))]
+	if !ok {
+		pushErrorString(L, "function is not registered anymore")
+		return -1
+	}
+
+	caller := s.caller
+	s.caller = L
+	n, err := callFunction(fn, L)
+	s.caller = caller
+	if err != nil {
+		pushErrorString(L, err.Error())
+		return -1
+	}
+	return C.int(n)
+}
+
+// callFunction calls a registered function, converting a panic in it to an error,
+// so that it is raised as a Lua error instead of unwinding through C.
+func callFunction(fn function, L *C.lua_State) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, fmt.Errorf("panic in Go function: %v", r)
+		}
+	}()
+
+	return fn(L)
+}
+
+// bridgeHook is called from C periodically while running Lua code.
+// When the running operation should be interrupted, it pushes the error message and returns 1.
+//
+//export bridgeHook
+func bridgeHook(L *C.lua_State) C.int {
+	s := stateOf(L)
+
+	// keep raising the error until the operation unwinds, so that it cannot be caught by `pcall`
+	if s.interrupted != "" {
+		pushErrorString(L, s.interrupted)
+		return 1
+	}
+	if C.lua_gethookcount(L) != C.int(s.hookCount) {
+		// (a coroutine left with the hook of an interrupted operation)
+		s.setHook(L, s.hookCount)
+	}
+
+	s.samplePeakMemory(L)
+
+	if max := s.opts.maxInstructions(); max > 0 {
+		s.instructions += int64(s.hookCount)
+		if s.instructions >= int64(max) {
+			return s.interrupt(L, fmt.Sprintf("instruction limit exceeded (limit: %d)", max))
+		}
+	}
+
+	if s.stopping.Load() {
+		s.stopped = true
+		return s.interrupt(L, "interrupted: stopped")
+	}
+
+	if s.ctx != nil {
+		if err := s.ctx.Err(); err != nil {
+			return s.interrupt(L, "interrupted: "+err.Error())
+		}
+	}
+	return 0
+}
+
+// interrupt pushes the error message for interrupting the running operation, and makes the hook
+// raise it again on every instruction until the operation unwinds. It returns 1 for bridgeHook.
+func (s *State) interrupt(L *C.lua_State, msg string) C.int {
+	s.interrupted = msg
+	s.setHook(L, 1)
+	if L != s.s {
+		s.setHook(s.s, 1)
+	}
+
+	pushErrorString(L, msg)
+	return 1
+}
+
+// bridgeLineHook is called from C on each line of Lua code executed, with a line hook.
+// When the line hook panics, it pushes the error message and returns 1.
+//
+//export bridgeLineHook
+func bridgeLineHook(L *C.lua_State, source *C.char, line C.int) (interrupted C.int) {
+	s := stateOf(L)
+	if s.lineHook == nil {
+		return 0
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			pushErrorString(L, fmt.Sprintf("panic in line hook: %v", r))
+			interrupted = 1
+		}
+	}()
+
+	s.lineHook(C.GoString(source), int(line))
+	return 0
+}
+
+// bridgePanic is called from C on an error outside of protected mode (e.g. from a `__newindex`
+// metamethod of the global table while setting a global variable), where Lua would abort
+// the process if the panic handler returned.
+//
+// Instead, it poisons the State, so that operations fail with ErrPoisoned, and blocks the worker
+// goroutine forever: unwinding the C stack is not possible from Go, so the lua_State and
+// the OS thread of the worker are leaked.
+//
+//export bridgePanic
+func bridgePanic(L *C.lua_State) {
+	s := stateOf(L)
+
+	msg := "unprotected error"
+	if C.lua_type(L, -1) == C.LUA_TSTRING {
+		msg = goString(L, -1)
+	}
+	if s.opts.Scheduler != nil {
+		s.opts.Scheduler.replaceWorker()
+	}
+	s.poison(fmt.Errorf("%w: %s", ErrPoisoned, msg))
+
+	select {}
+}
+
+// bridgeRead is called from C while loading Lua code from a reader, and reads the next chunk
+// of the code into buf. It returns 0 at the end of the code, or when the reader fails or panics
+// (keeping the error for loadReader).
+//
+//export bridgeRead
+func bridgeRead(h C.uintptr_t, buf *C.char, size C.size_t) (n C.size_t) {
+	cr := cgo.Handle(h).Value().(*chunkReader)
+
+	defer func() {
+		if r := recover(); r != nil {
+			cr.err = fmt.Errorf("panic in reader: %v", r)
+			n = 0
+		}
+	}()
+
+	b := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))
+	for {
+		read, err := cr.r.Read(b)
+		if read > 0 {
+			// return what was read, and get the error (if any) again on the next call
+			return C.size_t(read)
+		}
+		if err != nil {
+			if err != io.EOF {
+				cr.err = err
+			}
+			return 0
+		}
+	}
+}
+
+// pushErrorString pushes an error message onto the Lua stack.
+func pushErrorString(L *C.lua_State, msg string) {
+	cMsg := C.CString(msg)
+	defer C.free(unsafe.Pointer(cMsg))
+
+	C.lua_pushlstring(L, cMsg, C.size_t(len(msg)))
+}
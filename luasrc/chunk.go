@@ -0,0 +1,316 @@
+// chunk.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+// bridge_dump_buffer is a growing buffer for lua_dump.
+typedef struct {
+  char* data;
+  size_t len;
+  size_t cap;
+} bridge_dump_buffer;
+
+// bridge_dump_writer is a lua_Writer which appends to a bridge_dump_buffer.
+static int bridge_dump_writer(lua_State* L, const void* p, size_t sz, void* ud) {
+  bridge_dump_buffer* b = (bridge_dump_buffer*)ud;
+
+  if (b->len + sz > b->cap) {
+    size_t cap = b->cap > 0 ? b->cap * 2 : 1024;
+    char* data;
+    while (cap < b->len + sz) {
+      cap *= 2;
+    }
+    data = (char*)realloc(b->data, cap);
+    if (data == NULL) {
+      return 1;
+    }
+    b->data = data;
+    b->cap = cap;
+  }
+  memcpy(b->data + b->len, p, sz);
+  b->len += sz;
+  return 0;
+}
+
+// bridge_dump dumps the function on the top of the stack into the buffer.
+static int bridge_dump(lua_State* L, bridge_dump_buffer* b) {
+  return lua_dump(L, bridge_dump_writer, b, 0);
+}
+
+static int bridge_ref(lua_State* L) {
+  return luaL_ref(L, LUA_REGISTRYINDEX);
+}
+
+static void bridge_unref(lua_State* L, int ref) {
+  luaL_unref(L, LUA_REGISTRYINDEX, ref);
+}
+
+static int bridge_push_ref(lua_State* L, int ref) {
+  return lua_rawgeti(L, LUA_REGISTRYINDEX, ref);
+}
+*/
+import "C"
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"unsafe"
+)
+
+// bytecodeChunkName is the chunk name of functions loaded from bytecode.
+var bytecodeChunkName = C.CString("=bytecode")
+
+// bytecodeMode is the mode for loading only binary chunks.
+var bytecodeMode = C.CString("b")
+
+// Chunk is a compiled Lua chunk which can be called repeatedly without re-parsing its code.
+//
+// The compiled function is referenced from the registry until the chunk is released.
+type Chunk struct {
+	s   *State
+	ref C.int
+	gen int64
+}
+
+// Compile compiles a string of Lua code as a Chunk.
+//
+// The name is used as the chunk name in error messages and tracebacks
+// (e.g. "=script" for `script:1:`, or "@script.lua" for `script.lua:1:`).
+// If it is empty, the code itself is used, like Evaluate.
+func (s *State) Compile(ctx context.Context, code, name string) (*Chunk, error) {
+	if name == "" {
+		name = code
+	}
+
+	var chunk *Chunk
+
+	err := s.run(ctx, func() error {
+		if err := s.loadNamed(s.s, code, name); err != nil {
+			return err
+		}
+		chunk = &Chunk{s: s, ref: C.bridge_ref(s.s), gen: s.generation}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// Check parses a string of Lua code without running it, and returns its syntax error if any
+// (e.g. for linting scripts without side effects).
+func (s *State) Check(ctx context.Context, code string) error {
+	return s.run(ctx, func() error {
+		if err := s.load(s.s, code); err != nil {
+			return err
+		}
+		C.lua_settop(s.s, -2) // Pop the loaded function
+
+		return nil
+	})
+}
+
+// Call calls the chunk with given arguments (available as `...` in the chunk) and returns its results.
+func (c *Chunk) Call(ctx context.Context, args ...any) ([]any, error) {
+	return c.s.callRef(ctx, &c.ref, c.gen, "chunk was already released", args)
+}
+
+// callRef calls the function referenced from the registry with given arguments,
+// and returns its results. If the reference was released, it fails with the given message.
+//
+// The reference should be from the lua_State of the given generation (see Reset).
+func (s *State) callRef(ctx context.Context, ref *C.int, gen int64, released string, args []any) ([]any, error) {
+	var results []any
+
+	err := s.run(ctx, func() error {
+		L := s.s
+		top := C.lua_gettop(L)
+
+		if *ref == C.LUA_NOREF {
+			return fmt.Errorf("%s", released)
+		}
+		if gen != s.generation {
+			return fmt.Errorf("lua state was reset")
+		}
+		C.bridge_push_ref(L, *ref)
+
+		if err := checkStack(L, len(args)); err != nil {
+			C.lua_settop(L, top)
+			return err
+		}
+		for _, arg := range args {
+			if err := s.pushGoValue(L, arg); err != nil {
+				C.lua_settop(L, top)
+				return err
+			}
+		}
+
+		var err error
+		results, err = s.call(L, top, len(args))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Release releases the compiled function, so that it can be garbage-collected.
+//
+// Releasing a chunk more than once is a no-op.
+func (c *Chunk) Release(ctx context.Context) error {
+	return c.s.run(ctx, func() error {
+		if c.gen == c.s.generation {
+			C.bridge_unref(c.s.s, c.ref)
+		}
+		c.ref = C.LUA_NOREF
+
+		return nil
+	})
+}
+
+// Dump compiles a string of Lua code and returns its bytecode,
+// which can be loaded later with LoadBytecode.
+//
+// Note that bytecode is specific to the Lua version (and the platform, e.g. sizes of
+// integers and pointers), so it should be loaded with the same build which dumped it.
+// Loading bytecode is not safe for untrusted data: malicious bytecode can crash the process.
+func (s *State) Dump(ctx context.Context, code string) ([]byte, error) {
+	var data []byte
+
+	err := s.run(ctx, func() error {
+		if err := s.load(s.s, code); err != nil {
+			return err
+		}
+		defer C.lua_settop(s.s, -2)
+
+		var err error
+		data, err = dumpFunction(s.s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// dumpFunction returns the bytecode of the Lua function on the top of the stack.
+// This function must be called from within the locked OS thread.
+func dumpFunction(L *C.lua_State) ([]byte, error) {
+	var b C.bridge_dump_buffer
+	defer C.free(unsafe.Pointer(b.data))
+
+	if C.bridge_dump(L, &b) != 0 {
+		return nil, fmt.Errorf("failed to dump bytecode")
+	}
+	return C.GoBytes(unsafe.Pointer(b.data), C.int(b.len)), nil
+}
+
+// LoadBytecode loads bytecode (dumped with Dump) as a Chunk.
+//
+// Only binary chunks are accepted, so Lua source code is rejected with an error.
+// Sandboxed states reject binary chunks too, as they can crash the process.
+func (s *State) LoadBytecode(ctx context.Context, data []byte) (*Chunk, error) {
+	if s.opts.Sandboxed {
+		return nil, fmt.Errorf("failed to load bytecode: binary chunks are not allowed in sandboxed states")
+	}
+
+	var chunk *Chunk
+
+	err := s.run(ctx, func() error {
+		if err := s.loadBytecode(s.s, data); err != nil {
+			return err
+		}
+		chunk = &Chunk{s: s, ref: C.bridge_ref(s.s), gen: s.generation}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// loadBytecode loads bytecode as a function, and pushes it onto the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) loadBytecode(L *C.lua_State, data []byte) error {
+	cData := C.CBytes(data)
+	defer C.free(cData)
+
+	if status := C.luaL_loadbufferx(L, (*C.char)(cData), C.size_t(len(data)), bytecodeChunkName, bytecodeMode); status != C.LUA_OK {
+		err := s.loadError(L, status)
+		C.lua_settop(L, -2) // pop the error message
+		return err
+	}
+	return nil
+}
+
+// chunkKey is the key of a cached chunk: its name and code.
+type chunkKey struct {
+	name, code string
+}
+
+// chunkCache is an LRU cache of functions compiled by Execute and Evaluate,
+// referenced from the registry of the current lua_State.
+type chunkCache struct {
+	size    int
+	order   *list.List // of *cachedChunk, most recently used first
+	entries map[chunkKey]*list.Element
+}
+
+// cachedChunk is an entry of chunkCache.
+type cachedChunk struct {
+	key chunkKey
+	ref C.int
+}
+
+// newChunkCache returns a new chunkCache holding up to size functions,
+// or nil if size is not positive.
+func newChunkCache(size int) *chunkCache {
+	if size <= 0 {
+		return nil
+	}
+	return &chunkCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[chunkKey]*list.Element),
+	}
+}
+
+// loadCached loads a string of Lua code with the given chunk name like loadNamed,
+// reusing the function compiled from the same name and code if it is cached.
+// This function must be called from within the locked OS thread.
+func (s *State) loadCached(L *C.lua_State, code, name string) error {
+	c := s.chunks
+	if c == nil {
+		return s.loadNamed(L, code, name)
+	}
+
+	key := chunkKey{name: name, code: code}
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		C.bridge_push_ref(L, e.Value.(*cachedChunk).ref)
+		return nil
+	}
+
+	if err := s.loadNamed(L, code, name); err != nil {
+		return err
+	}
+	C.lua_pushvalue(L, -1)
+	c.entries[key] = c.order.PushFront(&cachedChunk{key: key, ref: C.bridge_ref(L)})
+
+	// evict the least recently used one
+	if c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Back()).(*cachedChunk)
+		delete(c.entries, oldest.key)
+		C.bridge_unref(L, oldest.ref)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+// clone.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+static void bridge_push_globals(lua_State* L) {
+  lua_pushglobaltable(L);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// cloneKind is the kind of a value in a snapshot of globals.
+type cloneKind int
+
+const (
+	cloneNil cloneKind = iota
+	cloneBoolean
+	cloneInteger
+	cloneNumber
+	cloneString
+	cloneBuiltin // a value of the standard libraries, referenced by its path (e.g. "table.insert")
+	cloneTable
+	cloneFunction
+)
+
+// cloneNode is a value in a snapshot of globals.
+// Tables and functions are shared by their ids, so that references (and cycles) are preserved.
+type cloneNode struct {
+	kind cloneKind
+
+	boolean bool
+	integer int64
+	number  float64
+	str     string // string value, or path of a builtin
+
+	id           int
+	keys, values []*cloneNode // entries of a table
+	meta         *cloneNode   // metatable of a table
+	bytecode     []byte       // bytecode of a function
+	upvalues     []*cloneNode // upvalues of a function
+}
+
+// Clone creates a new State (with the same options) which has copies of the globals defined by
+// scripts (ones whose names are not in a new State), e.g. for branching independent copies of
+// an expensive base environment.
+//
+// Tables are copied deeply (with their metatables), and Lua functions are copied as bytecode
+// with their upvalues (which are not shared between copied functions anymore). References to
+// values of the standard libraries (e.g. `local insert = table.insert`) are resolved in the new
+// State, but modifications of the standard libraries themselves are not copied.
+//
+// It fails if the globals hold values which cannot be copied: Go (or C) functions, userdata,
+// and coroutines. Settings made after the creation (e.g. SetOutput) are not copied either.
+func (s *State) Clone(ctx context.Context) (*State, error) {
+	clone := NewStateWithOptions(s.opts)
+
+	// names of the globals of a new State
+	var builtins map[string]bool
+	if err := clone.run(ctx, func() error {
+		builtins = clone.globalNames(clone.s)
+		return nil
+	}); err != nil {
+		clone.Close()
+		return nil, err
+	}
+
+	// snapshot the globals defined by scripts
+	var names []string
+	var snapshot []*cloneNode
+	if err := s.run(ctx, func() error {
+		var err error
+		names, snapshot, err = s.snapshotGlobals(s.s, builtins)
+		return err
+	}); err != nil {
+		clone.Close()
+		return nil, fmt.Errorf("failed to clone state: %w", err)
+	}
+
+	// and restore them
+	if err := clone.run(ctx, func() error {
+		return clone.restoreGlobals(clone.s, names, snapshot)
+	}); err != nil {
+		clone.Close()
+		return nil, fmt.Errorf("failed to clone state: %w", err)
+	}
+
+	return clone, nil
+}
+
+// globalNames returns the names of the global variables.
+// This function must be called from within the locked OS thread.
+func (s *State) globalNames(L *C.lua_State) map[string]bool {
+	names := make(map[string]bool)
+
+	C.bridge_push_globals(L)
+	C.lua_pushnil(L)
+	for C.lua_next(L, -2) != 0 {
+		if C.lua_type(L, -2) == C.LUA_TSTRING {
+			names[goString(L, -2)] = true
+		}
+		C.lua_settop(L, -2) // Pop the value
+	}
+	C.lua_settop(L, -2) // Pop the globals
+
+	return names
+}
+
+// snapshotter takes snapshots of Lua values.
+type snapshotter struct {
+	L        *C.lua_State
+	builtins map[unsafe.Pointer]string
+	seen     map[unsafe.Pointer]*cloneNode
+	lastID   int
+}
+
+// snapshotGlobals takes a snapshot of the global variables whose names are not in builtins.
+// This function must be called from within the locked OS thread.
+func (s *State) snapshotGlobals(L *C.lua_State, builtins map[string]bool) (names []string, nodes []*cloneNode, err error) {
+	top := C.lua_gettop(L)
+	defer C.lua_settop(L, top)
+
+	sn := &snapshotter{
+		L:        L,
+		builtins: make(map[unsafe.Pointer]string),
+		seen:     make(map[unsafe.Pointer]*cloneNode),
+	}
+
+	// paths of the values of the standard libraries (and the globals table itself)
+	C.bridge_push_globals(L)
+	sn.builtins[C.lua_topointer(L, -1)] = "_G"
+	for name := range builtins {
+		cName := C.CString(name)
+		C.lua_pushstring(L, cName)
+		C.free(unsafe.Pointer(cName))
+		C.lua_rawget(L, -2) // (raw, as `_G` may have metamethods)
+
+		sn.addBuiltin(-1, name)
+		if C.lua_type(L, -1) == C.LUA_TTABLE && name != "_G" {
+			C.lua_pushnil(L)
+			for C.lua_next(L, -2) != 0 {
+				if C.lua_type(L, -2) == C.LUA_TSTRING {
+					sn.addBuiltin(-1, name+"."+goString(L, -2))
+				}
+				C.lua_settop(L, -2) // Pop the value
+			}
+		}
+		C.lua_settop(L, -2) // Pop the field
+	}
+
+	// globals defined by scripts
+	C.lua_pushnil(L)
+	for C.lua_next(L, -2) != 0 {
+		if C.lua_type(L, -2) == C.LUA_TSTRING {
+			if name := goString(L, -2); !builtins[name] {
+				node, err := sn.snapshot(-1, name)
+				if err != nil {
+					return nil, nil, err
+				}
+				names = append(names, name)
+				nodes = append(nodes, node)
+			}
+		}
+		C.lua_settop(L, -2) // Pop the value
+	}
+
+	return names, nodes, nil
+}
+
+// addBuiltin records the path of the value (of a reference type) at the given index.
+func (sn *snapshotter) addBuiltin(idx C.int, path string) {
+	switch C.lua_type(sn.L, idx) {
+	case C.LUA_TTABLE, C.LUA_TFUNCTION, C.LUA_TUSERDATA, C.LUA_TTHREAD:
+		if ptr := C.lua_topointer(sn.L, idx); sn.builtins[ptr] == "" {
+			sn.builtins[ptr] = path
+		}
+	}
+}
+
+// snapshot takes a snapshot of the value at the given index, which is reached with path.
+func (sn *snapshotter) snapshot(idx C.int, path string) (*cloneNode, error) {
+	L := sn.L
+	idx = C.lua_absindex(L, idx)
+
+	switch t := C.lua_type(L, idx); t {
+	case C.LUA_TNIL:
+		return &cloneNode{kind: cloneNil}, nil
+	case C.LUA_TBOOLEAN:
+		return &cloneNode{kind: cloneBoolean, boolean: C.lua_toboolean(L, idx) != 0}, nil
+	case C.LUA_TNUMBER:
+		if C.lua_isinteger(L, idx) != 0 {
+			return &cloneNode{kind: cloneInteger, integer: int64(C.lua_tointegerx(L, idx, nil))}, nil
+		}
+		return &cloneNode{kind: cloneNumber, number: float64(C.lua_tonumberx(L, idx, nil))}, nil
+	case C.LUA_TSTRING:
+		return &cloneNode{kind: cloneString, str: goString(L, idx)}, nil
+	}
+
+	ptr := C.lua_topointer(L, idx)
+	if builtin, ok := sn.builtins[ptr]; ok {
+		return &cloneNode{kind: cloneBuiltin, str: builtin}, nil
+	}
+	if node, ok := sn.seen[ptr]; ok {
+		return node, nil
+	}
+	if C.lua_checkstack(L, 3) == 0 {
+		return nil, fmt.Errorf("'%s': stack overflow while cloning nested values", path)
+	}
+
+	switch t := C.lua_type(L, idx); {
+	case t == C.LUA_TTABLE:
+		sn.lastID++
+		node := &cloneNode{kind: cloneTable, id: sn.lastID}
+		sn.seen[ptr] = node
+
+		C.lua_pushnil(L)
+		for C.lua_next(L, idx) != 0 {
+			key, err := sn.snapshot(-2, path+"[key]")
+			if err != nil {
+				return nil, err
+			}
+			value, err := sn.snapshot(-1, fmt.Sprintf("%s.%s", path, keyPath(L, -2)))
+			if err != nil {
+				return nil, err
+			}
+			node.keys = append(node.keys, key)
+			node.values = append(node.values, value)
+			C.lua_settop(L, -2) // Pop the value
+		}
+
+		if C.lua_getmetatable(L, idx) != 0 {
+			meta, err := sn.snapshot(-1, path+"<metatable>")
+			if err != nil {
+				return nil, err
+			}
+			node.meta = meta
+			C.lua_settop(L, -2) // Pop the metatable
+		}
+		return node, nil
+	case t == C.LUA_TFUNCTION && C.lua_iscfunction(L, idx) == 0:
+		sn.lastID++
+		node := &cloneNode{kind: cloneFunction, id: sn.lastID}
+		sn.seen[ptr] = node
+
+		C.lua_pushvalue(L, idx)
+		bytecode, err := dumpFunction(L)
+		C.lua_settop(L, -2) // Pop the function
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", path, err)
+		}
+		node.bytecode = bytecode
+
+		for i := C.int(1); ; i++ {
+			name := C.lua_getupvalue(L, idx, i)
+			if name == nil {
+				break
+			}
+			upvalue, err := sn.snapshot(-1, fmt.Sprintf("%s<upvalue %s>", path, C.GoString(name)))
+			if err != nil {
+				return nil, err
+			}
+			node.upvalues = append(node.upvalues, upvalue)
+			C.lua_settop(L, -2) // Pop the upvalue
+		}
+		return node, nil
+	case t == C.LUA_TFUNCTION:
+		return nil, fmt.Errorf("'%s': cannot clone a Go (or C) function", path)
+	default:
+		return nil, fmt.Errorf("'%s': cannot clone a %s value", path, C.GoString(C.lua_typename(L, t)))
+	}
+}
+
+// keyPath returns the key at the given index for paths in error messages.
+func keyPath(L *C.lua_State, idx C.int) string {
+	switch C.lua_type(L, idx) {
+	case C.LUA_TSTRING:
+		return goString(L, idx)
+	case C.LUA_TNUMBER:
+		return fmt.Sprint(goNumber(L, idx)) // without converting the key in place
+	default:
+		return "[" + C.GoString(C.lua_typename(L, C.lua_type(L, idx))) + "]"
+	}
+}
+
+// restoreGlobals sets the global variables to values restored from their snapshots.
+// This function must be called from within the locked OS thread.
+func (s *State) restoreGlobals(L *C.lua_State, names []string, nodes []*cloneNode) error {
+	top := C.lua_gettop(L)
+	defer C.lua_settop(L, top)
+
+	// restored tables and functions, by their ids
+	C.lua_createtable(L, 0, 0)
+	cache := C.lua_gettop(L)
+
+	for i, name := range names {
+		if err := s.restore(L, cache, nodes[i]); err != nil {
+			return fmt.Errorf("'%s': %w", name, err)
+		}
+
+		cName := C.CString(name)
+		C.lua_setglobal(L, cName)
+		C.free(unsafe.Pointer(cName))
+	}
+	return nil
+}
+
+// restore pushes the value restored from its snapshot onto the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) restore(L *C.lua_State, cache C.int, node *cloneNode) error {
+	if C.lua_checkstack(L, 3) == 0 {
+		return fmt.Errorf("stack overflow while restoring nested values")
+	}
+
+	switch node.kind {
+	case cloneNil:
+		C.lua_pushnil(L)
+	case cloneBoolean:
+		C.lua_pushboolean(L, boolToInt(node.boolean))
+	case cloneInteger:
+		C.lua_pushinteger(L, C.lua_Integer(node.integer))
+	case cloneNumber:
+		C.lua_pushnumber(L, C.lua_Number(node.number))
+	case cloneString:
+		if err := s.pushGoValue(L, node.str); err != nil {
+			return err
+		}
+	case cloneBuiltin:
+		first, rest, _ := strings.Cut(node.str, ".")
+		C.bridge_push_globals(L)
+		if first != "_G" {
+			cFirst := C.CString(first)
+			C.lua_getfield(L, -1, cFirst)
+			C.free(unsafe.Pointer(cFirst))
+			C.lua_rotate(L, -2, 1)
+			C.lua_settop(L, -2) // Pop the globals
+		}
+		if rest != "" {
+			cRest := C.CString(rest)
+			C.lua_getfield(L, -1, cRest)
+			C.free(unsafe.Pointer(cRest))
+			C.lua_rotate(L, -2, 1)
+			C.lua_settop(L, -2) // Pop the holder
+		}
+	case cloneTable, cloneFunction:
+		if C.lua_rawgeti(L, cache, C.lua_Integer(node.id)) != C.LUA_TNIL {
+			return nil // already restored
+		}
+		C.lua_settop(L, -2) // Pop the nil
+
+		if node.kind == cloneTable {
+			C.lua_createtable(L, 0, C.int(len(node.keys)))
+		} else if err := s.loadBytecode(L, node.bytecode); err != nil {
+			return err
+		}
+		C.lua_pushvalue(L, -1)
+		C.lua_rawseti(L, cache, C.lua_Integer(node.id))
+
+		for i, key := range node.keys {
+			if err := s.restore(L, cache, key); err != nil {
+				return err
+			}
+			if err := s.restore(L, cache, node.values[i]); err != nil {
+				return err
+			}
+			C.lua_rawset(L, -3)
+		}
+		if node.meta != nil {
+			if err := s.restore(L, cache, node.meta); err != nil {
+				return err
+			}
+			C.lua_setmetatable(L, -2)
+		}
+		for i, upvalue := range node.upvalues {
+			if err := s.restore(L, cache, upvalue); err != nil {
+				return err
+			}
+			if C.lua_setupvalue(L, -2, C.int(i+1)) == nil {
+				C.lua_settop(L, -2) // Pop the upvalue
+			}
+		}
+	}
+	return nil
+}
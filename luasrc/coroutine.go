@@ -0,0 +1,77 @@
+// coroutine.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// coroutineGuard is a Lua chunk which wraps `coroutine.create` and `coroutine.wrap`
+// with a guard counting live coroutines.
+//
+// Created coroutines are kept in a weak table, so collected (or dead) ones are
+// not counted anymore when the count is refreshed on reaching the limit.
+// (Coroutines created with `coroutine.wrap` are counted until they are collected.)
+const coroutineGuard = `
+local max = ...
+if type(coroutine) ~= "table" then return end
+
+local create, wrap, status = coroutine.create, coroutine.wrap, coroutine.status
+local live = setmetatable({}, {__mode = "k"})
+local n = 0
+
+local function reserve()
+  if n >= max then
+    collectgarbage()
+
+    n = 0
+    for co, isThread in pairs(live) do
+      if isThread and status(co) == "dead" then
+        live[co] = nil
+      else
+        n = n + 1
+      end
+    end
+
+    if n >= max then
+      error(("too many coroutines (limit: %d)"):format(max), 3)
+    end
+  end
+end
+
+coroutine.create = function(f)
+  reserve()
+  local co = create(f)
+  live[co] = true
+  n = n + 1
+  return co
+end
+
+coroutine.wrap = function(f)
+  reserve()
+  local fn = wrap(f)
+  live[fn] = false
+  n = n + 1
+  return fn
+end
+`
+
+// guardCoroutines limits the number of live coroutines to max.
+// This function must be called from within the locked OS thread.
+func (s *State) guardCoroutines(max int) {
+	cCode := C.CString(coroutineGuard)
+	defer C.free(unsafe.Pointer(cCode))
+
+	if C.luaL_loadstring(s.s, cCode) == C.LUA_OK {
+		C.lua_pushinteger(s.s, C.lua_Integer(max))
+		C.lua_pcallk(s.s, 1, 0, 0, 0, nil)
+	}
+	C.lua_settop(s.s, 0)
+}
@@ -0,0 +1,119 @@
+// errors.go
+
+package luasrc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ErrStateClosed is returned by operations on a closed State.
+var ErrStateClosed = errors.New("lua state is closed")
+
+// ErrCloseTimeout is returned by State.CloseTimeout when the state is not closed in time.
+var ErrCloseTimeout = errors.New("timed out closing lua state")
+
+// ErrPoisoned is returned (wrapped with the Lua error message) by operations on a State which
+// was poisoned by an error outside of protected mode, which would have aborted the process.
+var ErrPoisoned = errors.New("lua state is poisoned")
+
+// ErrStopped is returned by operations interrupted with State.Stop.
+var ErrStopped = errors.New("lua state was stopped")
+
+// Sentinel errors for the kinds of LuaErrors, for use with errors.Is.
+var (
+	ErrSyntax  = errors.New("lua syntax error")
+	ErrRuntime = errors.New("lua runtime error")
+	ErrMemory  = errors.New("lua memory error")
+
+	// ErrStackOverflow matches runtime errors of runaway recursion (e.g. `local function f() return 1 + f() end`),
+	// which overflowed the Lua stack or the C stack. Such errors match ErrRuntime too.
+	ErrStackOverflow = errors.New("lua stack overflow")
+)
+
+// ErrorKind is the kind of a LuaError.
+type ErrorKind int
+
+// ErrorKind constants
+const (
+	KindSyntax  ErrorKind = iota // error while loading (compiling) Lua code
+	KindRuntime                  // error while running Lua code
+	KindMemory                   // memory allocation error
+)
+
+// String returns the name of the error kind.
+func (k ErrorKind) String() string {
+	switch k {
+	case KindSyntax:
+		return "syntax"
+	case KindRuntime:
+		return "runtime"
+	case KindMemory:
+		return "memory"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// LuaError is an error returned from Lua.
+type LuaError struct {
+	Kind      ErrorKind
+	Message   string
+	Traceback string // stack traceback (only for runtime errors)
+
+	// Line is the line number where a syntax error was found (only for syntax errors),
+	// parsed from the "chunkname:line: message" format of Message. It is 0 if unknown.
+	Line int
+
+	// Value is the error object (e.g. a table of `error({code = 42})`) converted to Go,
+	// for inspecting structured errors raised by scripts (only for runtime errors).
+	Value any
+}
+
+// errorLocation matches the location prefix of a Lua error message, like `[string "..."]:3: ` or `script.lua:3: `.
+var errorLocation = regexp.MustCompile(`^(?:\[string ".*?"\]|[^:\n]*):(\d+): `)
+
+// stackOverflow matches the messages of stack overflow errors, like `[string "..."]:1: stack overflow`
+// or `C stack overflow`.
+var stackOverflow = regexp.MustCompile(`(?:^|: )(?:C )?stack overflow$`)
+
+// errorLine returns the line number in the location prefix of a Lua error message, or 0 if there is none.
+func errorLine(msg string) int {
+	m := errorLocation.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	line, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return line
+}
+
+// Error returns the error message, e.g. "lua runtime error: [string \"...\"]:1: failed".
+func (e *LuaError) Error() string {
+	switch e.Kind {
+	case KindSyntax:
+		return "lua load error: " + e.Message
+	case KindMemory:
+		return "lua memory error: " + e.Message
+	}
+	return "lua runtime error: " + e.Message
+}
+
+// Is reports whether the error matches the sentinel error of its kind
+// (ErrSyntax, ErrRuntime, or ErrMemory), or ErrStackOverflow for stack overflows.
+func (e *LuaError) Is(target error) bool {
+	switch target {
+	case ErrStackOverflow:
+		return e.Kind == KindRuntime && stackOverflow.MatchString(e.Message)
+	case ErrSyntax:
+		return e.Kind == KindSyntax
+	case ErrRuntime:
+		return e.Kind == KindRuntime
+	case ErrMemory:
+		return e.Kind == KindMemory
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+// exit.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lualib.h"
+
+// bridge_push_os pushes the `os` table, returning 0 if the os library is not opened.
+static int bridge_push_os(lua_State* L) {
+  if (lua_getglobal(L, LUA_OSLIBNAME) != LUA_TTABLE) {
+    lua_pop(L, 1);
+    return 0;
+  }
+  return 1;
+}
+*/
+import "C"
+
+import (
+	"errors"
+)
+
+// errExitDisabled is raised (as a Lua error) when a script calls `os.exit`,
+// which would terminate the host process.
+var errExitDisabled = errors.New("os.exit is disabled")
+
+// cExit is the C string of the name of `os.exit`.
+var cExit = C.CString("exit")
+
+// disableExit replaces `os.exit` (if the os library is opened) with a function
+// which raises an error instead of terminating the host process.
+// This function must be called from within the locked OS thread.
+func (s *State) disableExit() {
+	if C.bridge_push_os(s.s) == 0 {
+		return
+	}
+	s.pushFunction(s.s, func(L *C.lua_State) (int, error) {
+		return 0, errExitDisabled
+	})
+	C.lua_setfield(s.s, -2, cExit)
+	C.lua_settop(s.s, -2) // Pop the os table
+}
@@ -0,0 +1,60 @@
+// explain.go
+
+package luasrc
+
+/*
+#include "lua.h"
+*/
+import "C"
+
+import (
+	"context"
+)
+
+// TraceCall is a record of a call to a registered Go function.
+type TraceCall struct {
+	Function string // name of the function (e.g. "new_id" or "metrics.inc")
+	Args     []any
+	Results  []any
+	Err      error
+}
+
+// Trace is a record of what a script did while being evaluated.
+type Trace struct {
+	// Calls are the calls to registered Go functions, in order.
+	Calls []TraceCall
+
+	// Results are the final results of the script.
+	Results []any
+
+	// Err is the final error of the script.
+	Err error
+}
+
+// EvaluateExplain executes a string of Lua code and returns its results,
+// along with a trace which records every call to registered Go functions
+// (with their arguments and results) and the final result.
+func (s *State) EvaluateExplain(ctx context.Context, code string) (results []any, trace Trace, err error) {
+	err = s.run(ctx, func() error {
+		s.trace = &trace
+		defer func() { s.trace = nil }()
+
+		top := C.lua_gettop(s.s)
+		if err := s.load(s.s, code); err != nil {
+			return err
+		}
+
+		var err error
+		results, err = s.call(s.s, top, 0)
+		return err
+	})
+
+	if ctx.Err() != nil {
+		// the operation might be still running, so don't touch the trace
+		return nil, Trace{Err: err}, err
+	}
+
+	trace.Results, trace.Err = results, err
+
+	return results, trace, err
+}
@@ -0,0 +1,180 @@
+// gc.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+static int bridge_gc(lua_State* L, int what) {
+  return lua_gc(L, what);
+}
+
+// bridge_gc_generational returns whether the garbage collector is in generational mode,
+// as the previous mode returned by switching to incremental mode (switching back if so).
+static int bridge_gc_generational(lua_State* L) {
+  if (lua_gc(L, LUA_GCINC, 0, 0, 0) != LUA_GCGEN) {
+    return 0;
+  }
+  lua_gc(L, LUA_GCGEN, 0, 0);
+  return 1;
+}
+
+static const char* gc_cycles_key = "lua-go.gc_cycles";
+
+static void bridge_push_gc_cycles_key(lua_State* L) {
+  lua_pushstring(L, gc_cycles_key);
+}
+
+static lua_Integer bridge_gc_cycles(lua_State* L) {
+  lua_Integer n;
+  lua_getfield(L, LUA_REGISTRYINDEX, gc_cycles_key);
+  n = lua_tointeger(L, -1);
+  lua_pop(L, 1);
+  return n;
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+)
+
+// GCMode is an operation of the Lua garbage collector for State.GC.
+type GCMode int
+
+// GCMode constants
+const (
+	GCCollect GCMode = iota // performs a full garbage-collection cycle
+	GCStep                  // performs a garbage-collection step
+	GCStop                  // stops the garbage collector
+	GCRestart               // restarts the garbage collector
+)
+
+// gcCounter is a Lua chunk which counts garbage collection cycles
+// with a sentinel object which is re-created whenever it is finalized.
+const gcCounter = `
+local registry, key = ...
+registry[key] = 0
+
+local mt = {}
+mt.__gc = function()
+  registry[key] = registry[key] + 1
+  setmetatable({}, mt)
+end
+setmetatable({}, mt)
+`
+
+// GCStats is the statistics of the Lua garbage collector.
+type GCStats struct {
+	// MemoryBytes is the total memory in use by Lua (in bytes).
+	MemoryBytes int64
+
+	// MemoryKB is the total memory in use by Lua (in kilobytes).
+	MemoryKB float64
+
+	// Mode is the mode of the garbage collector ("incremental" or "generational").
+	// Reading the generational mode performs a full collection, as entering the mode does.
+	Mode string
+
+	// Running is whether the garbage collector is running (not stopped).
+	Running bool
+
+	// Cycles is the number of garbage collection cycles (approximately counted
+	// with a finalizer-based sentinel) since the state was created.
+	Cycles int64
+
+	// PeakMemoryBytes is the high-water mark of memory in use by Lua (in bytes)
+	// during the last evaluation, sampled periodically while running Lua code.
+	PeakMemoryBytes int64
+}
+
+// GCStats returns the current statistics of the Lua garbage collector.
+func (s *State) GCStats(ctx context.Context) (GCStats, error) {
+	var stats GCStats
+
+	err := s.run(ctx, func() error {
+		stats.MemoryBytes = memoryBytes(s.s)
+		stats.MemoryKB = float64(stats.MemoryBytes) / 1024
+		stats.Running = C.bridge_gc(s.s, C.LUA_GCISRUNNING) != 0
+		stats.Cycles = int64(C.bridge_gc_cycles(s.s))
+		stats.PeakMemoryBytes = s.peakMemory
+
+		// (after the others, as it may perform a full collection)
+		stats.Mode = "incremental"
+		if C.bridge_gc_generational(s.s) != 0 {
+			stats.Mode = "generational"
+		}
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// GC controls the Lua garbage collector, like `collectgarbage` in Lua.
+func (s *State) GC(ctx context.Context, mode GCMode) error {
+	var what C.int
+	switch mode {
+	case GCCollect:
+		what = C.LUA_GCCOLLECT
+	case GCStep:
+		what = C.LUA_GCSTEP
+	case GCStop:
+		what = C.LUA_GCSTOP
+	case GCRestart:
+		what = C.LUA_GCRESTART
+	default:
+		return fmt.Errorf("unknown GC mode: %d", mode)
+	}
+
+	return s.run(ctx, func() error {
+		C.bridge_gc(s.s, what)
+		return nil
+	})
+}
+
+// MemoryKB returns the total memory in use by Lua (in kilobytes, rounded down).
+func (s *State) MemoryKB(ctx context.Context) (int, error) {
+	var kb int
+
+	err := s.run(ctx, func() error {
+		kb = int(C.bridge_gc(s.s, C.LUA_GCCOUNT))
+		return nil
+	})
+
+	return kb, err
+}
+
+// countGCCycles starts counting garbage collection cycles.
+// This function must be called from within the locked OS thread.
+func (s *State) countGCCycles() {
+	cCode := C.CString(gcCounter)
+	defer C.free(unsafe.Pointer(cCode))
+
+	if C.luaL_loadstring(s.s, cCode) == C.LUA_OK {
+		C.lua_pushvalue(s.s, C.LUA_REGISTRYINDEX)
+		C.bridge_push_gc_cycles_key(s.s)
+		C.lua_pcallk(s.s, 2, 0, 0, 0, nil)
+	}
+	C.lua_settop(s.s, 0)
+}
+
+// memoryBytes returns the total memory in use by Lua (in bytes).
+func memoryBytes(L *C.lua_State) int64 {
+	kb := int64(C.bridge_gc(L, C.LUA_GCCOUNT))
+	b := int64(C.bridge_gc(L, C.LUA_GCCOUNTB))
+
+	return kb*1024 + b
+}
+
+// samplePeakMemory updates the high-water mark of memory in use by Lua.
+// This function must be called from within the locked OS thread.
+func (s *State) samplePeakMemory(L *C.lua_State) {
+	if n := memoryBytes(L); n > s.peakMemory {
+		s.peakMemory = n
+	}
+}
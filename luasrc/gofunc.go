@@ -0,0 +1,105 @@
+// gofunc.go
+
+package luasrc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeFor[context.Context]()
+	errorType   = reflect.TypeFor[error]()
+)
+
+// SetGlobalFunc registers an ordinary Go function (e.g. `func(a, b int) int`, or
+// `func(string) (string, error)`) as a global Lua function with the given name,
+// converting its arguments and results with reflection.
+//
+// Lua arguments are converted to the parameter types like UnmarshalGlobal, and the results
+// are converted back to Lua values like SetGlobal. A wrong number of arguments, or arguments
+// which cannot be converted, raise Lua errors. When the last result is an error, a non-nil
+// one is raised as a Lua error (instead of being returned). When the first parameter is
+// a context.Context, it receives the context of the running operation (like GoFunctionContext).
+//
+// The function is called on the worker goroutine, so it must not call
+// methods of this State itself.
+func (s *State) SetGlobalFunc(ctx context.Context, name string, fn any) error {
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return fmt.Errorf("cannot register %T as a function", fn)
+	}
+	t := rv.Type()
+
+	// parameters to be converted from Lua arguments
+	var params []reflect.Type
+	withContext := t.NumIn() > 0 && t.In(0) == contextType
+	for i := range t.NumIn() {
+		if i > 0 || !withContext {
+			params = append(params, t.In(i))
+		}
+	}
+	withError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+
+	return s.RegisterFunction(ctx, name, func(args []any) ([]any, error) {
+		if err := checkArgCount(len(args), len(params), t.IsVariadic()); err != nil {
+			return nil, fmt.Errorf("bad call to '%s': %w", name, err)
+		}
+
+		in := make([]reflect.Value, 0, t.NumIn()+len(args))
+		if withContext {
+			in = append(in, reflect.ValueOf(context.WithValue(s.ctx, callerKey{}, s)))
+		}
+		for i, arg := range args {
+			typ := params[min(i, len(params)-1)]
+			if t.IsVariadic() && i >= len(params)-1 {
+				typ = typ.Elem()
+			}
+
+			v := reflect.New(typ).Elem()
+			if err := convertArg(arg, v); err != nil {
+				return nil, fmt.Errorf("bad argument #%d to '%s': %w", i+1, name, err)
+			}
+			in = append(in, v)
+		}
+
+		out := rv.Call(in)
+		if withError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+			out = out[:len(out)-1]
+		}
+
+		results := make([]any, len(out))
+		for i, v := range out {
+			results[i] = v.Interface()
+		}
+		return results, nil
+	})
+}
+
+// checkArgCount returns an error if the number of arguments does not match the number of parameters.
+func checkArgCount(args, params int, variadic bool) error {
+	switch {
+	case variadic && args < params-1:
+		return fmt.Errorf("wrong number of arguments (expected at least %d, got %d)", params-1, args)
+	case !variadic && args != params:
+		return fmt.Errorf("wrong number of arguments (expected %d, got %d)", params, args)
+	}
+	return nil
+}
+
+// convertArg converts a Go value (converted from Lua) into out, rejecting nil
+// for types which cannot be nil (e.g. numbers, or strings).
+func convertArg(value any, out reflect.Value) error {
+	if value == nil {
+		switch out.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Slice, reflect.Map:
+			return nil
+		}
+		return fmt.Errorf("%v expected, got nil", out.Type())
+	}
+	return unmarshalValue(value, out)
+}
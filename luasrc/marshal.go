@@ -0,0 +1,394 @@
+// marshal.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// luaField is an exported struct field with its key in Lua tables.
+type luaField struct {
+	index     int
+	key       string
+	omitEmpty bool
+}
+
+// luaFields returns the exported fields of a struct type with their keys in Lua tables.
+//
+// Keys are field names, or names in `lua:"..."` struct tags. Fields with `lua:"-"` are skipped,
+// and fields with `lua:",omitempty"` are omitted from Lua tables when they are empty.
+func luaFields(t reflect.Type) []luaField {
+	var fields []luaField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		key, opts, _ := strings.Cut(f.Tag.Get("lua"), ",")
+		if key == "-" && opts == "" {
+			continue
+		}
+		if key == "" {
+			key = f.Name
+		}
+		fields = append(fields, luaField{
+			index:     i,
+			key:       key,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+// isEmpty returns whether a value is empty for `omitempty`.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// pushReflectValue pushes a Go value of a type not handled by pushGoValue
+// (e.g. structs, typed slices, and named basic types) onto the Lua stack.
+//
+// Values nested deeper than Options.MaxTableDepth (e.g. self-referencing pointers) are rejected with an error.
+// This function must be called from within the locked OS thread.
+func (s *State) pushReflectValue(L *C.lua_State, rv reflect.Value, depth int) error {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		// dereference (recursively), pushing nil for nil pointers
+		if rv.IsNil() {
+			C.lua_pushnil(L)
+			return nil
+		}
+		return s.pushNestedValue(L, rv.Elem(), depth)
+	case reflect.Bool:
+		C.lua_pushboolean(L, boolToInt(rv.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		C.lua_pushinteger(L, C.lua_Integer(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		pushUnsigned(L, rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		C.lua_pushnumber(L, C.lua_Number(rv.Float()))
+	case reflect.String:
+		return s.pushGoValue(L, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			C.lua_pushnil(L)
+			return nil
+		}
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			pushBytes(L, rv.Bytes())
+			return nil
+		}
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		C.lua_createtable(L, C.int(rv.Len()), 0)
+		for i := range rv.Len() {
+			if err := s.pushNestedValue(L, rv.Index(i), depth+1); err != nil {
+				C.lua_settop(L, -2) // pop the table
+				return fmt.Errorf("index %d: %w", i, err)
+			}
+			C.lua_rawseti(L, -2, C.lua_Integer(i+1))
+		}
+	case reflect.Struct:
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		fields := luaFields(rv.Type())
+		C.lua_createtable(L, 0, C.int(len(fields)))
+		for _, f := range fields {
+			fv := rv.Field(f.index)
+			if f.omitEmpty && isEmpty(fv) {
+				continue
+			}
+			if err := s.pushNestedValue(L, fv, depth+1); err != nil {
+				C.lua_settop(L, -2) // pop the table
+				return fmt.Errorf("field %s: %w", f.key, err)
+			}
+			cKey := C.CString(f.key)
+			C.lua_setfield(L, -2, cKey)
+			C.free(unsafe.Pointer(cKey))
+		}
+	case reflect.Map:
+		switch rv.Type().Key().Kind() {
+		case reflect.String, reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if v, ok := rv.Interface().(map[any]any); ok {
+				return s.pushGoValueAt(L, v, depth)
+			}
+			return fmt.Errorf("unsupported Go type: %v (keys should be strings, integers, or booleans)", rv.Type())
+		}
+		if rv.IsNil() {
+			C.lua_pushnil(L)
+			return nil
+		}
+		if err := s.checkTableDepth(L, depth); err != nil {
+			return err
+		}
+		C.lua_createtable(L, 0, C.int(rv.Len()))
+		for iter := rv.MapRange(); iter.Next(); {
+			key := iter.Key()
+			if err := s.pushReflectValue(L, key, depth+1); err != nil {
+				C.lua_settop(L, -2) // pop the table
+				return fmt.Errorf("key %v: %w", key, err)
+			}
+			if err := s.pushNestedValue(L, iter.Value(), depth+1); err != nil {
+				C.lua_settop(L, -3) // pop the key and the table
+				return fmt.Errorf("value for key %v: %w", key, err)
+			}
+			C.lua_rawset(L, -3)
+		}
+	default:
+		return fmt.Errorf("unsupported Go type: %v", rv.Type())
+	}
+	return nil
+}
+
+// pushNestedValue pushes a Go value held by another one (e.g. an element, a struct field,
+// or a dereferenced pointer) like pushGoValueAt, so that values of types it handles
+// (e.g. *OrderedTable or map[any]any) are converted as they are at the top level.
+// This function must be called from within the locked OS thread.
+func (s *State) pushNestedValue(L *C.lua_State, rv reflect.Value, depth int) error {
+	if rv.CanInterface() {
+		return s.pushGoValueAt(L, rv.Interface(), depth)
+	}
+	return s.pushReflectValue(L, rv, depth)
+}
+
+// boolToInt converts a bool to a C int.
+func boolToInt(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// UnmarshalGlobal converts a global variable into the value pointed to by out
+// (e.g. a pointer to a struct), which is the inverse of SetGlobal.
+//
+// Tables are converted into structs (with the same keys as SetGlobal), slices, arrays, and maps.
+// Numbers are converted into numeric types as long as they fit without loss,
+// and nil leaves the destination as its zero value.
+func (s *State) UnmarshalGlobal(ctx context.Context, name string, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("failed to unmarshal global '%s': non-nil pointer is required, got %T", name, out)
+	}
+
+	var value any
+	if err := s.run(ctx, func() error {
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
+		defer C.lua_settop(s.s, -2)
+
+		var err error
+		value, err = s.toGoValue(s.s, -1)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if err := unmarshalValue(value, rv.Elem()); err != nil {
+		return fmt.Errorf("failed to unmarshal global '%s': %w", name, err)
+	}
+	return nil
+}
+
+// GetGlobalTable gets a global table with string keys (e.g. a config table) as map[string]any.
+//
+// It fails if the variable is not a table, or the table has keys which are not strings.
+// Nested tables are converted as usual (e.g. to map[any]any or []any).
+func (s *State) GetGlobalTable(ctx context.Context, name string) (map[string]any, error) {
+	var value any
+	if err := s.run(ctx, func() error {
+		if err := s.pushGlobal(s.s, name); err != nil {
+			return err
+		}
+		if C.lua_type(s.s, -1) != C.LUA_TTABLE {
+			typeName := C.GoString(C.lua_typename(s.s, C.lua_type(s.s, -1)))
+			C.lua_settop(s.s, -2)
+			return fmt.Errorf("global '%s' is not a table: %s", name, typeName)
+		}
+		defer C.lua_settop(s.s, -2)
+
+		var err error
+		if value, err = s.toGoValue(s.s, -1); err != nil {
+			return fmt.Errorf("failed to get global '%s': %w", name, err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	entries, _ := tableEntries(value)
+	table := make(map[string]any, len(entries))
+	for k, v := range entries {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("global '%s' has a non-string key: %v (%T)", name, k, k)
+		}
+		table[key] = v
+	}
+	return table, nil
+}
+
+// Unmarshal converts a Go value converted from Lua (e.g. a result of Evaluate) into the value
+// pointed to by out, with the same rules as UnmarshalGlobal.
+func Unmarshal(value, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("non-nil pointer is required, got %T", out)
+	}
+	return unmarshalValue(value, rv.Elem())
+}
+
+// unmarshalValue converts a Go value (converted from Lua) into out.
+func unmarshalValue(value any, out reflect.Value) error {
+	if value == nil {
+		out.SetZero()
+		return nil
+	}
+
+	switch out.Kind() {
+	case reflect.Interface:
+		if v := reflect.ValueOf(value); v.Type().AssignableTo(out.Type()) {
+			out.Set(v)
+			return nil
+		}
+	case reflect.Pointer:
+		if out.IsNil() {
+			out.Set(reflect.New(out.Type().Elem()))
+		}
+		return unmarshalValue(value, out.Elem())
+	case reflect.Bool:
+		if v, ok := value.(bool); ok {
+			out.SetBool(v)
+			return nil
+		}
+	case reflect.String:
+		if v, ok := value.(string); ok {
+			out.SetString(v)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if unmarshalNumber(value, out) {
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		if v, ok := value.(string); ok && out.Kind() == reflect.Slice && out.Type().Elem().Kind() == reflect.Uint8 {
+			out.SetBytes([]byte(v))
+			return nil
+		}
+		if v, ok := value.([]any); ok {
+			if out.Kind() == reflect.Slice {
+				out.Set(reflect.MakeSlice(out.Type(), len(v), len(v)))
+			} else if len(v) > out.Len() {
+				return fmt.Errorf("cannot unmarshal %d elements into %v", len(v), out.Type())
+			}
+			for i, elem := range v {
+				if err := unmarshalValue(elem, out.Index(i)); err != nil {
+					return fmt.Errorf("index %d: %w", i, err)
+				}
+			}
+			return nil
+		}
+	case reflect.Struct:
+		if entries, ok := tableEntries(value); ok {
+			for _, f := range luaFields(out.Type()) {
+				if elem, exists := entries[f.key]; exists {
+					if err := unmarshalValue(elem, out.Field(f.index)); err != nil {
+						return fmt.Errorf("field %s: %w", f.key, err)
+					}
+				}
+			}
+			return nil
+		}
+	case reflect.Map:
+		if entries, ok := tableEntries(value); ok {
+			m := reflect.MakeMapWithSize(out.Type(), len(entries))
+			for k, elem := range entries {
+				key := reflect.New(out.Type().Key()).Elem()
+				if err := unmarshalValue(k, key); err != nil {
+					return fmt.Errorf("key %v: %w", k, err)
+				}
+				val := reflect.New(out.Type().Elem()).Elem()
+				if err := unmarshalValue(elem, val); err != nil {
+					return fmt.Errorf("value for key %v: %w", k, err)
+				}
+				m.SetMapIndex(key, val)
+			}
+			out.Set(m)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("cannot unmarshal %v (%T) into %v", value, value, out.Type())
+}
+
+// tableEntries returns the entries of a table converted to Go (a map, an ordered table, or a slice).
+func tableEntries(value any) (map[any]any, bool) {
+	switch v := value.(type) {
+	case map[any]any:
+		return v, true
+	case *OrderedTable:
+		entries := make(map[any]any, v.Len())
+		for i, key := range v.keys {
+			entries[key] = v.values[i]
+		}
+		return entries, true
+	case []any:
+		entries := make(map[any]any, len(v))
+		for i, elem := range v {
+			entries[int64(i+1)] = elem
+		}
+		return entries, true
+	}
+	return nil, false
+}
+
+// unmarshalNumber converts a number into out of a numeric type, if it fits without loss.
+func unmarshalNumber(value any, out reflect.Value) bool {
+	switch v := value.(type) {
+	case int64:
+		switch {
+		case out.CanInt() && !out.OverflowInt(v):
+			out.SetInt(v)
+			return true
+		case out.CanUint() && v >= 0 && !out.OverflowUint(uint64(v)):
+			out.SetUint(uint64(v))
+			return true
+		case out.CanFloat():
+			out.SetFloat(float64(v))
+			return true
+		}
+	case float64:
+		switch {
+		case out.CanFloat():
+			out.SetFloat(v)
+			return true
+		case v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64:
+			return unmarshalNumber(int64(v), out)
+		}
+	}
+	return false
+}
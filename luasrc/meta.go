@@ -0,0 +1,102 @@
+// meta.go
+
+package luasrc
+
+/*
+#include <string.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+// maximum length of `__index` chains to follow
+#define BRIDGE_MAX_INDEX_CHAIN 100
+
+// bridge_resolve_table returns a plain copy of the table (1st argument) with its metatable resolved:
+// fields inherited from `__index` tables (e.g. of classes) are added unless overridden
+// (except for ones prefixed with "__", like metamethods), and
+// when it has a `__len` metamethod, elements 1..#t are read with `__index` honored.
+static int bridge_resolve_table(lua_State* L) {
+  lua_Integer i, n;
+  int depth;
+
+  lua_settop(L, 1);
+  lua_newtable(L); // 2: copy
+
+  // own fields
+  lua_pushnil(L);
+  while (lua_next(L, 1) != 0) {
+    lua_pushvalue(L, -2);
+    lua_insert(L, -2);
+    lua_rawset(L, 2);
+  }
+
+  // inherited fields
+  lua_pushvalue(L, 1); // 3: current table of the chain
+  for (depth = 0; depth < BRIDGE_MAX_INDEX_CHAIN; depth++) {
+    int t = luaL_getmetafield(L, 3, "__index");
+    if (t != LUA_TTABLE) {
+      if (t != LUA_TNIL) {
+        lua_pop(L, 1);
+      }
+      break;
+    }
+    lua_replace(L, 3);
+
+    lua_pushnil(L);
+    while (lua_next(L, 3) != 0) {
+      // skip metamethods of classes (e.g. `Class.__index = Class`)
+      if (lua_type(L, -2) == LUA_TSTRING && strncmp(lua_tostring(L, -2), "__", 2) == 0) {
+        lua_pop(L, 1);
+        continue;
+      }
+      lua_pushvalue(L, -2);
+      if (lua_rawget(L, 2) == LUA_TNIL) {
+        lua_pop(L, 1);
+        lua_pushvalue(L, -2);
+        lua_insert(L, -2);
+        lua_rawset(L, 2);
+      } else {
+        lua_pop(L, 2);
+      }
+    }
+  }
+
+  // elements with a custom length
+  if (luaL_getmetafield(L, 1, "__len") != LUA_TNIL) {
+    lua_pop(L, 1);
+    n = luaL_len(L, 1);
+    for (i = 1; i <= n; i++) {
+      lua_geti(L, 1, i);
+      lua_rawseti(L, 2, i);
+    }
+  }
+
+  lua_settop(L, 2);
+  return 1;
+}
+
+static void bridge_push_resolve_table(lua_State* L) {
+  lua_pushcfunction(L, bridge_resolve_table);
+}
+*/
+import "C"
+
+// pushResolvedTable pushes a plain copy of the table at the given index with its metatable
+// resolved (see Options.Metamethods), and returns whether it has pushed one.
+// Tables without metatables are not copied.
+// This function must be called from within the locked OS thread.
+func (s *State) pushResolvedTable(L *C.lua_State, idx C.int) (bool, error) {
+	if C.lua_getmetatable(L, idx) == 0 {
+		return false, nil
+	}
+	C.lua_settop(L, -2) // Pop the metatable
+
+	// resolve in protected mode, as metamethods can raise errors
+	idx = C.lua_absindex(L, idx)
+	C.bridge_push_resolve_table(L)
+	C.lua_pushvalue(L, idx)
+	if err := s.pcall(L, 1, 1); err != nil {
+		C.lua_settop(L, -2) // Pop the error object
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,103 @@
+// modulefs.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+
+static const char* module_fs_key = "lua-go.module_fs";
+
+// bridge_module_fs_installed returns whether the searcher for the module FS is installed.
+static int bridge_module_fs_installed(lua_State* L) {
+  int installed = lua_getfield(L, LUA_REGISTRYINDEX, module_fs_key) != LUA_TNIL;
+  lua_pop(L, 1);
+  return installed;
+}
+
+// bridge_set_module_fs_installed marks the searcher for the module FS as installed.
+static void bridge_set_module_fs_installed(lua_State* L) {
+  lua_pushboolean(L, 1);
+  lua_setfield(L, LUA_REGISTRYINDEX, module_fs_key);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// searcherInstaller is a Lua chunk which inserts a searcher into `package.searchers`,
+// right after the preload searcher (so that it takes precedence over files).
+const searcherInstaller = `
+local searcher = ...
+if type(package) ~= "table" or type(package.searchers) ~= "table" then
+  error("package library is not opened", 0)
+end
+
+local searchers = package.searchers
+for i = #searchers, 2, -1 do searchers[i + 1] = searchers[i] end
+searchers[2] = searcher
+`
+
+// SetModuleFS makes `require` resolve Lua modules in fsys (e.g. an embed.FS),
+// before searching `package.path`.
+//
+// A module named "a.b" is loaded from "a/b.lua" or "a/b/init.lua" in fsys.
+// Calling it again replaces the FS.
+func (s *State) SetModuleFS(ctx context.Context, fsys fs.FS) error {
+	return s.run(ctx, func() error {
+		s.moduleFS = fsys
+		if C.bridge_module_fs_installed(s.s) != 0 {
+			return nil
+		}
+
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top)
+
+		if err := s.load(s.s, searcherInstaller); err != nil {
+			return err
+		}
+		s.pushFunction(s.s, s.searchModuleFS)
+		if err := s.pcall(s.s, 1, 0); err != nil {
+			return err
+		}
+		C.bridge_set_module_fs_installed(s.s)
+		return nil
+	})
+}
+
+// searchModuleFS is a searcher for `package.searchers` which loads Lua modules from the module FS.
+//
+// It returns the loader and the path of the module, or a message when the module is not found.
+// This function must be called from within the locked OS thread.
+func (s *State) searchModuleFS(L *C.lua_State) (int, error) {
+	name := goString(L, 1)
+	if s.moduleFS == nil {
+		return 0, nil
+	}
+
+	base := strings.ReplaceAll(name, ".", "/")
+
+	var messages []string
+	for _, path := range []string{base + ".lua", base + "/init.lua"} {
+		code, err := fs.ReadFile(s.moduleFS, path)
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("\n\tno file '%s' in module FS", path))
+			continue
+		}
+
+		if err := s.loadNamed(L, string(code), "@"+path); err != nil {
+			return 0, fmt.Errorf("error loading module '%s' from module FS file '%s':\n\t%s", name, path, err.(*LuaError).Message)
+		}
+		if err := s.pushGoValue(L, path); err != nil {
+			return 0, err
+		}
+		return 2, nil
+	}
+
+	return 1, s.pushGoValue(L, strings.Join(messages, ""))
+}
@@ -0,0 +1,179 @@
+// options.go
+
+package luasrc
+
+// DefaultMaxTableDepth is the default maximum depth of nested tables
+// which are converted between Lua and Go.
+const DefaultMaxTableDepth = 1000
+
+// DefaultMaxCoroutines is the default maximum number of live coroutines
+// which scripts can create.
+const DefaultMaxCoroutines = 10000
+
+// DefaultChunkCacheSize is the default number of functions compiled by Execute and Evaluate
+// which are cached for reuse (see Options.ChunkCacheSize).
+const DefaultChunkCacheSize = 64
+
+// HoleMode specifies how tables with holes (nil elements) in their sequences are converted to Go values.
+//
+// Note that the length of such tables (with the `#` operator) is not well-defined in Lua:
+// for `{1, nil, 3}`, it can be either 1 or 3. The conversion does not depend on it,
+// but only on the keys present in the table.
+type HoleMode int
+
+// HoleMode constants
+const (
+	// HolesAsMap converts tables with holes to maps, e.g. `{1, nil, 3}` to map[any]any{1: 1, 3: 3}. (default)
+	HolesAsMap HoleMode = iota
+
+	// HolesAsNil converts tables with only positive integer keys to slices up to the highest key,
+	// filling holes with nil, e.g. `{1, nil, 3}` to []any{1, nil, 3}.
+	//
+	// Tables which would be less than half filled (e.g. `{[1000] = true}`) are still converted to maps.
+	HolesAsNil
+)
+
+// Options is a set of options for creating a State.
+type Options struct {
+	// MaxCoroutines is the maximum number of live coroutines which scripts can create
+	// with `coroutine.create` or `coroutine.wrap`.
+	//
+	// Zero means DefaultMaxCoroutines, and a negative value means no limit.
+	MaxCoroutines int
+
+	// Holes specifies how tables with holes in their sequences are converted to Go values.
+	Holes HoleMode
+
+	// EmptyTableAsMap converts empty tables to empty maps (map[any]any, or *OrderedTable with
+	// OrderedTables) instead of empty slices ([]any).
+	//
+	// Lua itself cannot distinguish an empty array from an empty object, so this chooses
+	// which one empty tables are taken for (e.g. when a schema expects objects).
+	EmptyTableAsMap bool
+
+	// OrderedTables converts tables which are not arrays to *OrderedTable (preserving
+	// the iteration order of their keys) instead of map[any]any.
+	OrderedTables bool
+
+	// NumbersAsFloat64 converts all Lua numbers (including integers) to float64, like `encoding/json`
+	// does, instead of converting integers to int64. Keys of tables are not affected.
+	//
+	// Note that integers beyond ±2^53 cannot be represented exactly as float64, so they lose precision.
+	NumbersAsFloat64 bool
+
+	// Metamethods resolves metatables when converting tables with them to Go values:
+	// fields inherited from `__index` tables (e.g. of class-like objects) are included
+	// (except for ones prefixed with "__", like metamethods), and elements 1..n are read with `__len` and `__index` when `__len` is defined.
+	//
+	// By default, only raw fields of tables are converted.
+	Metamethods bool
+
+	// FunctionRefs converts Lua functions to *LuaRef (callable from Go) instead of placeholder strings.
+	// Each LuaRef keeps its function from being garbage-collected until it is closed.
+	FunctionRefs bool
+
+	// MaxMemoryBytes is the maximum number of bytes which the state can allocate.
+	// Allocations beyond it fail while running Lua code, raising a memory error (KindMemory).
+	//
+	// Zero or a negative value means no limit.
+	MaxMemoryBytes int
+
+	// MaxInstructions is the maximum number of VM instructions which a single operation
+	// (e.g. Execute or Evaluate) can execute before being aborted with an error.
+	// It is checked periodically (every 1000 instructions at most), so the limit is approximate.
+	//
+	// Zero or a negative value means no limit.
+	MaxInstructions int
+
+	// MaxResults is the maximum number of values which a single call (e.g. Evaluate, or Resume)
+	// can return to Go. Calls returning more values (e.g. `return table.unpack(huge)`) fail with
+	// an error, instead of converting all of them.
+	//
+	// Zero or a negative value means no limit.
+	MaxResults int
+
+	// Sandboxed opens only the base library (without `dofile` and `loadfile`) and
+	// the standard libraries in Libraries, instead of all standard libraries.
+	// It also makes `load`, and loading code given to the State, reject binary chunks.
+	Sandboxed bool
+
+	// Libraries is the standard libraries to open when Sandboxed is set.
+	Libraries []Library
+
+	// AllowExit keeps the original `os.exit`, which terminates the host process.
+	// By default, it is replaced with a function raising an error ("os.exit is disabled").
+	AllowExit bool
+
+	// MaxTableDepth is the maximum depth of nested tables which are converted between Lua and Go.
+	// Converting values nested deeper fails with an error, instead of exhausting the stack.
+	//
+	// Zero means DefaultMaxTableDepth, and a negative value means no limit.
+	MaxTableDepth int
+
+	// ChunkCacheSize is the number of functions compiled from code strings by Execute and Evaluate
+	// (and their variants) which are cached, so that running the same code again skips compiling it.
+	// The least recently used ones are evicted first.
+	//
+	// Cached functions share their upvalue `_ENV`, so code which assigns to `_ENV` itself
+	// affects later runs of the same code. Zero means DefaultChunkCacheSize, and a negative value
+	// disables the cache.
+	ChunkCacheSize int
+
+	// Scheduler runs operations of the state on the worker threads of the Scheduler
+	// (shared with other states), instead of its own worker goroutine.
+	Scheduler *Scheduler
+
+	// SearchPath is the initial `package.path` (see State.SetSearchPath). Empty means the default.
+	SearchPath string
+
+	// CSearchPath is the initial `package.cpath` (see State.SetCSearchPath). Empty means the default.
+	CSearchPath string
+}
+
+// maxCoroutines returns the effective maximum number of live coroutines (0 for no limit).
+func (o Options) maxCoroutines() int {
+	switch {
+	case o.MaxCoroutines == 0:
+		return DefaultMaxCoroutines
+	case o.MaxCoroutines < 0:
+		return 0
+	}
+	return o.MaxCoroutines
+}
+
+// maxMemoryBytes returns the effective maximum number of bytes to allocate (0 for no limit).
+func (o Options) maxMemoryBytes() int {
+	return max(o.MaxMemoryBytes, 0)
+}
+
+// maxInstructions returns the effective maximum number of instructions per operation (0 for no limit).
+func (o Options) maxInstructions() int {
+	return max(o.MaxInstructions, 0)
+}
+
+// maxResults returns the effective maximum number of results per call (0 for no limit).
+func (o Options) maxResults() int {
+	return max(o.MaxResults, 0)
+}
+
+// maxTableDepth returns the effective maximum depth of nested tables (0 for no limit).
+func (o Options) maxTableDepth() int {
+	switch {
+	case o.MaxTableDepth == 0:
+		return DefaultMaxTableDepth
+	case o.MaxTableDepth < 0:
+		return 0
+	}
+	return o.MaxTableDepth
+}
+
+// chunkCacheSize returns the effective number of cached functions (0 for no cache).
+func (o Options) chunkCacheSize() int {
+	switch {
+	case o.ChunkCacheSize == 0:
+		return DefaultChunkCacheSize
+	case o.ChunkCacheSize < 0:
+		return 0
+	}
+	return o.ChunkCacheSize
+}
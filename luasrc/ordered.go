@@ -0,0 +1,55 @@
+// ordered.go
+
+package luasrc
+
+// OrderedTable is a Lua table converted to Go, preserving the iteration order of its keys.
+//
+// Tables are converted to OrderedTables instead of maps when Options.OrderedTables is set.
+// Note that Lua does not define the iteration order of tables: it is the order of `next`
+// at the time of the conversion, which usually (but not necessarily) matches the insertion order
+// for small tables built with string keys.
+type OrderedTable struct {
+	keys   []any
+	values []any
+	index  map[any]int
+}
+
+// newOrderedTable creates a new, empty OrderedTable.
+func newOrderedTable() *OrderedTable {
+	return &OrderedTable{
+		index: make(map[any]int),
+	}
+}
+
+// set sets the value for the key, appending the key if it does not exist yet.
+func (t *OrderedTable) set(key, value any) {
+	if i, ok := t.index[key]; ok {
+		t.values[i] = value
+		return
+	}
+	t.index[key] = len(t.keys)
+	t.keys = append(t.keys, key)
+	t.values = append(t.values, value)
+}
+
+// Len returns the number of entries in the table.
+func (t *OrderedTable) Len() int {
+	return len(t.keys)
+}
+
+// Get returns the value for the key, and whether the key exists.
+//
+// Keys are Go values converted from Lua, so integer keys are int64 and
+// float keys are float64.
+func (t *OrderedTable) Get(key any) (any, bool) {
+	i, ok := t.index[key]
+	if !ok {
+		return nil, false
+	}
+	return t.values[i], true
+}
+
+// Keys returns the keys of the table in order.
+func (t *OrderedTable) Keys() []any {
+	return append([]any(nil), t.keys...)
+}
@@ -0,0 +1,108 @@
+// output.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+*/
+import "C"
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// printWrapper is a Lua chunk which returns a `print` replacement,
+// converting arguments to strings with `tostring` (honoring `__tostring`)
+// and passing the line to the given writer function.
+const printWrapper = `
+local write = ...
+local tostring, select = tostring, select
+return function(...)
+  local line = ""
+  for i = 1, select("#", ...) do
+    if i > 1 then line = line .. "\t" end
+    line = line .. tostring((select(i, ...)))
+  end
+  write(line .. "\n")
+end
+`
+
+// SetOutput replaces the global `print` function with one which writes to w.
+//
+// Like the original `print`, arguments are converted with `tostring`,
+// separated by tabs, and followed by a newline.
+func (s *State) SetOutput(ctx context.Context, w io.Writer) error {
+	return s.run(ctx, func() error {
+		return s.setOutput(s.s, w)
+	})
+}
+
+// Run executes a string of Lua code, and returns what it printed with `print`.
+//
+// `print` is redirected (as with SetOutput) only for the duration of the call,
+// and the previous `print` is restored afterward, even on error.
+// On a script error, the output printed before the error is returned with it.
+func (s *State) Run(ctx context.Context, code string) (output string, err error) {
+	var buf strings.Builder
+
+	err = s.run(ctx, func() (err error) {
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top)
+
+		// Restore the previous print function (and writer)
+		if err := s.pushGlobal(s.s, "print"); err != nil {
+			return err
+		}
+		defer func(w io.Writer) {
+			s.output = w
+			C.lua_pushvalue(s.s, top+1)
+			if restoreErr := s.storeGlobal(s.s, "print"); err == nil {
+				err = restoreErr
+			}
+		}(s.output)
+
+		if err := s.setOutput(s.s, &buf); err != nil {
+			return err
+		}
+		if err := s.load(s.s, code); err != nil {
+			return err
+		}
+		return s.pcall(s.s, 0, C.LUA_MULTRET)
+	})
+	if err != nil && ctx.Err() != nil {
+		// The operation may still be running, so the buffer cannot be read
+		return "", err
+	}
+	return buf.String(), err
+}
+
+// setOutput replaces the global `print` function with one which writes to w.
+//
+// The replacement is created once per lua_State and kept in the registry,
+// and only the writer it writes to is swapped afterward.
+// This function must be called from within the locked OS thread.
+func (s *State) setOutput(L *C.lua_State, w io.Writer) error {
+	top := C.lua_gettop(L)
+	defer C.lua_settop(L, top)
+
+	if s.printRef == 0 {
+		if err := s.load(L, printWrapper); err != nil {
+			return err
+		}
+		s.pushFunction(L, func(L *C.lua_State) (int, error) {
+			_, err := io.WriteString(s.output, goString(L, 1))
+			return 0, err
+		})
+		if err := s.pcall(L, 1, 1); err != nil {
+			return err
+		}
+		s.printRef = C.luaL_ref(L, C.LUA_REGISTRYINDEX)
+	}
+
+	s.output = w
+	C.lua_rawgeti(L, C.LUA_REGISTRYINDEX, C.lua_Integer(s.printRef))
+	return s.storeGlobal(L, "print")
+}
@@ -0,0 +1,207 @@
+// path.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+// bridge_walk_path walks from the global table through the fields given as arguments,
+// and returns true, the table which holds the last field, and the value of it.
+// When a value on the way is not indexable, it returns false, the (1-based) position
+// of its field, and its type name.
+static int bridge_walk_path(lua_State* L) {
+  int n = lua_gettop(L);
+  int i;
+
+  lua_pushboolean(L, 1);
+  lua_pushnil(L);
+  lua_pushglobaltable(L);
+  for (i = 1; i <= n; i++) {
+    int t = lua_type(L, -1);
+    if (i > 1 && t != LUA_TTABLE && luaL_getmetafield(L, -1, "__index") == LUA_TNIL) {
+      lua_pushboolean(L, 0);
+      lua_pushinteger(L, i - 1);
+      lua_pushstring(L, lua_typename(L, t));
+      return 3;
+    }
+    if (i > 1 && t != LUA_TTABLE) {
+      lua_pop(L, 1); // pop the __index metafield
+    }
+    lua_replace(L, -2); // the holder
+    lua_pushvalue(L, -1);
+    lua_getfield(L, -1, lua_tostring(L, i));
+    lua_remove(L, -2);
+  }
+  return 3;
+}
+
+static void bridge_push_walk_path(lua_State* L) {
+  lua_pushcfunction(L, bridge_walk_path);
+}
+
+// bridge_set_field sets the field of the table (1st argument) with the key (2nd)
+// to the value (3rd), honoring `__newindex` metamethods.
+static int bridge_set_field(lua_State* L) {
+  lua_settop(L, 3);
+  lua_setfield(L, 1, lua_tostring(L, 2));
+  return 0;
+}
+
+static void bridge_push_set_field(lua_State* L) {
+  lua_pushcfunction(L, bridge_set_field);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// CallPath calls a Lua function by its dotted path from the global table
+// (e.g. "json.encode" or "a.b.c") with given arguments, and returns its results.
+//
+// When the last separator is ':' (e.g. "obj:render"), the function is called as a method,
+// with the table holding it as the implicit `self` argument.
+func (s *State) CallPath(ctx context.Context, path string, args ...any) ([]any, error) {
+	fields, method, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []any
+
+	err = s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+
+		// walk the path in protected mode, as indexing can call metamethods
+		C.bridge_push_walk_path(s.s)
+		for _, field := range fields {
+			cField := C.CString(field)
+			C.lua_pushstring(s.s, cField)
+			C.free(unsafe.Pointer(cField))
+		}
+		if err := s.pcall(s.s, len(fields), 3); err != nil {
+			C.lua_settop(s.s, top)
+			return err
+		}
+
+		// [true, holder, value] or [false, position, type name]
+		if C.lua_toboolean(s.s, top+1) == 0 {
+			pos := int(C.lua_tointegerx(s.s, top+2, nil))
+			typeName := goString(s.s, top+3)
+			C.lua_settop(s.s, top)
+			return fmt.Errorf("'%s' is not indexable (a %s value)", strings.Join(fields[:pos], "."), typeName)
+		}
+		if C.lua_type(s.s, top+3) != C.LUA_TFUNCTION {
+			typeName := C.GoString(C.lua_typename(s.s, C.lua_type(s.s, top+3)))
+			C.lua_settop(s.s, top)
+			return fmt.Errorf("'%s' is not a function (a %s value)", path, typeName)
+		}
+
+		C.lua_rotate(s.s, top+1, -1) // [holder, value, true]
+		C.lua_settop(s.s, -2)        // [holder, value]
+		C.lua_rotate(s.s, top+1, 1)  // [value, holder]
+		nargs := len(args)
+		if method {
+			nargs++ // holder as `self`
+		} else {
+			C.lua_settop(s.s, -2) // [value]
+		}
+
+		if err := checkStack(s.s, len(args)); err != nil {
+			C.lua_settop(s.s, top)
+			return err
+		}
+		for i, arg := range args {
+			if err := s.pushGoValue(s.s, arg); err != nil {
+				C.lua_settop(s.s, top)
+				return fmt.Errorf("argument %d: %w", i+1, err)
+			}
+		}
+
+		var err error
+		results, err = s.call(s.s, top, nargs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SetField sets a field of an existing table, reached by its dotted path from the global table
+// (e.g. "config" or "config.server"), to a Go value, without replacing the whole table.
+//
+// It fails if the path does not lead to a table.
+func (s *State) SetField(ctx context.Context, tablePath, key string, value any) error {
+	fields, method, err := splitPath(tablePath)
+	if err != nil {
+		return err
+	}
+	if method {
+		return fmt.Errorf("invalid path '%s': ':' is not allowed", tablePath)
+	}
+
+	return s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top)
+
+		// walk the path in protected mode, as indexing can call metamethods
+		C.bridge_push_walk_path(s.s)
+		for _, field := range fields {
+			cField := C.CString(field)
+			C.lua_pushstring(s.s, cField)
+			C.free(unsafe.Pointer(cField))
+		}
+		if err := s.pcall(s.s, len(fields), 3); err != nil {
+			return err
+		}
+
+		// [true, holder, value] or [false, position, type name]
+		if C.lua_toboolean(s.s, top+1) == 0 {
+			pos := int(C.lua_tointegerx(s.s, top+2, nil))
+			return fmt.Errorf("'%s' is not indexable (a %s value)", strings.Join(fields[:pos], "."), goString(s.s, top+3))
+		}
+		if C.lua_type(s.s, top+3) != C.LUA_TTABLE {
+			typeName := C.GoString(C.lua_typename(s.s, C.lua_type(s.s, top+3)))
+			return fmt.Errorf("'%s' is not a table (a %s value)", tablePath, typeName)
+		}
+
+		// set the field in protected mode, as it can call `__newindex`
+		C.bridge_push_set_field(s.s)
+		C.lua_pushvalue(s.s, top+3)
+		cKey := C.CString(key)
+		C.lua_pushstring(s.s, cKey)
+		C.free(unsafe.Pointer(cKey))
+		if err := s.pushGoValue(s.s, value); err != nil {
+			return fmt.Errorf("failed to set field '%s' of '%s': %w", key, tablePath, err)
+		}
+		return s.pcall(s.s, 3, 0)
+	})
+}
+
+// splitPath splits a path like "a.b.c" or "a.b:c" into its fields,
+// and returns whether it is a method call.
+func splitPath(path string) (fields []string, method bool, err error) {
+	prefix, name, method := strings.Cut(path, ":")
+	if method {
+		if strings.ContainsAny(name, ".:") {
+			return nil, false, fmt.Errorf("invalid path '%s': ':' should be the last separator", path)
+		}
+		fields = append(strings.Split(prefix, "."), name)
+	} else {
+		fields = strings.Split(path, ".")
+	}
+
+	for _, field := range fields {
+		if field == "" {
+			return nil, false, fmt.Errorf("invalid path '%s': empty field name", path)
+		}
+	}
+	return fields, method, nil
+}
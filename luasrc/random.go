@@ -0,0 +1,51 @@
+// random.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lualib.h"
+
+// bridge_get_randomseed returns `math.randomseed`, or nil if the math library is not opened.
+static int bridge_get_randomseed(lua_State* L) {
+  if (lua_getglobal(L, LUA_MATHLIBNAME) != LUA_TTABLE) {
+    lua_pushnil(L);
+    return 1;
+  }
+  lua_getfield(L, -1, "randomseed");
+  return 1;
+}
+
+static void bridge_push_get_randomseed(lua_State* L) {
+  lua_pushcfunction(L, bridge_get_randomseed);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+)
+
+// SeedRandom seeds the pseudo-random generator of `math.random` with the given seed,
+// for reproducible sequences (e.g. in tests).
+func (s *State) SeedRandom(ctx context.Context, seed int64) error {
+	return s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+		defer C.lua_settop(s.s, top)
+
+		// get the function in protected mode, as indexing can call metamethods
+		C.bridge_push_get_randomseed(s.s)
+		if err := s.pcall(s.s, 0, 1); err != nil {
+			return err
+		}
+		if C.lua_type(s.s, -1) == C.LUA_TNIL {
+			return fmt.Errorf("failed to seed random: math library is not opened")
+		}
+
+		// Lua 5.4 seeds with two integers
+		C.lua_pushinteger(s.s, C.lua_Integer(seed))
+		C.lua_pushinteger(s.s, 0)
+		return s.pcall(s.s, 2, 0)
+	})
+}
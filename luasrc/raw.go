@@ -0,0 +1,20 @@
+// raw.go
+
+package luasrc
+
+import (
+	"context"
+	"unsafe"
+)
+
+// WithRawState runs fn on the worker goroutine with the raw `lua_State*`,
+// for driving the Lua C API directly (e.g. for custom metatables or userdata).
+//
+// The pointer is valid only during fn, and must not be used concurrently or after fn returns.
+// Keeping the stack balanced is the caller's responsibility, and fn must not call
+// other methods of the State (which would deadlock).
+func (s *State) WithRawState(ctx context.Context, fn func(L unsafe.Pointer) error) error {
+	return s.run(ctx, func() error {
+		return fn(unsafe.Pointer(s.s))
+	})
+}
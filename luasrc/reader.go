@@ -0,0 +1,93 @@
+// reader.go
+
+package luasrc
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include "lua.h"
+
+// defined in callback.go
+extern size_t bridgeRead(uintptr_t h, char* buf, size_t size);
+
+// bridge_reader is the state of bridge_read: a handle to the Go reader, and a buffer for its chunks.
+typedef struct {
+  uintptr_t handle;
+  char* buf;
+  size_t size;
+} bridge_reader;
+
+// bridge_read is a lua_Reader which reads chunks from the Go reader.
+static const char* bridge_read(lua_State* L, void* ud, size_t* size) {
+  bridge_reader* r = (bridge_reader*)ud;
+  *size = bridgeRead(r->handle, r->buf, r->size);
+  return *size > 0 ? r->buf : NULL;
+}
+
+static int bridge_load_reader(lua_State* L, bridge_reader* r, const char* name, const char* mode) {
+  return lua_load(L, bridge_read, r, name, mode);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// readerBufferSize is the size of chunks read from readers for loading Lua code.
+const readerBufferSize = 64 * 1024
+
+// chunkReader is a reader of Lua code, and the error from it (if any).
+type chunkReader struct {
+	r   io.Reader
+	err error
+}
+
+// EvaluateReader evaluates Lua code read from r and returns its results, like EvaluateNamed.
+//
+// The code is loaded in chunks as it is read, without reading it into a single string first
+// (e.g. for large generated scripts). The name is used as the chunk name (see Compile),
+// and "=reader" is used if it is empty.
+//
+// An error from r is returned (wrapped) as it is, instead of a LuaError. Note that reading
+// from r is not interrupted when ctx is done.
+func (s *State) EvaluateReader(ctx context.Context, r io.Reader, name string) ([]any, error) {
+	if name == "" {
+		name = "=reader"
+	}
+
+	return s.evaluateWith(ctx, func() error {
+		return s.loadReader(s.s, r, name)
+	}, false)
+}
+
+// loadReader loads Lua code read from r as a function, and pushes it onto the stack.
+// This function must be called from within the locked OS thread.
+func (s *State) loadReader(L *C.lua_State, r io.Reader, name string) error {
+	cr := &chunkReader{r: r}
+	h := cgo.NewHandle(cr)
+	defer h.Delete()
+
+	buf := C.malloc(readerBufferSize)
+	defer C.free(buf)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	reader := C.bridge_reader{handle: C.uintptr_t(h), buf: (*C.char)(buf), size: readerBufferSize}
+	status := C.bridge_load_reader(L, &reader, cName, s.loadMode())
+	if cr.err != nil {
+		C.lua_settop(L, -2) // Pop the function (of the partially-read code) or the error message
+		return fmt.Errorf("failed to read Lua code: %w", cr.err)
+	}
+	if status != C.LUA_OK {
+		err := s.loadError(L, status)
+		C.lua_settop(L, -2) // Pop the error message
+		return err
+	}
+	return nil
+}
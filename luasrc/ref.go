@@ -0,0 +1,82 @@
+// ref.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+
+static int bridge_ref_value(lua_State* L, int idx) {
+  lua_pushvalue(L, idx);
+  return luaL_ref(L, LUA_REGISTRYINDEX);
+}
+
+static void bridge_unref_value(lua_State* L, int ref) {
+  luaL_unref(L, LUA_REGISTRYINDEX, ref);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"runtime"
+)
+
+// LuaRef is a reusable handle to a Lua function, referenced from the registry.
+//
+// Functions are converted to LuaRefs when Options.FunctionRefs is set.
+// A LuaRef should be closed when it is not needed anymore; otherwise the function is
+// released only when the LuaRef is garbage-collected (or the State is closed).
+type LuaRef struct {
+	s   *State
+	ref C.int
+	gen int64
+
+	cleanup runtime.Cleanup
+}
+
+// luaRefKey identifies a registry reference of a lua_State of a generation.
+type luaRefKey struct {
+	ref C.int
+	gen int64
+}
+
+// newLuaRef creates a new LuaRef for the Lua function at the given index.
+// This function must be called from within the locked OS thread.
+func (s *State) newLuaRef(L *C.lua_State, idx C.int) *LuaRef {
+	r := &LuaRef{s: s, ref: C.bridge_ref_value(L, idx), gen: s.generation}
+	r.cleanup = runtime.AddCleanup(r, func(ref luaRefKey) {
+		// release the reference on the worker goroutine, without blocking the cleanup goroutine
+		go s.run(context.Background(), func() error {
+			if ref.gen == s.generation {
+				C.bridge_unref_value(s.s, ref.ref)
+			}
+			return nil
+		})
+	}, luaRefKey{ref: r.ref, gen: r.gen})
+
+	return r
+}
+
+// Call calls the Lua function with given arguments and returns its results.
+func (r *LuaRef) Call(ctx context.Context, args ...any) ([]any, error) {
+	return r.s.callRef(ctx, &r.ref, r.gen, "function reference was already closed", args)
+}
+
+// Close releases the Lua function.
+//
+// Closing a LuaRef more than once is a no-op.
+func (r *LuaRef) Close() error {
+	return r.s.run(context.Background(), func() error {
+		if r.ref != C.LUA_NOREF {
+			r.cleanup.Stop()
+
+			if r.gen == r.s.generation {
+				C.bridge_unref_value(r.s.s, r.ref)
+			}
+			r.ref = C.LUA_NOREF
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+// repl.go
+
+package luasrc
+
+/*
+#include "lua.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// eofMark is the end of syntax error messages for incomplete code (e.g. an unclosed `function`).
+const eofMark = "<eof>"
+
+// EvaluateIncremental evaluates a (possibly partial) input of an interactive console, like the
+// standalone `lua` REPL: the input is evaluated as an expression (e.g. `1 + 2`) if it is one,
+// or as statements otherwise.
+//
+// When the input is incomplete (e.g. an unclosed `function`), it returns incomplete == true
+// without an error, so that the caller can read more lines and retry with all of them.
+func (s *State) EvaluateIncremental(ctx context.Context, code string) (results []any, incomplete bool, err error) {
+	err = s.run(ctx, func() error {
+		top := C.lua_gettop(s.s)
+
+		// try as an expression first, then as statements
+		if s.load(s.s, "return "+code) != nil {
+			if err := s.load(s.s, code); err != nil {
+				var luaErr *LuaError
+				if errors.As(err, &luaErr) && luaErr.Kind == KindSyntax && strings.HasSuffix(luaErr.Message, eofMark) {
+					incomplete = true
+					return nil
+				}
+				return err
+			}
+		}
+
+		// Reset the high-water mark of memory for this evaluation
+		s.peakMemory = memoryBytes(s.s)
+
+		var err error
+		results, err = s.call(s.s, top, 0)
+		s.samplePeakMemory(s.s)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return results, incomplete, nil
+}
+
+// EvaluateExpr evaluates a string of Lua code which may be a bare expression (e.g. `1 + 2`,
+// or `math.sqrt(16)`), and returns its results, like a calculator.
+//
+// The code is loaded as an expression (prepended with `return`) first, so that function calls
+// return their results, and as statements (like Evaluate) when it is not an expression.
+// Syntax errors are reported for the code as statements.
+func (s *State) EvaluateExpr(ctx context.Context, code string) ([]any, error) {
+	return s.evaluateWith(ctx, func() error {
+		err := s.loadCached(s.s, "return "+code, code)
+		var luaErr *LuaError
+		if errors.As(err, &luaErr) && luaErr.Kind == KindSyntax {
+			return s.loadCached(s.s, code, code)
+		}
+		return err
+	}, false)
+}
@@ -0,0 +1,123 @@
+// sandbox.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+#include "lualib.h"
+
+// bridge_open_library opens a standard library (except the base library) by its index,
+// in the order of Library constants.
+static void bridge_open_library(lua_State* L, int lib) {
+  static const luaL_Reg libs[] = {
+    {LUA_COLIBNAME, luaopen_coroutine},
+    {LUA_TABLIBNAME, luaopen_table},
+    {LUA_STRLIBNAME, luaopen_string},
+    {LUA_MATHLIBNAME, luaopen_math},
+    {LUA_UTF8LIBNAME, luaopen_utf8},
+    {LUA_IOLIBNAME, luaopen_io},
+    {LUA_OSLIBNAME, luaopen_os},
+    {LUA_LOADLIBNAME, luaopen_package},
+    {LUA_DBLIBNAME, luaopen_debug},
+  };
+
+  if (lib < 0 || lib >= (int)(sizeof(libs) / sizeof(libs[0]))) {
+    return;
+  }
+  luaL_requiref(L, libs[lib].name, libs[lib].func, 1);
+  lua_pop(L, 1);
+}
+
+// bridge_load_text calls the original `load` (the upvalue) with the mode "t",
+// so that binary chunks (which can be crafted to corrupt memory) are rejected.
+static int bridge_load_text(lua_State* L) {
+  int n = lua_gettop(L);
+
+  // (keep the 4th argument absent if it is, as an explicit nil env would replace _ENV)
+  if (n < 3) {
+    lua_settop(L, 3);
+    n = 3;
+  }
+  lua_pushliteral(L, "t");
+  lua_replace(L, 3);
+
+  lua_pushvalue(L, lua_upvalueindex(1));
+  lua_insert(L, 1);
+  lua_call(L, n, LUA_MULTRET);
+  return lua_gettop(L);
+}
+
+// bridge_open_base opens the base library without functions which access files,
+// and with `load` accepting only text chunks.
+static void bridge_open_base(lua_State* L) {
+  luaL_requiref(L, LUA_GNAME, luaopen_base, 1);
+  lua_pop(L, 1);
+
+  lua_pushnil(L);
+  lua_setglobal(L, "dofile");
+  lua_pushnil(L);
+  lua_setglobal(L, "loadfile");
+
+  lua_getglobal(L, "load");
+  lua_pushcclosure(L, bridge_load_text, 1);
+  lua_setglobal(L, "load");
+}
+*/
+import "C"
+
+// textMode is the mode for loading only text chunks.
+var textMode = C.CString("t")
+
+// Library is a standard Lua library which can be opened in a sandboxed state.
+type Library int
+
+// Library constants
+const (
+	LibCoroutine Library = iota // `coroutine`
+	LibTable                    // `table`
+	LibString                   // `string`
+	LibMath                     // `math`
+	LibUTF8                     // `utf8`
+	LibIO                       // `io`
+	LibOS                       // `os`
+	LibPackage                  // `package` and `require`
+	LibDebug                    // `debug`
+)
+
+// NewSandboxedState creates a new Lua state which opens only the base library
+// (without `dofile` and `loadfile`) and given standard libraries.
+//
+// Globals of the libraries which are not opened (e.g. `os`, `io`, `package`, `require`,
+// and `debug`) are nil, so scripts cannot access files or spawn processes with them.
+// Binary chunks are rejected both by `load` and by operations like Execute or Evaluate,
+// as crafted bytecode can corrupt memory.
+func NewSandboxedState(libs ...Library) *State {
+	return NewStateWithOptions(Options{
+		Sandboxed: true,
+		Libraries: libs,
+	})
+}
+
+// openLibraries opens the standard libraries as specified in the options.
+// This function must be called from within the locked OS thread.
+func (s *State) openLibraries() {
+	if !s.opts.Sandboxed {
+		C.luaL_openlibs(s.s)
+		return
+	}
+
+	C.bridge_open_base(s.s)
+	for _, lib := range s.opts.Libraries {
+		C.bridge_open_library(s.s, C.int(lib))
+	}
+}
+
+// loadMode returns the mode for loading Lua code given as text (e.g. to Execute or Evaluate):
+// text chunks only in sandboxed states, or both text and binary chunks otherwise.
+func (s *State) loadMode() *C.char {
+	if s.opts.Sandboxed {
+		return textMode
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// scheduler.go
+
+package luasrc
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Scheduler runs operations of many States on a fixed number of worker goroutines
+// (each locked to an OS thread), instead of one worker goroutine per State.
+//
+// A lua_State needs no thread affinity between operations, so operations of a State
+// can run on any of the workers, one at a time. While a State runs an operation,
+// it occupies a worker (e.g. a blocking Go function called from Lua blocks the worker),
+// so other States wait for a free one.
+type Scheduler struct {
+	ops  chan func()
+	done chan struct{}
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewScheduler creates a new Scheduler with the given number of worker threads
+// (runtime.GOMAXPROCS(0) if it is not positive).
+func NewScheduler(threads int) *Scheduler {
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+
+	sc := &Scheduler{
+		ops:  make(chan func()),
+		done: make(chan struct{}),
+	}
+
+	sc.wg.Add(threads)
+	for range threads {
+		go sc.work()
+	}
+
+	return sc
+}
+
+// work runs operations sent to the scheduler until it is closed.
+func (sc *Scheduler) work() {
+	defer sc.wg.Done()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for {
+		select {
+		case op := <-sc.ops:
+			op()
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// replaceWorker starts a new worker thread in place of the calling one,
+// which never returns (see bridgePanic).
+func (sc *Scheduler) replaceWorker() {
+	sc.wg.Add(1)
+	go sc.work()
+	sc.wg.Done()
+}
+
+// NewStateOnScheduler creates a new Lua state whose operations run on the given Scheduler,
+// and opens the standard libraries.
+func NewStateOnScheduler(sched *Scheduler) *State {
+	return NewStateWithOptions(Options{Scheduler: sched})
+}
+
+// Close stops the worker threads after their running operations, and waits until they stop.
+//
+// States on the Scheduler should be closed before it, as their operations
+// (including Close) cannot run afterward.
+func (sc *Scheduler) Close() {
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+	})
+	sc.wg.Wait()
+}
+
+// do runs op on a worker thread and waits until it returns.
+func (sc *Scheduler) do(op func()) {
+	finished := make(chan struct{})
+	select {
+	case sc.ops <- func() {
+		defer close(finished)
+		op()
+	}:
+		<-finished
+	case <-sc.done:
+	}
+}
+
+// dispatch sends op to a worker thread of the scheduler as long as ctx allows,
+// making sure that operations of the State run one at a time.
+// The turn of the State is released when op returns (or when it is not sent).
+func (s *State) dispatch(ctx context.Context, op func()) error {
+	// wait for the running operation of this State (if any)
+	select {
+	case s.turn <- struct{}{}:
+	case <-s.done:
+		return s.closedErr()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-s.done:
+		<-s.turn
+		return s.closedErr()
+	default:
+	}
+
+	select {
+	case s.opts.Scheduler.ops <- func() {
+		defer func() { <-s.turn }()
+		op()
+	}:
+		return nil
+	case <-s.opts.Scheduler.done:
+		<-s.turn
+		return ErrStateClosed
+	case <-ctx.Done():
+		<-s.turn
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+// search.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+#include "lualib.h"
+
+// bridge_set_package_field sets `package[field]` (1st argument) to the given string (2nd),
+// and returns whether the package library is opened.
+static int bridge_set_package_field(lua_State* L) {
+  lua_settop(L, 2);
+  if (lua_getglobal(L, LUA_LOADLIBNAME) != LUA_TTABLE) {
+    lua_pushboolean(L, 0);
+    return 1;
+  }
+  lua_pushvalue(L, 2);
+  lua_setfield(L, -2, lua_tostring(L, 1));
+  lua_pushboolean(L, 1);
+  return 1;
+}
+
+static void bridge_push_set_package_field(lua_State* L) {
+  lua_pushcfunction(L, bridge_set_package_field);
+}
+
+// bridge_unload_module sets `package.loaded[name]` to nil.
+static void bridge_unload_module(lua_State* L, const char* name) {
+  luaL_getsubtable(L, LUA_REGISTRYINDEX, LUA_LOADED_TABLE);
+  lua_pushnil(L);
+  lua_setfield(L, -2, name);
+  lua_pop(L, 1);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+)
+
+// SetSearchPath sets `package.path`, the search path of `require` for Lua modules,
+// e.g. "/path/to/modules/?.lua;/path/to/modules/?/init.lua".
+func (s *State) SetSearchPath(ctx context.Context, path string) error {
+	return s.run(ctx, func() error {
+		return s.setPackageField("path", path)
+	})
+}
+
+// SetCSearchPath sets `package.cpath`, the search path of `require` for C modules,
+// e.g. "/path/to/modules/?.so".
+func (s *State) SetCSearchPath(ctx context.Context, path string) error {
+	return s.run(ctx, func() error {
+		return s.setPackageField("cpath", path)
+	})
+}
+
+// UnloadModule removes a module from `package.loaded`, so that the next `require(name)`
+// loads it again (e.g. for reloading a module file which has been edited).
+//
+// Values already returned by `require` (e.g. the module stored in a variable) are not affected.
+func (s *State) UnloadModule(ctx context.Context, name string) error {
+	return s.run(ctx, func() error {
+		cName := C.CString(name)
+		defer C.free(unsafe.Pointer(cName))
+
+		C.bridge_unload_module(s.s, cName)
+
+		return nil
+	})
+}
+
+// setPackageField sets a string field of the `package` table.
+// This function must be called from within the locked OS thread.
+func (s *State) setPackageField(field, value string) error {
+	top := C.lua_gettop(s.s)
+	defer C.lua_settop(s.s, top)
+
+	// set the field in protected mode, as indexing can call metamethods
+	C.bridge_push_set_package_field(s.s)
+	cField := C.CString(field)
+	C.lua_pushstring(s.s, cField)
+	C.free(unsafe.Pointer(cField))
+	cValue := C.CString(value)
+	C.lua_pushstring(s.s, cValue)
+	C.free(unsafe.Pointer(cValue))
+	if err := s.pcall(s.s, 2, 1); err != nil {
+		return err
+	}
+
+	if C.lua_toboolean(s.s, -1) == 0 {
+		return fmt.Errorf("failed to set package.%s: package library is not opened", field)
+	}
+	return nil
+}
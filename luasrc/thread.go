@@ -0,0 +1,120 @@
+// thread.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+
+// bridge_new_thread creates a new thread, moves the function on the top of the stack onto it,
+// and returns the thread with a registry reference to it (keeping it from being collected).
+static lua_State* bridge_new_thread(lua_State* L, int* ref) {
+  lua_State* co = lua_newthread(L);
+  lua_rotate(L, -2, 1); // [thread, function]
+  lua_xmove(L, co, 1);
+  *ref = luaL_ref(L, LUA_REGISTRYINDEX);
+  return co;
+}
+
+static void bridge_unref_thread(lua_State* L, int ref) {
+  luaL_unref(L, LUA_REGISTRYINDEX, ref);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+)
+
+// Coroutine is a Lua coroutine (thread) which is resumed step by step from Go,
+// e.g. for generators or cooperative tasks.
+//
+// The thread is referenced from the registry until the coroutine is closed.
+type Coroutine struct {
+	s    *State
+	co   *C.lua_State
+	ref  C.int
+	gen  int64
+	done bool
+}
+
+// NewCoroutine loads a string of Lua code as the body of a new coroutine.
+//
+// The code is not run until the coroutine is resumed, and arguments of the first
+// Resume are available as `...` in the code.
+func (s *State) NewCoroutine(ctx context.Context, code string) (*Coroutine, error) {
+	var c *Coroutine
+
+	err := s.run(ctx, func() error {
+		if err := s.load(s.s, code); err != nil {
+			return err
+		}
+
+		c = &Coroutine{s: s, gen: s.generation}
+		c.co = C.bridge_new_thread(s.s, &c.ref)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Resume resumes the coroutine with given arguments (passed to the code on the first call,
+// or returned from `coroutine.yield` afterward).
+//
+// It returns the yielded values with done == false, or the returned values with done == true
+// when the coroutine has finished. After an error, the coroutine cannot be resumed again.
+func (c *Coroutine) Resume(ctx context.Context, args ...any) (results []any, done bool, err error) {
+	err = c.s.run(ctx, func() error {
+		if c.ref == C.LUA_NOREF {
+			return fmt.Errorf("coroutine was already closed")
+		}
+		if c.gen != c.s.generation {
+			return fmt.Errorf("lua state was reset")
+		}
+		if c.done {
+			return fmt.Errorf("cannot resume dead coroutine")
+		}
+
+		if err := checkStack(c.co, len(args)); err != nil {
+			return err
+		}
+		for i, arg := range args {
+			if err := c.s.pushGoValue(c.co, arg); err != nil {
+				C.lua_settop(c.co, -C.int(i)-1) // Pop pushed arguments
+				return fmt.Errorf("argument %d: %w", i+1, err)
+			}
+		}
+
+		var yielded bool
+		var resumeErr error
+		results, yielded, resumeErr = c.s.resume(c.s.s, c.co, len(args))
+		c.done = !yielded
+		done = c.done
+
+		return resumeErr
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return results, done, nil
+}
+
+// Close releases the coroutine, so that it can be garbage-collected.
+//
+// Closing a coroutine more than once is a no-op.
+func (c *Coroutine) Close() error {
+	return c.s.run(context.Background(), func() error {
+		if c.ref != C.LUA_NOREF {
+			if c.gen == c.s.generation {
+				C.bridge_unref_thread(c.s.s, c.ref)
+			}
+			c.ref = C.LUA_NOREF
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+// thunk.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+static const char* thunks_key = "lua-go.thunks";
+
+// bridge_push_thunks pushes the table which holds uncalled thunks.
+static void bridge_push_thunks(lua_State* L) {
+  luaL_getsubtable(L, LUA_REGISTRYINDEX, thunks_key);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+)
+
+// Thunk is a one-shot handle to a Lua function.
+//
+// Instead of taking its own registry reference, a thunk is parked in a single
+// table shared by all thunks of the State, and its slot is released on the
+// first Call. It is meant for the common "return a callback, call it once" pattern.
+type Thunk struct {
+	s  *State
+	id int64
+}
+
+// newThunk creates a new thunk for the Lua function at the given index.
+// This function must be called from within the locked OS thread.
+func (s *State) newThunk(L *C.lua_State, idx C.int) *Thunk {
+	idx = C.lua_absindex(L, idx)
+
+	s.lastThunkID++
+
+	C.bridge_push_thunks(L)
+	C.lua_pushvalue(L, idx)
+	C.lua_rawseti(L, -2, C.lua_Integer(s.lastThunkID))
+	C.lua_settop(L, -2) // pop the thunks table
+
+	return &Thunk{s: s, id: s.lastThunkID}
+}
+
+// Call calls the Lua function with given arguments and returns its results.
+//
+// The function is released after the call, so a thunk can be called only once.
+func (t *Thunk) Call(ctx context.Context, args ...any) ([]any, error) {
+	var results []any
+
+	err := t.s.run(ctx, func() error {
+		L := t.s.s
+		top := C.lua_gettop(L)
+
+		// take the function out of the thunks table, releasing its slot
+		C.bridge_push_thunks(L)
+		C.lua_rawgeti(L, -1, C.lua_Integer(t.id))
+		C.lua_pushnil(L)
+		C.lua_rawseti(L, -3, C.lua_Integer(t.id))
+		C.lua_rotate(L, -2, 1)
+		C.lua_settop(L, -2) // pop the thunks table
+
+		if C.lua_type(L, -1) != C.LUA_TFUNCTION {
+			C.lua_settop(L, top)
+			return fmt.Errorf("thunk was already called or released")
+		}
+
+		if err := checkStack(L, len(args)); err != nil {
+			C.lua_settop(L, top)
+			return err
+		}
+		for _, arg := range args {
+			if err := t.s.pushGoValue(L, arg); err != nil {
+				C.lua_settop(L, top)
+				return err
+			}
+		}
+
+		var err error
+		results, err = t.s.call(L, top, len(args))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Release releases the Lua function without calling it.
+func (t *Thunk) Release(ctx context.Context) error {
+	return t.s.run(ctx, func() error {
+		C.bridge_push_thunks(t.s.s)
+		C.lua_pushnil(t.s.s)
+		C.lua_rawseti(t.s.s, -2, C.lua_Integer(t.id))
+		C.lua_settop(t.s.s, -2)
+
+		return nil
+	})
+}
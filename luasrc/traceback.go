@@ -0,0 +1,54 @@
+// traceback.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+
+// bridge_push_call_stack pushes a traceback of the current call stack.
+static void bridge_push_call_stack(lua_State* L) {
+  luaL_traceback(L, L, NULL, 0);
+}
+*/
+import "C"
+
+import (
+	"context"
+)
+
+// callerKey is the key of the context value given to GoFunctionContext,
+// which marks that the context belongs to a running Go function of the State.
+type callerKey struct{}
+
+// Traceback returns a traceback of the current Lua call stack (e.g. for logging).
+//
+// When called with the context given to a GoFunctionContext (from within the function),
+// it returns the stack of the Lua code calling the function. Otherwise, as no Lua code is
+// running between operations, the traceback has no frames.
+func (s *State) Traceback(ctx context.Context) (string, error) {
+	if ctx.Value(callerKey{}) == s && s.caller != nil {
+		// already on the worker goroutine, so running another operation would deadlock
+		return traceback(s.caller), nil
+	}
+
+	var tb string
+
+	err := s.run(ctx, func() error {
+		tb = traceback(s.s)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tb, nil
+}
+
+// traceback returns a traceback of the call stack of the given Lua state (or thread).
+// This function must be called from within the locked OS thread.
+func traceback(L *C.lua_State) string {
+	C.bridge_push_call_stack(L)
+	defer C.lua_settop(L, -2)
+
+	return goString(L, -1)
+}
@@ -0,0 +1,141 @@
+// tracked.go
+
+package luasrc
+
+/*
+#include "lua.h"
+#include "lauxlib.h"
+
+static void bridge_push_globals(lua_State* L) {
+  lua_pushglobaltable(L);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+)
+
+// trackedEnv is a Lua chunk which builds an environment for tracking writes
+// to the given global variables.
+//
+// Writes to tracked globals are forwarded to the global table and recorded.
+// Tracked globals holding tables are wrapped with proxy tables, so that writes
+// to their fields are also recorded (shallowly).
+//
+// It returns the environment and the table of mutated global names.
+const trackedEnv = `
+local G, names = ...
+local mutated, proxies, originals = {}, {}, setmetatable({}, {__mode = "k"})
+
+local function proxy(name, t)
+  local p = setmetatable({}, {
+    __index = t,
+    __newindex = function(_, k, v)
+      if originals[v] then v = originals[v] end
+      t[k] = v
+      mutated[name] = true
+    end,
+    __len = function() return #t end,
+    __pairs = function() return next, t, nil end,
+  })
+  originals[p] = t
+  return p
+end
+
+for name in pairs(names) do
+  if type(G[name]) == "table" then proxies[name] = proxy(name, G[name]) end
+end
+
+local env = setmetatable({}, {
+  __index = function(_, k)
+    local p = proxies[k]
+    if p then return p end
+    return G[k]
+  end,
+  __newindex = function(_, k, v)
+    if originals[v] then v = originals[v] end
+    if names[k] then
+      mutated[k] = true
+      proxies[k] = type(v) == "table" and proxy(k, v) or nil
+    end
+    G[k] = v
+  end,
+})
+
+return env, mutated
+`
+
+// EvaluateTracked executes a string of Lua code and returns its results,
+// along with the new values of the given global variables which were mutated
+// (reassigned, or their fields written) by the code.
+//
+// Writes to fields of tracked tables are tracked shallowly: writes to
+// the fields of nested tables are not recorded.
+func (s *State) EvaluateTracked(ctx context.Context, code string, tracked ...string) (results []any, mutations map[string]any, err error) {
+	err = s.run(ctx, func() error {
+		L := s.s
+		top := C.lua_gettop(L)
+
+		if err := s.load(L, code); err != nil {
+			return err
+		}
+
+		// build the tracking environment
+		if err := s.load(L, trackedEnv); err != nil {
+			C.lua_settop(L, top)
+			return err
+		}
+		C.bridge_push_globals(L)
+		C.lua_createtable(L, 0, C.int(len(tracked)))
+		for _, name := range tracked {
+			if err := s.pushGoValue(L, name); err != nil {
+				C.lua_settop(L, top)
+				return fmt.Errorf("tracked global '%s': %w", name, err)
+			}
+			C.lua_pushboolean(L, 1)
+			C.lua_rawset(L, -3)
+		}
+		if err := s.pcall(L, 2, 2); err != nil {
+			C.lua_settop(L, top)
+			return err
+		}
+
+		// set the environment as the chunk's _ENV, keeping the mutated names table below the chunk
+		C.lua_rotate(L, top+1, 1)
+		C.lua_setupvalue(L, top+2, 1)
+
+		var err error
+		if results, err = s.call(L, top+1, 0); err != nil {
+			C.lua_settop(L, top)
+			return err
+		}
+
+		// collect the new values of mutated globals (with raw gets, as metamethods of the global table
+		// cannot be called outside of protected mode)
+		mutations = map[string]any{}
+		C.lua_pushnil(L)
+		for C.lua_next(L, top+1) != 0 {
+			C.lua_settop(L, -2) // pop the value
+			name := goString(L, -1)
+			C.bridge_push_globals(L)
+			C.lua_pushvalue(L, -2)
+			C.lua_rawget(L, -2)
+			value, err := s.toGoValue(L, -1)
+			if err != nil {
+				C.lua_settop(L, top)
+				return fmt.Errorf("mutation of '%s': %w", name, err)
+			}
+			mutations[name] = value
+			C.lua_settop(L, -3) // keep the key for the next iteration
+		}
+		C.lua_settop(L, top)
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, mutations, nil
+}
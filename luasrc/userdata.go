@@ -0,0 +1,150 @@
+// userdata.go
+
+package luasrc
+
+/*
+#include <stdlib.h>
+#include "lua.h"
+#include "lauxlib.h"
+
+// object_marker is the key (as a light userdata) which marks metatables of Go objects,
+// which scripts cannot forge.
+static const char object_marker = 0;
+
+// bridge_new_object pushes a new userdata holding the id of a Go object.
+static void bridge_new_object(lua_State* L, lua_Integer id) {
+  lua_Integer* p = (lua_Integer*)lua_newuserdatauv(L, sizeof(lua_Integer), 0);
+  *p = id;
+}
+
+// bridge_object_id returns the id of the Go object held by the userdata at the given index,
+// or 0 if it is not a userdata created with bridge_new_object (with a marked metatable).
+static lua_Integer bridge_object_id(lua_State* L, int idx) {
+  lua_Integer* p = (lua_Integer*)lua_touserdata(L, idx);
+  lua_Integer id = 0;
+
+  idx = lua_absindex(L, idx);
+
+  if (p == NULL || lua_type(L, idx) != LUA_TUSERDATA || !lua_getmetatable(L, idx)) {
+    return 0;
+  }
+  if (lua_rawgetp(L, -1, &object_marker) == LUA_TBOOLEAN && lua_rawlen(L, idx) == sizeof(lua_Integer)) {
+    id = *p;
+  }
+  lua_pop(L, 2);
+  return id;
+}
+
+// bridge_mark_object_metatable marks the table on the top of the stack as a metatable of Go objects.
+static void bridge_mark_object_metatable(lua_State* L) {
+  lua_pushboolean(L, 1);
+  lua_rawsetp(L, -2, &object_marker);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+)
+
+// goObject is a Go object exposed as userdata, with the ids of the functions in its metatable
+// (released along with it).
+type goObject struct {
+	value any
+	funcs []int64
+}
+
+// C strings of metatable fields for Go objects (other than `__index`)
+var (
+	cGC       = C.CString("__gc")
+	cTypeName = C.CString("__name")
+)
+
+// PushUserdata exposes an opaque Go object (e.g. a database handle) to Lua as a userdata
+// in the global variable with the given name, with methods called like `obj:method(...)`.
+//
+// Methods receive the object as self, and arguments after it. The object is referenced from
+// the State until the userdata is garbage-collected, and userdata values passed back to Go
+// (e.g. as arguments of Go functions, or results of Evaluate) are converted to the object.
+// As methods are called on the worker goroutine, they must not call methods of this State itself.
+func (s *State) PushUserdata(ctx context.Context, name string, obj any, methods map[string]func(self any, args []any) ([]any, error)) error {
+	return s.run(ctx, func() error {
+		L := s.s
+
+		s.lastObjectID++
+		id := s.lastObjectID
+		object := goObject{value: obj}
+
+		C.bridge_new_object(L, C.lua_Integer(id))
+
+		// metatable: {__index = methods, __gc = release, __name = type name}
+		C.lua_createtable(L, 0, 4)
+		C.bridge_mark_object_metatable(L)
+
+		typeName := C.CString(fmt.Sprintf("%T", obj))
+		C.lua_pushstring(L, typeName)
+		C.free(unsafe.Pointer(typeName))
+		C.lua_setfield(L, -2, cTypeName)
+
+		C.lua_createtable(L, 0, C.int(len(methods)))
+		for methodName, method := range methods {
+			cMethodName := C.CString(methodName)
+			s.pushFunction(L, s.wrapMethod(methodName, method))
+			object.funcs = append(object.funcs, s.lastFuncID)
+			C.lua_setfield(L, -2, cMethodName)
+			C.free(unsafe.Pointer(cMethodName))
+		}
+		C.lua_setfield(L, -2, cIndex)
+
+		s.pushFunction(L, func(L *C.lua_State) (int, error) {
+			if id := C.bridge_object_id(L, 1); id != 0 {
+				s.releaseObject(int64(id))
+			}
+			return 0, nil
+		})
+		object.funcs = append(object.funcs, s.lastFuncID)
+		C.lua_setfield(L, -2, cGC)
+
+		s.objects[id] = object
+
+		C.lua_setmetatable(L, -2)
+
+		return s.storeGlobal(L, name)
+	})
+}
+
+// wrapMethod wraps a method of Go objects as an internal function,
+// which is called with the userdata of the object as the first argument.
+func (s *State) wrapMethod(name string, method func(self any, args []any) ([]any, error)) function {
+	return func(L *C.lua_State) (int, error) {
+		obj, ok := s.object(L, 1)
+		if !ok {
+			return 0, fmt.Errorf("method '%s' should be called on its object (e.g. `obj:%s()`)", name, name)
+		}
+		return s.wrapGoFunction(name, func(args []any) ([]any, error) {
+			return method(obj, args[1:])
+		})(L)
+	}
+}
+
+// object returns the Go object held by the userdata at the given index, if any.
+// This function must be called from within the locked OS thread.
+func (s *State) object(L *C.lua_State, idx C.int) (any, bool) {
+	id := C.bridge_object_id(L, idx)
+	if id == 0 {
+		return nil, false
+	}
+	obj, ok := s.objects[int64(id)]
+	return obj.value, ok
+}
+
+// releaseObject releases the Go object with the given id, and the functions in its metatable.
+// This function must be called from within the locked OS thread.
+func (s *State) releaseObject(id int64) {
+	for _, funcID := range s.objects[id].funcs {
+		delete(s.funcs, funcID)
+	}
+	delete(s.objects, id)
+}
@@ -0,0 +1,89 @@
+// metrics.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+)
+
+// MetricsSink receives metrics emitted by scripts through the `metrics` module.
+type MetricsSink interface {
+	// Inc increments a counter.
+	Inc(name string, value float64, tags map[string]string)
+
+	// Observe records a value for a histogram (or summary).
+	Observe(name string, value float64, tags map[string]string)
+}
+
+// SetMetricsSink registers a `metrics` module which forwards metrics to the given sink:
+//
+//	metrics.inc(name, [value = 1], [tags])
+//	metrics.observe(name, value, [tags])
+//
+// Tags are given as a Lua table, and converted to labels with string keys and values.
+func (s *State) SetMetricsSink(ctx context.Context, sink MetricsSink) error {
+	return s.RegisterModule(ctx, "metrics", map[string]GoFunction{
+		"inc": func(args []any) ([]any, error) {
+			name, value, tags, err := metricArgs(args, 1)
+			if err != nil {
+				return nil, fmt.Errorf("metrics.inc: %w", err)
+			}
+			sink.Inc(name, value, tags)
+			return nil, nil
+		},
+		"observe": func(args []any) ([]any, error) {
+			name, value, tags, err := metricArgs(args, 0)
+			if err != nil {
+				return nil, fmt.Errorf("metrics.observe: %w", err)
+			}
+			sink.Observe(name, value, tags)
+			return nil, nil
+		},
+	})
+}
+
+// metricArgs converts the arguments of a metrics function (name, value, tags).
+//
+// If defaultValue is not 0, the value can be omitted.
+func metricArgs(args []any, defaultValue float64) (name string, value float64, tags map[string]string, err error) {
+	if len(args) < 1 {
+		return "", 0, nil, fmt.Errorf("name is missing")
+	}
+	var ok bool
+	if name, ok = args[0].(string); !ok {
+		return "", 0, nil, fmt.Errorf("name should be a string, got %T", args[0])
+	}
+
+	value = defaultValue
+	if len(args) > 1 && args[1] != nil {
+		switch v := args[1].(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			return "", 0, nil, fmt.Errorf("value should be a number, got %T", args[1])
+		}
+	} else if defaultValue == 0 {
+		return "", 0, nil, fmt.Errorf("value is missing")
+	}
+
+	if len(args) > 2 && args[2] != nil {
+		tags = map[string]string{}
+		switch t := args[2].(type) {
+		case map[any]any:
+			for k, v := range t {
+				tags[fmt.Sprint(k)] = fmt.Sprint(v)
+			}
+		case []any: // empty or array-like table
+			for i, v := range t {
+				tags[fmt.Sprint(i+1)] = fmt.Sprint(v)
+			}
+		default:
+			return "", 0, nil, fmt.Errorf("tags should be a table, got %T", args[2])
+		}
+	}
+
+	return name, value, tags, nil
+}
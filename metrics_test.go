@@ -0,0 +1,71 @@
+package lua
+
+import (
+	"context"
+	"testing"
+)
+
+// metric is a metric recorded by testSink.
+type metric struct {
+	kind  string
+	name  string
+	value float64
+	tags  map[string]string
+}
+
+// testSink is a MetricsSink which records metrics.
+type testSink struct {
+	metrics []metric
+}
+
+func (s *testSink) Inc(name string, value float64, tags map[string]string) {
+	s.metrics = append(s.metrics, metric{"inc", name, value, tags})
+}
+
+func (s *testSink) Observe(name string, value float64, tags map[string]string) {
+	s.metrics = append(s.metrics, metric{"observe", name, value, tags})
+}
+
+// TestSetMetricsSink tests emitting metrics from scripts.
+func TestSetMetricsSink(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	sink := &testSink{}
+	if err := s.SetMetricsSink(ctx, sink); err != nil {
+		t.Fatalf("SetMetricsSink failed with error: %v", err)
+	}
+
+	err := s.Execute(ctx, `
+		metrics.inc("hits", 1)
+		metrics.inc("visits")
+		require("metrics").observe("latency", 0.25, {route = "/", code = 200})
+	`)
+	if err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	if len(sink.metrics) != 3 {
+		t.Fatalf("Expected 3 metrics, got %v", sink.metrics)
+	}
+	if m := sink.metrics[0]; m.kind != "inc" || m.name != "hits" || m.value != 1 || m.tags != nil {
+		t.Errorf(`Expected metrics.inc("hits", 1), got %v`, m)
+	}
+	if m := sink.metrics[1]; m.kind != "inc" || m.name != "visits" || m.value != 1 {
+		t.Errorf(`Expected metrics.inc("visits"), got %v`, m)
+	}
+	if m := sink.metrics[2]; m.kind != "observe" ||
+		m.name != "latency" ||
+		m.value != 0.25 ||
+		m.tags["route"] != "/" ||
+		m.tags["code"] != "200" {
+		t.Errorf(`Expected metrics.observe("latency", 0.25, {route = "/", code = 200}), got %v`, m)
+	}
+
+	// invalid arguments raise a Lua error
+	if err := s.Execute(ctx, `metrics.observe("latency")`); err == nil {
+		t.Error("Expected error for a missing value, got nil")
+	}
+}
@@ -0,0 +1,75 @@
+// pool.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Pool is a fixed-size pool of States, for running Lua code concurrently.
+//
+// Each State runs its operations one at a time, so concurrent workloads
+// should borrow a State from the pool for each unit of work.
+type Pool struct {
+	states chan *State
+	all    []*State
+
+	closeOnce sync.Once
+}
+
+// NewPool creates a pool of size States, running init (if not nil) on each of them,
+// e.g. for registering Go functions or executing an init script.
+//
+// If init fails for any State, all created States are closed and the error is returned.
+func NewPool(size int, init func(*State) error) (*Pool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid pool size: %d", size)
+	}
+
+	p := &Pool{
+		states: make(chan *State, size),
+	}
+	for i := range size {
+		s := NewState()
+		p.all = append(p.all, s)
+
+		if init != nil {
+			if err := init(s); err != nil {
+				p.Close()
+				return nil, fmt.Errorf("failed to initialize state %d: %w", i, err)
+			}
+		}
+		p.states <- s
+	}
+
+	return p, nil
+}
+
+// Get borrows a State from the pool, waiting until one is available or ctx is done.
+//
+// The returned function returns the State to the pool, and must be called
+// exactly once when the State is not used anymore.
+func (p *Pool) Get(ctx context.Context) (*State, func(), error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case s := <-p.states:
+		var once sync.Once
+		return s, func() {
+			once.Do(func() { p.states <- s })
+		}, nil
+	}
+}
+
+// Close closes all States of the pool.
+//
+// States should not be borrowed from (or used after returning to) a closed pool.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		for _, s := range p.all {
+			s.Close()
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPool tests evaluating Lua code concurrently through a pool.
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+
+	pool, err := NewPool(4, func(s *State) error {
+		return s.Execute(ctx, `function square(n) return n * n end`)
+	})
+	if err != nil {
+		t.Fatalf("NewPool failed with error: %v", err)
+	}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s, release, err := pool.Get(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer release()
+
+			results, err := s.CallGlobal(ctx, "square", i)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if results[0] != int64(i*i) {
+				errs <- errors.New("unexpected result")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent evaluation failed with error: %v", err)
+	}
+}
+
+// TestPoolTimeout tests waiting for a State when all of them are in use.
+func TestPoolTimeout(t *testing.T) {
+	pool, err := NewPool(1, nil)
+	if err != nil {
+		t.Fatalf("NewPool failed with error: %v", err)
+	}
+	defer pool.Close()
+
+	_, release, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get failed with error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// returned states can be borrowed again
+	release()
+	release() // no-op
+	if _, release, err := pool.Get(context.Background()); err != nil {
+		t.Errorf("Get failed with error: %v", err)
+	} else {
+		release()
+	}
+
+	// init errors
+	if _, err := NewPool(2, func(s *State) error { return errors.New("init failed") }); err == nil {
+		t.Error("Expected error from init, got nil")
+	}
+}
@@ -0,0 +1,65 @@
+// safe.go
+
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SafeOptions is a set of options for EvaluateSafe.
+type SafeOptions struct {
+	// Timeout is the maximum execution time of each attempt (zero for no timeout).
+	Timeout time.Duration
+
+	// Retries is the number of retries when an attempt times out (zero for no retry).
+	Retries int
+
+	// Backoff is the delay before each retry.
+	Backoff time.Duration
+}
+
+// EvaluateSafe evaluates a string of Lua code in a fresh environment (see EvaluateIsolated)
+// with the given timeout, and returns its results.
+//
+// When an attempt times out, it is retried up to opts.Retries times, each with a clean environment.
+// If all attempts fail, the returned error reports all of them.
+func (s *State) EvaluateSafe(ctx context.Context, code string, opts SafeOptions) ([]any, error) {
+	var errs []error
+
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 && opts.Backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, errors.Join(append(errs, ctx.Err())...)
+			case <-time.After(opts.Backoff):
+			}
+		}
+
+		results, err := s.evaluateAttempt(ctx, code, opts.Timeout)
+		if err == nil {
+			return results, nil
+		}
+		errs = append(errs, fmt.Errorf("attempt %d: %w", attempt+1, err))
+
+		// retry only when the attempt itself timed out
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// evaluateAttempt evaluates a string of Lua code in a fresh environment with the given timeout.
+func (s *State) evaluateAttempt(ctx context.Context, code string, timeout time.Duration) ([]any, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return s.EvaluateIsolated(ctx, code)
+}
@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestEvaluateSafe tests evaluating with retries on timeout.
+func TestEvaluateSafe(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// (an interrupted attempt may still be running when EvaluateSafe returns)
+	var attempts atomic.Int64
+	if err := s.RegisterFunction(ctx, "attempt", func(args []any) ([]any, error) {
+		return []any{attempts.Add(1)}, nil
+	}); err != nil {
+		t.Fatalf("RegisterFunction failed with error: %v", err)
+	}
+
+	// times out on the first attempt, but succeeds on retry
+	code := `
+		leaked = true
+		if attempt() == 1 then
+			while true do end
+		end
+		return "ok", leaked
+	`
+	results, err := s.EvaluateSafe(ctx, code, SafeOptions{
+		Timeout: 100 * time.Millisecond,
+		Retries: 1,
+		Backoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("EvaluateSafe failed with error: %v", err)
+	}
+	if len(results) != 2 || results[0].(string) != "ok" || results[1].(bool) != true {
+		t.Errorf("EvaluateSafe returned %v, want [ok true]", results)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts.Load())
+	}
+
+	// writes to globals are not leaked
+	if val, err := s.GetGlobal(ctx, "leaked"); err != nil || val != nil {
+		t.Errorf(`GetGlobal("leaked") = %v, want nil`, val)
+	}
+
+	// no retry by default
+	attempts.Store(0)
+	_, err = s.EvaluateSafe(ctx, code, SafeOptions{Timeout: 100 * time.Millisecond})
+	if err == nil || attempts.Load() != 1 {
+		t.Errorf("Expected an error after 1 attempt, got %v after %d attempts", err, attempts.Load())
+	}
+
+	// all attempts are reported
+	_, err = s.EvaluateSafe(ctx, `while true do end`, SafeOptions{
+		Timeout: 50 * time.Millisecond,
+		Retries: 1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "attempt 1") || !strings.Contains(err.Error(), "attempt 2") {
+		t.Errorf("Expected errors of both attempts, got %v", err)
+	}
+
+	// errors other than timeouts are not retried
+	attempts.Store(0)
+	_, err = s.EvaluateSafe(ctx, `attempt() error("fail")`, SafeOptions{Retries: 3})
+	if err == nil || attempts.Load() != 1 {
+		t.Errorf("Expected an error after 1 attempt, got %v after %d attempts", err, attempts.Load())
+	}
+}
@@ -0,0 +1,28 @@
+// sink.go
+
+package lua
+
+import (
+	"context"
+)
+
+// SetChannelSink registers a global Lua function with the given name (e.g. `emit`)
+// which sends its argument (converted to a Go value) to the given channel.
+//
+// It lets scripts stream values out to the host incrementally. When the channel is full,
+// the function blocks until the value is received, or the running operation is cancelled.
+func (s *State) SetChannelSink(ctx context.Context, name string, ch chan<- any) error {
+	return s.RegisterFunctionContext(ctx, name, func(ctx context.Context, args []any) ([]any, error) {
+		var value any
+		if len(args) > 0 {
+			value = args[0]
+		}
+
+		select {
+		case ch <- value:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+}
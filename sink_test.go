@@ -0,0 +1,41 @@
+package lua
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestSetChannelSink tests streaming values from scripts to a Go channel.
+func TestSetChannelSink(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	ch := make(chan any, 2)
+	if err := s.SetChannelSink(ctx, "emit", ch); err != nil {
+		t.Fatalf("SetChannelSink failed with error: %v", err)
+	}
+
+	if err := s.Execute(ctx, `emit(1); emit("two")`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if v := <-ch; v.(int64) != 1 {
+		t.Errorf("Expected 1 from the channel, got %v", v)
+	}
+	if v := <-ch; v.(string) != "two" {
+		t.Errorf("Expected two from the channel, got %v", v)
+	}
+
+	// blocked on a full channel, but cancelled
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Execute(timeoutCtx, `for i = 1, 3 do emit(i) end`); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, but got %v", err)
+	}
+	if len(ch) != 2 {
+		t.Errorf("Expected 2 values in the channel, got %d", len(ch))
+	}
+}
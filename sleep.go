@@ -0,0 +1,40 @@
+// sleep.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OpenSleep registers a global Lua function `sleep(seconds)` which pauses the script
+// with a Go timer, instead of busy-waiting.
+//
+// The sleep is interrupted (with an error) when the running operation is cancelled,
+// and sleeping longer than maxDuration raises an error.
+func (s *State) OpenSleep(ctx context.Context, maxDuration time.Duration) error {
+	return s.RegisterFunctionContext(ctx, "sleep", func(ctx context.Context, args []any) ([]any, error) {
+		seconds, ok := numberArg(args, 0)
+		if !ok || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < 0 {
+			return nil, fmt.Errorf("sleep: duration should be a non-negative finite number of seconds")
+		}
+
+		// (compare before converting, as huge values overflow time.Duration)
+		if seconds > maxDuration.Seconds() {
+			return nil, fmt.Errorf("sleep: duration %vs exceeds the maximum (%v)", seconds, maxDuration)
+		}
+		d := min(time.Duration(seconds*float64(time.Second)), maxDuration)
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package lua
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestOpenSleep tests the cancellable `sleep` function.
+func TestOpenSleep(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.OpenSleep(ctx, 5*time.Second); err != nil {
+		t.Fatalf("OpenSleep failed with error: %v", err)
+	}
+
+	// sleep
+	start := time.Now()
+	if err := s.Execute(ctx, `sleep(0.05)`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to sleep at least 50ms, but slept %v", elapsed)
+	}
+
+	// returns promptly on cancellation
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	if err := s.Execute(timeoutCtx, `sleep(3)`); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected sleep to be cancelled promptly, but took %v", elapsed)
+	}
+
+	// exceeding the maximum
+	if err := s.Execute(ctx, `sleep(10)`); err == nil {
+		t.Error("Expected error for exceeding the maximum sleep duration, got nil")
+	}
+	for _, code := range []string{`sleep(-1)`, `sleep(math.huge)`, `sleep(-math.huge)`, `sleep(0/0)`, `sleep(1e300)`, `sleep(2^63)`} {
+		start := time.Now()
+		if err := s.Execute(ctx, code); err == nil {
+			t.Errorf("Expected error for `%s`, got nil", code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected `%s` to fail promptly, but took %v", code, elapsed)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// typed.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/meinside/lua-go/luasrc"
+)
+
+// EvaluateTyped evaluates a string of Lua code which returns a single value,
+// and returns it converted to type T.
+//
+// The value is converted like UnmarshalGlobal: numbers are coerced to numeric types of T
+// (e.g. int64 to int or float64, or a float64 with an integral value to int) as long as they
+// fit without loss, and tables are converted to structs, slices, arrays, or maps.
+func EvaluateTyped[T any](ctx context.Context, s *State, code string) (T, error) {
+	var zero T
+
+	results, err := s.Evaluate(ctx, code)
+	if err != nil {
+		return zero, err
+	}
+	if len(results) != 1 {
+		return zero, fmt.Errorf("expected a single result, got %d", len(results))
+	}
+
+	return convertTo[T](results[0])
+}
+
+// GetGlobalTyped gets a global variable from the Lua state, converted to type T.
+//
+// Numbers are coerced like EvaluateTyped.
+func GetGlobalTyped[T any](ctx context.Context, s *State, name string) (T, error) {
+	value, err := s.GetGlobal(ctx, name)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	v, err := convertTo[T](value)
+	if err != nil {
+		return v, fmt.Errorf("global '%s': %w", name, err)
+	}
+	return v, nil
+}
+
+// convertTo converts a Go value (converted from Lua) to type T, like UnmarshalGlobal,
+// but rejecting nil for types which cannot be nil.
+func convertTo[T any](value any) (T, error) {
+	var zero T
+
+	if v, ok := value.(T); ok {
+		return v, nil
+	}
+
+	if value == nil {
+		switch typ := reflect.TypeFor[T](); typ.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Slice, reflect.Map:
+			return zero, nil
+		default:
+			return zero, fmt.Errorf("cannot convert nil to %v", typ)
+		}
+	}
+
+	var v T
+	if err := luasrc.Unmarshal(value, &v); err != nil {
+		return zero, err
+	}
+	return v, nil
+}
+
+// UnmarshalGlobal converts a global variable into the value pointed to by out
+// (e.g. a pointer to a struct), which is the inverse of SetGlobal.
+func UnmarshalGlobal(ctx context.Context, s *State, name string, out any) error {
+	return s.s.UnmarshalGlobal(ctx, name, out)
+}
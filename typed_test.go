@@ -0,0 +1,94 @@
+package lua
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// TestEvaluateTyped tests evaluating a single value of a specific type.
+func TestEvaluateTyped(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if v, err := EvaluateTyped[int](ctx, s, `return 40 + 2`); err != nil || v != 42 {
+		t.Errorf("EvaluateTyped[int] = %v (error: %v), want 42", v, err)
+	}
+	if v, err := EvaluateTyped[float64](ctx, s, `return 42`); err != nil || v != 42.0 {
+		t.Errorf("EvaluateTyped[float64] = %v (error: %v), want 42.0", v, err)
+	}
+	if v, err := EvaluateTyped[int](ctx, s, `return 2^3`); err != nil || v != 8 {
+		t.Errorf("EvaluateTyped[int] = %v (error: %v), want 8", v, err)
+	}
+	if v, err := EvaluateTyped[uint8](ctx, s, `return 255`); err != nil || v != 255 {
+		t.Errorf("EvaluateTyped[uint8] = %v (error: %v), want 255", v, err)
+	}
+	if v, err := EvaluateTyped[string](ctx, s, `return "hello"`); err != nil || v != "hello" {
+		t.Errorf("EvaluateTyped[string] = %v (error: %v), want hello", v, err)
+	}
+	if v, err := EvaluateTyped[[]any](ctx, s, `return {1, 2, 3}`); err != nil || len(v) != 3 {
+		t.Errorf("EvaluateTyped[[]any] = %v (error: %v), want [1 2 3]", v, err)
+	}
+
+	// tables are converted like UnmarshalGlobal
+	if v, err := EvaluateTyped[[]int](ctx, s, `return {1, 2.0, 3}`); err != nil || !reflect.DeepEqual(v, []int{1, 2, 3}) {
+		t.Errorf("EvaluateTyped[[]int] = %v (error: %v), want [1 2 3]", v, err)
+	}
+	type point struct {
+		X, Y float64
+	}
+	if v, err := EvaluateTyped[point](ctx, s, `return {X = 1, Y = 2.5}`); err != nil || v != (point{1, 2.5}) {
+		t.Errorf("EvaluateTyped[point] = %v (error: %v), want {1 2.5}", v, err)
+	}
+	if v, err := EvaluateTyped[map[string]int](ctx, s, `return {a = 1}`); err != nil || !reflect.DeepEqual(v, map[string]int{"a": 1}) {
+		t.Errorf("EvaluateTyped[map[string]int] = %v (error: %v), want map[a:1]", v, err)
+	}
+
+	// conversion errors
+	for code, fn := range map[string]func() error{
+		`return 1.5`:   func() error { _, err := EvaluateTyped[int](ctx, s, `return 1.5`); return err },
+		`return 256`:   func() error { _, err := EvaluateTyped[uint8](ctx, s, `return 256`); return err },
+		`return -1`:    func() error { _, err := EvaluateTyped[uint](ctx, s, `return -1`); return err },
+		`return "42"`:  func() error { _, err := EvaluateTyped[int](ctx, s, `return "42"`); return err },
+		`return nil`:   func() error { _, err := EvaluateTyped[string](ctx, s, `return nil`); return err },
+		`return 1, 2`:  func() error { _, err := EvaluateTyped[int](ctx, s, `return 1, 2`); return err },
+		`return a b c`: func() error { _, err := EvaluateTyped[int](ctx, s, `return a b c`); return err },
+	} {
+		if err := fn(); err == nil {
+			t.Errorf("Expected error for `%s`, got nil", code)
+		}
+	}
+}
+
+// TestGetGlobalTyped tests getting a global variable of a specific type.
+func TestGetGlobalTyped(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.Execute(ctx, `count = 3; ratio = 0.5; name = "lua"`); err != nil {
+		t.Fatalf("Execute failed with error: %v", err)
+	}
+
+	if v, err := GetGlobalTyped[int](ctx, s, "count"); err != nil || v != 3 {
+		t.Errorf("GetGlobalTyped[int] = %v (error: %v), want 3", v, err)
+	}
+	if v, err := GetGlobalTyped[float32](ctx, s, "ratio"); err != nil || v != 0.5 {
+		t.Errorf("GetGlobalTyped[float32] = %v (error: %v), want 0.5", v, err)
+	}
+	if v, err := GetGlobalTyped[string](ctx, s, "name"); err != nil || v != "lua" {
+		t.Errorf("GetGlobalTyped[string] = %v (error: %v), want lua", v, err)
+	}
+	if _, err := GetGlobalTyped[int](ctx, s, "name"); err == nil {
+		t.Error("Expected error for converting a string to int, got nil")
+	}
+	if _, err := GetGlobalTyped[int](ctx, s, "non_existent"); err == nil {
+		t.Error("Expected error for a non-existent global, got nil")
+	}
+	if v, err := GetGlobalTyped[any](ctx, s, "non_existent"); err != nil || v != nil {
+		t.Errorf("GetGlobalTyped[any] = %v (error: %v), want nil", v, err)
+	}
+}
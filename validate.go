@@ -0,0 +1,132 @@
+// validate.go
+
+package lua
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"unicode/utf8"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// OpenValidate registers a `validate` module with the default validators
+// (see ValidateFunctions), so that scripts share the validation logic of the host.
+func (s *State) OpenValidate(ctx context.Context) error {
+	return s.RegisterModule(ctx, "validate", ValidateFunctions())
+}
+
+// ValidateFunctions returns the default validators of the `validate` module:
+//
+//	validate.is_email(s)
+//	validate.is_url(s)
+//	validate.is_uuid(s)
+//	validate.in_range(n, lo, hi)
+//	validate.length(s, min, max)
+//	validate.matches(s, pattern) -- pattern is a Go regular expression
+//
+// Each validator returns a boolean. Values of unexpected types are reported as invalid.
+//
+// The returned map can be extended with custom validators before registering it with RegisterModule.
+func ValidateFunctions() map[string]GoFunction {
+	return map[string]GoFunction{
+		"is_email": validator(func(args []any) (bool, error) {
+			str, ok := arg[string](args, 0)
+			if !ok {
+				return false, nil
+			}
+			addr, err := mail.ParseAddress(str)
+			return err == nil && addr.Address == str, nil
+		}),
+		"is_url": validator(func(args []any) (bool, error) {
+			str, ok := arg[string](args, 0)
+			if !ok {
+				return false, nil
+			}
+			u, err := url.ParseRequestURI(str)
+			return err == nil && u.Scheme != "" && u.Host != "", nil
+		}),
+		"is_uuid": validator(func(args []any) (bool, error) {
+			str, ok := arg[string](args, 0)
+			return ok && uuidRegexp.MatchString(str), nil
+		}),
+		"in_range": validator(func(args []any) (bool, error) {
+			n, ok := numberArg(args, 0)
+			if !ok {
+				return false, nil
+			}
+			lo, okLo := numberArg(args, 1)
+			hi, okHi := numberArg(args, 2)
+			if !okLo || !okHi {
+				return false, fmt.Errorf("in_range: lower and upper bounds should be numbers")
+			}
+			return lo <= n && n <= hi, nil
+		}),
+		"length": validator(func(args []any) (bool, error) {
+			str, ok := arg[string](args, 0)
+			if !ok {
+				return false, nil
+			}
+			lo, okLo := numberArg(args, 1)
+			hi, okHi := numberArg(args, 2)
+			if !okLo || !okHi {
+				return false, fmt.Errorf("length: min and max lengths should be numbers")
+			}
+			l := float64(utf8.RuneCountInString(str))
+			return lo <= l && l <= hi, nil
+		}),
+		"matches": validator(func(args []any) (bool, error) {
+			str, ok := arg[string](args, 0)
+			if !ok {
+				return false, nil
+			}
+			pattern, ok := arg[string](args, 1)
+			if !ok {
+				return false, fmt.Errorf("matches: pattern should be a string")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, fmt.Errorf("matches: %w", err)
+			}
+			return re.MatchString(str), nil
+		}),
+	}
+}
+
+// validator converts a validation function to a GoFunction.
+func validator(fn func(args []any) (bool, error)) GoFunction {
+	return func(args []any) ([]any, error) {
+		valid, err := fn(args)
+		if err != nil {
+			return nil, err
+		}
+		return []any{valid}, nil
+	}
+}
+
+// arg returns the argument at the given index as type T.
+func arg[T any](args []any, i int) (T, bool) {
+	var v T
+	if i >= len(args) {
+		return v, false
+	}
+	v, ok := args[i].(T)
+	return v, ok
+}
+
+// numberArg returns the numeric argument at the given index as a float64.
+func numberArg(args []any, i int) (float64, bool) {
+	if i >= len(args) {
+		return 0, false
+	}
+	switch v := args[i].(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,44 @@
+package lua
+
+import (
+	"context"
+	"testing"
+)
+
+// TestOpenValidate tests the validators of the `validate` module.
+func TestOpenValidate(t *testing.T) {
+	s := NewState()
+	defer s.Close()
+
+	ctx := context.Background()
+
+	if err := s.OpenValidate(ctx); err != nil {
+		t.Fatalf("OpenValidate failed with error: %v", err)
+	}
+
+	for code, expected := range map[string]bool{
+		`return validate.is_email("user@example.com")`:                    true,
+		`return validate.is_email("not an email")`:                        false,
+		`return validate.is_email(42)`:                                    false,
+		`return validate.is_url("https://example.com/path")`:              true,
+		`return validate.is_url("example.com")`:                           false,
+		`return validate.is_uuid("123e4567-e89b-12d3-a456-426614174000")`: true,
+		`return validate.in_range(5, 1, 10)`:                              true,
+		`return validate.in_range(10.5, 1, 10)`:                           false,
+		`return validate.length("héllo", 1, 5)`:                           true,
+		`return validate.matches("abc123", "^[a-z]+[0-9]+$")`:             true,
+		`return require("validate").matches("123abc", "^[a-z]+[0-9]+$")`:  false,
+	} {
+		results, err := s.Evaluate(ctx, code)
+		if err != nil {
+			t.Errorf("Evaluate(`%s`) failed with error: %v", code, err)
+		} else if len(results) != 1 || results[0].(bool) != expected {
+			t.Errorf("Evaluate(`%s`) = %v, want [%v]", code, results, expected)
+		}
+	}
+
+	// invalid arguments raise a Lua error
+	if _, err := s.Evaluate(ctx, `return validate.in_range(5, "a", 10)`); err == nil {
+		t.Error("Expected error for invalid bounds, got nil")
+	}
+}